@@ -8,15 +8,21 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
+	"path"
 	"slices"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	"github.com/douglarek/llmverse/config"
+	"github.com/douglarek/llmverse/metrics"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/llms/bedrock"
 	"github.com/tmc/langchaingo/llms/googleai"
@@ -25,10 +31,20 @@ import (
 	"github.com/tmc/langchaingo/memory"
 )
 
-func buildModelsFromConfig(settings config.Settings) map[string]llms.Model {
+// harmThresholds maps the harm_threshold settings to the Gemini safety thresholds.
+var harmThresholds = map[string]googleai.HarmBlockThreshold{
+	"":                         googleai.HarmBlockNone,
+	config.HarmThresholdNone:   googleai.HarmBlockNone,
+	config.HarmThresholdLow:    googleai.HarmBlockLowAndAbove,
+	config.HarmThresholdMedium: googleai.HarmBlockMediumAndAbove,
+	config.HarmThresholdHigh:   googleai.HarmBlockOnlyHigh,
+}
+
+func buildModelsFromConfig(settings config.Settings) (map[string]llms.Model, map[string]*rateLimit, error) {
 	var model llms.Model
 	var err error
 	models := make(map[string]llms.Model)
+	rateLimits := make(map[string]*rateLimit)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -38,26 +54,49 @@ func buildModelsFromConfig(settings config.Settings) map[string]llms.Model {
 			continue
 		}
 
+		rl := &rateLimit{}
+		var next doer = endUserDoer{}
+		if fields := thinkingFields(v); fields != nil {
+			next = &fieldsDoer{next: next, fields: fields}
+		}
+		if settings.IsReasoningModel(v.Name) {
+			next = &reasoningDoer{next: next}
+		}
+		if v.HTTPReferer != "" || v.XTitle != "" { // app attribution of openrouter
+			header := make(http.Header)
+			if v.HTTPReferer != "" {
+				header.Set("HTTP-Referer", v.HTTPReferer)
+			}
+			if v.XTitle != "" {
+				header.Set("X-Title", v.XTitle)
+			}
+			next = &headerDoer{next: next, header: header}
+		}
+		client := &rateLimitDoer{next: next, limit: rl, throttle: settings.ThrottleRateLimits}
+
 		switch v.Name {
-		case config.OpenAI, config.Groq, config.Deepseek, config.Qwen, config.ChatGLM, config.Lingyiwanwu:
+		case config.OpenAI, config.Groq, config.Deepseek, config.Qwen, config.ChatGLM, config.Lingyiwanwu, config.Grok, config.OpenRouter:
+			rateLimits[v.Name] = rl
 			model, err = openai.New(
 				openai.WithToken(v.APIKey),
 				openai.WithModel(v.Model),
 				openai.WithBaseURL(v.BaseURL),
+				openai.WithHTTPClient(client),
 			)
 		case config.Google:
 			model, err = googleai.New(ctx,
 				googleai.WithAPIKey(v.APIKey),
 				googleai.WithDefaultModel(v.Model),
-				googleai.WithHarmThreshold(googleai.HarmBlockNone),
+				googleai.WithHarmThreshold(harmThresholds[v.HarmThreshold]),
 			)
 		case config.Mistral:
 			model, err = mistral.New(
 				mistral.WithAPIKey(v.APIKey),
 				mistral.WithModel(v.Model),
+				mistral.WithEndpoint(v.BaseURL), // the official api if empty
 			)
 		case config.Bedrock:
-			options := bedrockruntime.New(bedrockruntime.Options{
+			o := bedrockruntime.Options{
 				Region: v.RegionName,
 				Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
 					return aws.Credentials{
@@ -65,54 +104,363 @@ func buildModelsFromConfig(settings config.Settings) map[string]llms.Model {
 						SecretAccessKey: v.SecretAccessKey,
 					}, nil
 				}),
-			})
+			}
+			if v.BaseURL != "" { // the endpoint of the region if empty
+				o.BaseEndpoint = aws.String(v.BaseURL)
+			}
+			options := bedrockruntime.New(o)
 			model, err = bedrock.New(
 				bedrock.WithModel(v.ModelID),
 				bedrock.WithClient(options),
 			)
 		case config.Azure:
+			rateLimits[v.Name] = rl
 			model, err = openai.New(
 				openai.WithToken(v.APIKey),
 				openai.WithModel(v.Model),
 				openai.WithBaseURL(v.BaseURL),
 				openai.WithAPIVersion(v.APIVersion),
 				openai.WithAPIType(openai.APITypeAzure),
+				openai.WithHTTPClient(client),
 			)
 		}
 
 		if err != nil {
-			panic(err)
+			return nil, nil, fmt.Errorf("cannot create model %s: %w", v.Name, err)
 		}
 
 		models[v.Name] = model
 	}
 
-	return models
+	return models, rateLimits, nil
+}
+
+// thinkingFields returns the request fields setting the thinking budget of the
+// model, or nil if it has none or its provider doesn't support one.
+func thinkingFields(ms config.LLMSetting) map[string]any {
+	if ms.ThinkingBudget == nil {
+		return nil
+	}
+	switch ms.Name {
+	case config.Qwen:
+		return map[string]any{"enable_thinking": true, "thinking_budget": *ms.ThinkingBudget}
+	}
+	slog.Debug("[thinkingFields] thinking_budget is not supported, ignored", "model", ms.Name)
+	return nil
 }
 
 type LLMAgent struct {
-	models   map[string]llms.Model
-	history  sync.Map
-	settings config.Settings
+	mu          sync.RWMutex // guards the fields swapped by Reload
+	models      map[string]llms.Model
+	rateLimits  map[string]*rateLimit
+	tools       map[string][]llms.Tool
+	userLimiter *userLimiter
+	moderator   Moderator
+	auditLog    AuditLog
+	slots       semaphore // the queries generating at once, up to max_concurrent_requests
+	settings    config.Settings
+
+	history      sync.Map
+	prompts      sync.Map // system prompt -> its parsed template, nil if it has none
+	guildPrompts sync.Map // guild id -> system prompt override
+	promptMu     sync.RWMutex
+	systemPrompt string         // runtime override of the global system prompt
+	lastModels   sync.Map       // history owner -> name of the model asked last
+	summaries    sync.Map       // history key -> summary of the conversation before switching to the model
+	trimmed      sync.Map       // history key -> messages were dropped from the history since the last answer
+	truncated    sync.Map       // history owner -> name of the model whose last answer was cut at the length limit
+	debug        sync.Map       // user -> the raw responses follow the answers
+	userModels   sync.Map       // user -> name of the model answering without a model selector
+	active       sync.WaitGroup // the generations in progress
+	stopOnce     sync.Once
+	stopCtx      context.Context // done once Shutdown is called
+	stop         context.CancelFunc
+	usageMu      sync.Mutex
+	usage        map[usageKey]tokenUsage // tokens used per user and model
+}
+
+// currentSettings returns the settings in effect.
+func (a *LLMAgent) currentSettings() config.Settings {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.settings
+}
+
+// model returns the model of the name.
+func (a *LLMAgent) model(name string) (llms.Model, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	m, ok := a.models[name]
+	return m, ok
+}
+
+// QueryOption customizes a single Query call.
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	guildID   string
+	channelID string
+	threadID  string
+	textFiles []string
+	pdfFiles  []string
+	schema    string
+	stateless bool
+	userName  string // who the system prompt names, the user id if empty
+}
+
+// ErrInterrupted wraps the error of a model that failed after it had already
+// streamed part of the answer.
+var ErrInterrupted = errors.New("answer interrupted")
+
+// contextTrimmedNote starts the answers of a conversation whose earliest messages
+// were dropped to fit the history limits.
+const contextTrimmedNote = "_(earlier context trimmed)_\n\n"
+
+// ContinuePrompt asks a model to go on with the answer it was cut off in.
+const ContinuePrompt = "Continue exactly where your last answer stopped, without repeating any of it."
+
+// Chunk is a piece of a streamed answer, a file that goes with the answer, or the
+// error that ended the answer. Truncated marks an answer cut at the length limit,
+// which TruncatedModel can continue.
+type Chunk struct {
+	Text       string
+	Attachment *Attachment
+	Err        error
+	Truncated  bool
+	Debug      string // the raw response of the model, for the users debugging
+}
+
+// isTruncated reports whether the stop reason of a provider means the answer hit
+// the max tokens, e.g. length, max_tokens or FinishReasonMaxTokens.
+func isTruncated(stopReason string) bool {
+	r := strings.ToLower(strings.ReplaceAll(stopReason, "_", ""))
+	r = strings.TrimPrefix(r, "finishreason")
+	return r == "length" || r == "maxtokens"
+}
+
+// Attachment is a file produced by a tool or the model, like a generated image.
+type Attachment struct {
+	Name string
+	Data []byte
+}
+
+// WithGuildID sets the guild the query comes from, so guild specific settings apply.
+func WithGuildID(guildID string) QueryOption {
+	return func(o *queryOptions) {
+		o.guildID = guildID
+	}
+}
+
+// WithChannelID sets the channel the query comes from, for the channel history scope.
+func WithChannelID(channelID string) QueryOption {
+	return func(o *queryOptions) {
+		o.channelID = channelID
+	}
+}
+
+// WithThreadID sets the thread the query comes from, for the thread history scope.
+func WithThreadID(threadID string) QueryOption {
+	return func(o *queryOptions) {
+		o.threadID = threadID
+	}
+}
+
+// WithTextFiles adds the contents of the text files at urls to the user input.
+func WithTextFiles(urls ...string) QueryOption {
+	return func(o *queryOptions) {
+		o.textFiles = append(o.textFiles, urls...)
+	}
+}
+
+// WithPDFFiles adds the text of the PDF files at urls to the user input.
+func WithPDFFiles(urls ...string) QueryOption {
+	return func(o *queryOptions) {
+		o.pdfFiles = append(o.pdfFiles, urls...)
+	}
+}
+
+// WithSchema makes the answer JSON validated against the configured schema of the name.
+func WithSchema(name string) QueryOption {
+	return func(o *queryOptions) {
+		o.schema = name
+	}
+}
+
+// WithUserName sets the name of the user, filled in for {{.User}} in the system prompt.
+func WithUserName(name string) QueryOption {
+	return func(o *queryOptions) {
+		o.userName = name
+	}
+}
+
+// WithStateless makes the query neither read nor keep the chat history.
+func WithStateless() QueryOption {
+	return func(o *queryOptions) {
+		o.stateless = true
+	}
+}
+
+// SetGuildSystemPrompt overrides the system prompt for the guild, an empty prompt
+// reverts it to the global one.
+func (a *LLMAgent) SetGuildSystemPrompt(guildID, prompt string) {
+	if prompt == "" {
+		a.guildPrompts.Delete(guildID)
+		return
+	}
+	a.guildPrompts.Store(guildID, prompt)
+}
+
+// SetSystemPrompt overrides the global system prompt at runtime, an empty prompt
+// reverts it to the configured one.
+func (a *LLMAgent) SetSystemPrompt(prompt string) {
+	a.promptMu.Lock()
+	defer a.promptMu.Unlock()
+	a.systemPrompt = prompt
+}
+
+// GlobalSystemPrompt returns the global system prompt in effect.
+func (a *LLMAgent) GlobalSystemPrompt() string {
+	a.promptMu.RLock()
+	defer a.promptMu.RUnlock()
+	if a.systemPrompt != "" {
+		return a.systemPrompt
+	}
+	return a.currentSettings().SystemPrompt
+}
+
+// SystemPrompt returns the system prompt in effect for the guild and model, the
+// guild override wins over the prompt of the model, which wins over the global one.
+func (a *LLMAgent) SystemPrompt(guildID, modelName string) string {
+	if v, ok := a.guildPrompts.Load(guildID); ok {
+		return v.(string)
+	}
+	settings := a.currentSettings()
+	settings.SystemPrompt = a.GlobalSystemPrompt() // with the runtime override
+	return settings.GetSystemPrompt(modelName)
 }
 
 func (a *LLMAgent) loadHistory(_ context.Context, model llms.Model, key string) *memory.ConversationTokenBuffer {
-	v, _ := a.history.LoadOrStore(key, memory.NewConversationTokenBuffer(model, *a.settings.HistoryMaxSize))
+	v, _ := a.history.LoadOrStore(key, memory.NewConversationTokenBuffer(model, *a.currentSettings().HistoryMaxSize))
 	return v.(*memory.ConversationTokenBuffer)
 }
 
-func (a *LLMAgent) ClearHistory(_ context.Context, user string) {
+// historyOwner returns whose conversation the query is part of in the history
+// scope, it prefixes the history keys. Without a channel or thread the history
+// falls back to the user.
+func historyOwner(scope, user string, o queryOptions) string {
+	switch {
+	case scope == config.HistoryScopeChannel && o.threadID != "":
+		return "channel:" + o.threadID // threads are channels of their own
+	case scope == config.HistoryScopeChannel && o.channelID != "":
+		return "channel:" + o.channelID
+	case scope == config.HistoryScopeThread && o.threadID != "":
+		return "thread:" + o.threadID
+	}
+	return user
+}
+
+// ClearHistory clears the history of the user, or of the channel or thread the
+// options point at in the configured history scope.
+func (a *LLMAgent) ClearHistory(_ context.Context, user string, opts ...QueryOption) {
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	owner := historyOwner(a.currentSettings().HistoryScope, user, o)
+
 	a.history.Range(func(k, v interface{}) bool {
-		slog.Debug("clearing history", "key", k, "user", user)
-		if strings.HasPrefix(k.(string), user) {
+		slog.Debug("clearing history", "key", k, "owner", owner)
+		if strings.HasPrefix(k.(string), owner+"_") {
 			a.history.Delete(k)
 		}
 		return true
 	})
-	slog.Debug("history cleared", "user", user)
+	a.summaries.Range(func(k, v interface{}) bool {
+		if strings.HasPrefix(k.(string), owner+"_") {
+			a.summaries.Delete(k)
+		}
+		return true
+	})
+	a.trimmed.Range(func(k, v interface{}) bool {
+		if strings.HasPrefix(k.(string), owner+"_") {
+			a.trimmed.Delete(k)
+		}
+		return true
+	})
+	a.truncated.Delete(owner)
+	slog.Debug("history cleared", "owner", owner)
+}
+
+// TruncatedModel returns the model whose last answer to the user, in the history
+// scope the options point at, was cut at the length limit, or "" if there is none.
+func (a *LLMAgent) TruncatedModel(user string, opts ...QueryOption) string {
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if v, ok := a.truncated.Load(historyOwner(a.currentSettings().HistoryScope, user, o)); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// ExportHistory renders the conversation the user has with the model as Markdown,
+// or with every model if modelName is empty, in the history scope the options
+// point at. It returns nil if there is no conversation.
+func (a *LLMAgent) ExportHistory(ctx context.Context, user, modelName string, opts ...QueryOption) ([]byte, error) {
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	owner := historyOwner(a.currentSettings().HistoryScope, user, o)
+
+	names := a.ModelNames()
+	if modelName != "" {
+		names = []string{modelName}
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		v, ok := a.history.Load(owner + "_" + name)
+		if !ok {
+			continue
+		}
+		messages, err := v.(*memory.ConversationTokenBuffer).ChatHistory.Messages(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "# Conversation with %s\n\n", name)
+		for _, m := range messages {
+			switch m := m.(type) {
+			case llms.HumanChatMessage:
+				fmt.Fprintf(&b, "**User:** %s\n\n", m.Content)
+			case llms.AIChatMessage:
+				if m.Content != "" {
+					fmt.Fprintf(&b, "**AI:** %s\n\n", m.Content)
+				}
+				for _, tc := range m.ToolCalls {
+					fmt.Fprintf(&b, "**AI** called `%s` with `%s`\n\n", tc.FunctionCall.Name, tc.FunctionCall.Arguments)
+				}
+			case llms.ToolChatMessage:
+				fmt.Fprintf(&b, "**Tool:** %s\n\n", m.Content)
+			}
+		}
+	}
+
+	if b.Len() == 0 {
+		return nil, nil
+	}
+	return []byte(b.String()), nil
 }
 
 func (a *LLMAgent) saveHistory(ctx context.Context, model llms.Model, key string, content ...llms.MessageContent) error {
+	if key == "" { // stateless
+		return nil
+	}
 	ch := a.loadHistory(ctx, model, key).ChatHistory
 	for _, c := range content {
 		var err error
@@ -120,21 +468,106 @@ func (a *LLMAgent) saveHistory(ctx context.Context, model llms.Model, key string
 		case llms.ChatMessageTypeHuman:
 			err = ch.AddUserMessage(ctx, c.Parts[0].(llms.TextContent).Text)
 		case llms.ChatMessageTypeAI:
-			err = ch.AddAIMessage(ctx, c.Parts[0].(llms.TextContent).Text)
+			var m llms.AIChatMessage
+			for _, p := range c.Parts {
+				switch p := p.(type) {
+				case llms.TextContent:
+					m.Content += p.Text
+				case llms.ToolCall:
+					m.ToolCalls = append(m.ToolCalls, p)
+				}
+			}
+			err = ch.AddMessage(ctx, m)
+		case llms.ChatMessageTypeTool:
+			for _, p := range c.Parts {
+				if r, ok := p.(llms.ToolCallResponse); ok {
+					if err = ch.AddMessage(ctx, llms.ToolChatMessage{ID: r.ToolCallID, Content: r.Content}); err != nil {
+						break
+					}
+				}
+			}
 		}
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	dropped, err := trimHistory(ctx, a.loadHistory(ctx, model, key), a.currentSettings().HistoryMaxMessages)
+	if dropped > 0 {
+		slog.Info("[LLMAgent.saveHistory] history trimmed", "key", key, "dropped", dropped)
+		metrics.AddHistoryTrimmed(dropped)
+		a.trimmed.Store(key, true)
+	}
+	return err
+}
+
+// countTokens counts the tokens of text, tests replace it to stay offline.
+var countTokens = func(text string) int { return llms.CountTokens("", text) }
+
+// trimHistory drops the oldest messages of the history until it fits in both its
+// token limit and maxMessages, 0 means no message limit, and then up to the next
+// user message so that no tool result is left without its call. System messages
+// are never dropped. It returns the number of messages dropped.
+func trimHistory(ctx context.Context, tb *memory.ConversationTokenBuffer, maxMessages int) (int, error) {
+	messages, err := tb.ChatHistory.Messages(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var system, turns []llms.ChatMessage
+	tokens := 0
+	for _, m := range messages {
+		if m.GetType() == llms.ChatMessageTypeSystem {
+			system = append(system, m)
+			continue
+		}
+		turns = append(turns, m)
+		tokens += countTokens(m.GetContent())
+	}
+
+	dropped := 0
+	for dropped < len(turns) && ((maxMessages > 0 && len(turns)-dropped > maxMessages) || tokens > tb.MaxTokenLimit) {
+		tokens -= countTokens(turns[dropped].GetContent())
+		dropped++
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	for dropped < len(turns) && turns[dropped].GetType() != llms.ChatMessageTypeHuman {
+		dropped++
+	}
+
+	return dropped, tb.ChatHistory.SetMessages(ctx, append(system, turns[dropped:]...))
+}
+
+// updateHistory replaces the trailing AI message of the history with text, or
+// appends a new one if the history doesn't end with an AI message yet.
+func (a *LLMAgent) updateHistory(ctx context.Context, model llms.Model, key, text string) error {
+	if key == "" { // stateless
+		return nil
+	}
+	ch := a.loadHistory(ctx, model, key).ChatHistory
+	messages, err := ch.Messages(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n := len(messages); n > 0 && messages[n-1].GetType() == llms.ChatMessageTypeAI {
+		messages[n-1] = llms.AIChatMessage{Content: text}
+		return ch.SetMessages(ctx, messages)
+	}
+	return ch.AddAIMessage(ctx, text)
 }
 
 func (a *LLMAgent) historyToContent(ctx context.Context, model llms.Model, key string) []llms.MessageContent {
+	if key == "" { // stateless
+		return nil
+	}
 	var content []llms.MessageContent
 
 	chatHistory := a.loadHistory(ctx, model, key).ChatHistory
 	cm, _ := chatHistory.Messages(ctx)
 
+	toolNames := make(map[string]string) // tool call id -> tool name, tool messages only keep the id
 	for _, m := range cm {
 		switch m.GetType() {
 		case llms.ChatMessageTypeHuman:
@@ -145,33 +578,186 @@ func (a *LLMAgent) historyToContent(ctx context.Context, model llms.Model, key s
 			})
 		case llms.ChatMessageTypeAI:
 			parts := []llms.ContentPart{llms.TextPart(m.GetContent())}
+			if am, ok := m.(llms.AIChatMessage); ok {
+				for _, tc := range am.ToolCalls {
+					toolNames[tc.ID] = tc.FunctionCall.Name
+					parts = append(parts, tc)
+				}
+			}
 			content = append(content, llms.MessageContent{
 				Role:  llms.ChatMessageTypeAI,
 				Parts: parts,
 			})
-			// for tool message, temporarily not known how to handle or is it necessary to handle
+		case llms.ChatMessageTypeTool:
+			tm, ok := m.(llms.ToolChatMessage)
+			if !ok {
+				continue
+			}
+			parts := []llms.ContentPart{llms.ToolCallResponse{
+				ToolCallID: tm.ID,
+				Name:       toolNames[tm.ID],
+				Content:    tm.Content,
+			}}
+			content = append(content, llms.MessageContent{
+				Role:  llms.ChatMessageTypeTool,
+				Parts: parts,
+			})
 		}
 	}
 
 	return content
 }
 
-func downloadImage(_ context.Context, url string) ([]byte, error) {
-	c := &http.Client{Timeout: 1 * time.Minute}
-	resp, err := c.Get(url)
+const summaryPrompt = "Summarize the following conversation between a user and an AI assistant in a few sentences, keep the facts, names and open questions that matter to continue it."
+
+// summarizeOnSwitch summarizes the conversation the history owner had with the
+// previous model when switching to modelName, so the new model can continue it.
+func (a *LLMAgent) summarizeOnSwitch(ctx context.Context, modelName, owner string) {
+	last, ok := a.lastModels.Swap(owner, modelName)
+	if !ok || last.(string) == modelName {
+		return
+	}
+	lastModel, ok := a.model(last.(string))
+	if !ok {
+		return
+	}
+
+	historyKey := owner + "_" + modelName
+	model, _ := a.model(modelName)
+	if messages, _ := a.loadHistory(ctx, model, historyKey).ChatHistory.Messages(ctx); len(messages) > 0 {
+		return // only the first turn of the new model gets the summary
+	}
+	messages, _ := a.loadHistory(ctx, lastModel, owner+"_"+last.(string)).ChatHistory.Messages(ctx)
+	if len(messages) == 0 {
+		return
+	}
+
+	conversation, err := llms.GetBufferString(messages, "User", "AI")
+	if err != nil {
+		slog.Error("[LLMAgent.summarizeOnSwitch] failed to render history", "error", err)
+		return
+	}
+
+	summarizer := lastModel
+	if m, ok := a.model(a.currentSettings().SummaryModel); ok {
+		summarizer = m
+	}
+	resp, err := summarizer.GenerateContent(ctx, []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, summaryPrompt),
+		llms.TextParts(llms.ChatMessageTypeHuman, conversation),
+	}, llms.WithMaxTokens(512))
+	if err != nil || len(resp.Choices) == 0 {
+		slog.Error("[LLMAgent.summarizeOnSwitch] failed to summarize history", "error", err)
+		return
+	}
+
+	slog.Debug("[LLMAgent.summarizeOnSwitch] summary", "owner", owner, "from", last, "to", modelName, "summary", resp.Choices[0].Content)
+	a.summaries.Store(historyKey, resp.Choices[0].Content)
+}
+
+// IsImageFile reports whether the file is an image of one of the allowed types.
+func (a *LLMAgent) IsImageFile(name string) bool {
+	return slices.Contains(a.currentSettings().AllowedImageTypes, strings.ToLower(strings.TrimPrefix(path.Ext(name), ".")))
+}
+
+// ImageTypes returns the extensions of the image files accepted.
+func (a *LLMAgent) ImageTypes() []string {
+	return a.currentSettings().AllowedImageTypes
+}
+
+// CheckImage returns why the image file of size bytes can't be sent to a model,
+// or nil if it can.
+func (a *LLMAgent) CheckImage(name string, size int) error {
+	settings := a.currentSettings()
+	if !a.IsImageFile(name) {
+		return fmt.Errorf("image %s is not supported, only %s images are accepted", name, strings.Join(settings.AllowedImageTypes, ", "))
+	}
+	if size > *settings.MaxImageBytes {
+		return fmt.Errorf("image %s is larger than the limit of %d bytes", name, *settings.MaxImageBytes)
+	}
+	return nil
+}
+
+// downloadImage downloads the image at url, images larger than maxSize bytes are
+// refused unless maxSize is 0.
+func downloadImage(ctx context.Context, url string, maxSize int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: 1 * time.Minute}).Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("failed to download image: " + resp.Status)
+	}
+	if maxSize == 0 {
+		return io.ReadAll(resp.Body)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxSize {
+		return nil, fmt.Errorf("image is larger than the limit of %d bytes", maxSize)
+	}
+	return b, nil
+}
+
+// parseTextParts downloads the text files at urls, files larger than maxSize bytes
+// or not encoded in UTF-8 are refused.
+func parseTextParts(ctx context.Context, urls []string, maxSize int) ([]llms.ContentPart, error) {
+	var parts []llms.ContentPart
+	for _, u := range urls {
+		name := path.Base(u)
+		if pu, err := url.Parse(u); err == nil {
+			name = path.Base(pu.Path)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := (&http.Client{Timeout: 1 * time.Minute}).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to download file %s: %s", name, resp.Status)
+		}
+
+		if len(b) > maxSize {
+			return nil, fmt.Errorf("file %s is larger than %d bytes", name, maxSize)
+		}
+		if !utf8.Valid(b) {
+			return nil, fmt.Errorf("file %s is not a text file", name)
+		}
+		parts = append(parts, llms.TextPart(fmt.Sprintf("Content of the attached file %s:\n%s", name, b)))
+	}
+	return parts, nil
 }
 
-func parseImageParts(modelName string, imageURLs []string) (parts []llms.ContentPart, err error) {
+// parseImageParts turns the images at imageURLs into parts in the same order, each
+// encoded the way the provider of the model expects.
+func parseImageParts(ctx context.Context, modelName string, imageURLs []string, maxImageDimension, maxImageBytes int) (parts []llms.ContentPart, err error) {
 	for _, url := range imageURLs {
-		if modelName == config.OpenAI || modelName == config.Azure {
+		if modelName == config.OpenAI || modelName == config.Azure || modelName == config.Grok {
 			parts = append(parts, llms.ImageURLPart(url))
 		} else {
-			b, err := downloadImage(context.Background(), url)
+			b, err := downloadImage(ctx, url, maxImageBytes)
+			if err != nil {
+				return nil, err
+			}
+			// large images may exceed the provider's size limits, so shrink them first
+			b, mime, err := downscaleImage(b, maxImageDimension)
 			if err != nil {
 				return nil, err
 			}
@@ -183,9 +769,9 @@ func parseImageParts(modelName string, imageURLs []string) (parts []llms.Content
 				// Let it be, it's very amateurish.
 				parts = append(parts, llms.ImageURLPart(base64.StdEncoding.EncodeToString(b)))
 			} else if modelName == config.Qwen {
-				parts = append(parts, llms.ImageURLPart(fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(b))))
+				parts = append(parts, llms.ImageURLPart(fmt.Sprintf("data:%s;base64,%s", mime, base64.StdEncoding.EncodeToString(b))))
 			} else {
-				parts = append(parts, llms.BinaryPart("image/png", b))
+				parts = append(parts, llms.BinaryPart(mime, b))
 			}
 		}
 	}
@@ -193,77 +779,249 @@ func parseImageParts(modelName string, imageURLs []string) (parts []llms.Content
 	return
 }
 
-func (a *LLMAgent) AvailableModelNames() string {
+// ModelNames returns the sorted names of the available models.
+func (a *LLMAgent) ModelNames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
 	var models []string
 	for k := range a.models {
 		models = append(models, k)
 	}
 	slices.Sort(models)
+	return models
+}
+
+// GuildModelNames returns the names of the models offered in the guild, sorted.
+func (a *LLMAgent) GuildModelNames(guildID string) []string {
+	settings := a.currentSettings()
+	return slices.DeleteFunc(a.ModelNames(), func(name string) bool { return !settings.GuildAllowsModel(guildID, name) })
+}
 
+// AvailableModelNames lists the models offered in the guild, for a reply.
+func (a *LLMAgent) AvailableModelNames(guildID string) string {
 	var b bytes.Buffer
-	for _, m := range models {
+	for _, m := range a.GuildModelNames(guildID) {
 		b.WriteString("`")
 		b.WriteString(m)
 		b.WriteString("`")
 		b.WriteString(", ")
 	}
+	if b.Len() == 0 { // the allowlist of the guild names none of the models built
+		return "none"
+	}
 	b.Truncate(b.Len() - 2)
 
 	return b.String()
 }
 
-func (a *LLMAgent) ParseModelName(input string) string {
-	index := strings.Index(input, ":")
-	if index == -1 {
-		return ""
+// ResolveModel returns the model the user gets when asking for modelName, that is
+// modelName itself or its fallback if the user has no access to modelName.
+func (a *LLMAgent) ResolveModel(modelName, userID string, roleIDs []string) (string, error) {
+	settings := a.currentSettings()
+	if settings.CanUseModel(modelName, userID, roleIDs) {
+		return modelName, nil
 	}
+	fallback := settings.ModelAccess[modelName].Fallback
+	if _, ok := a.model(fallback); ok && settings.CanUseModel(fallback, userID, roleIDs) {
+		slog.Info("[LLMAgent.ResolveModel] falling back", "user", userID, "model", modelName, "fallback", fallback)
+		return fallback, nil
+	}
+	return "", errors.New("you don't have access to this model")
+}
 
-	modelName := input[:index]
-	for k := range a.models {
-		if k == modelName {
-			return modelName
+// ModelStatus describes the thinking budget and the remaining quota of the models
+// that have them.
+func (a *LLMAgent) ModelStatus() string {
+	a.mu.RLock()
+	rateLimits, settings := a.rateLimits, a.settings
+	a.mu.RUnlock()
+
+	var b strings.Builder
+	for _, m := range a.ModelNames() {
+		var info []string
+		ms := settings.GetLLMModelSetting(m)
+		if _, ok := config.ThinkingBudgetLimits[m]; ok && ms.ThinkingBudget != nil {
+			info = append(info, fmt.Sprintf("thinking budget %d tokens", *ms.ThinkingBudget))
+		}
+		if rl, ok := rateLimits[m]; ok {
+			if remaining, reset, ok := rl.status(); ok {
+				v := fmt.Sprintf("%d requests left", remaining)
+				if d := time.Until(reset); d > 0 {
+					v += fmt.Sprintf(", resets in %s", d.Round(time.Second))
+				}
+				info = append(info, v)
+			}
+		}
+		if len(info) > 0 {
+			fmt.Fprintf(&b, "`%s`: %s\n", m, strings.Join(info, "; "))
 		}
 	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
 
-	return ""
+// HelpMessage returns the help_message replacing the built-in help, none if unset.
+func (a *LLMAgent) HelpMessage() string {
+	return a.currentSettings().HelpMessage
 }
 
-func (a *LLMAgent) Query(ctx context.Context, modelName, user, input string, imageURLs []string) (<-chan string, error) {
-	slog.Info("[LLMAgent.Query] query", "user", user, "input", input, "imageURLs", imageURLs)
+// AckEmoji returns the emoji acknowledging the messages the bot takes, none if disabled.
+func (a *LLMAgent) AckEmoji() string {
+	return *a.currentSettings().AckEmoji
+}
 
-	model := a.models[modelName]
-	output := make(chan string)
-	var err error
+// NoticePrefix returns the prefix of the bot's own notices and errors, none if disabled.
+func (a *LLMAgent) NoticePrefix() string {
+	return *a.currentSettings().NoticePrefix
+}
 
-	if len(imageURLs) > 0 && !a.settings.GetVisionSupport(modelName) {
-		close(output)
-		return output, errors.New("vision of current model not enabled")
+// Streams reports whether the model streams its answers, see config.Settings.Streams.
+func (a *LLMAgent) Streams(modelName string) bool {
+	return a.currentSettings().Streams(modelName)
+}
+
+// ReplyMode returns how the answers are shown while generated, one of config.ReplyModes.
+func (a *LLMAgent) ReplyMode() string {
+	return a.currentSettings().ReplyMode
+}
+
+// IncludeReferenceContext reports whether the messages replied to are quoted before the questions.
+func (a *LLMAgent) IncludeReferenceContext() bool {
+	return a.currentSettings().IncludeReferenceContext
+}
+
+// EditInterval returns the time between two edits of a streaming reply.
+func (a *LLMAgent) EditInterval() time.Duration {
+	return time.Duration(*a.currentSettings().EditIntervalMs) * time.Millisecond
+}
+
+// TypingInterval returns the time between two typing indicators while an answer is generated.
+func (a *LLMAgent) TypingInterval() time.Duration {
+	return time.Duration(*a.currentSettings().TypingIntervalMs) * time.Millisecond
+}
+
+// IsAdmin reports whether the user is one of the bot admins.
+func (a *LLMAgent) IsAdmin(userID string) bool {
+	return a.currentSettings().IsAdmin(userID)
+}
+
+// IsAllowed reports whether the user may use the bot in the guild, see config.Settings.IsAllowed.
+func (a *LLMAgent) IsAllowed(guildID, userID string) bool {
+	return a.currentSettings().IsAllowed(guildID, userID)
+}
+
+// ChannelAllowed reports whether the bot answers in the channel, see config.Settings.ChannelAllowed.
+func (a *LLMAgent) ChannelAllowed(guildID, channelID, parentID string) bool {
+	return a.currentSettings().ChannelAllowed(guildID, channelID, parentID)
+}
+
+// CommandPrefix returns the prefix of the commands, see config.Settings.CommandPrefix.
+func (a *LLMAgent) CommandPrefix() string {
+	return a.currentSettings().CommandPrefix
+}
+
+// ModelSeparator returns what ends a model selector, see config.Settings.ModelSeparator.
+func (a *LLMAgent) ModelSeparator() string {
+	return a.currentSettings().ModelSeparator
+}
+
+// ParseModelName returns the model selected by the "model:" prefix at the very
+// start of input, with the configured model separator in place of the colon.
+// Separators elsewhere in input are ignored. Only the models offered in the guild
+// can be selected.
+func (a *LLMAgent) ParseModelName(input, guildID string) string {
+	input = strings.TrimLeftFunc(input, unicode.IsSpace)
+	separator := a.ModelSeparator()
+
+	var modelName string
+	for _, k := range a.GuildModelNames(guildID) {
+		if len(k) <= len(modelName) || !strings.HasPrefix(input, k) {
+			continue
+		}
+		if rest := strings.TrimLeft(input[len(k):], " \t"); strings.HasPrefix(rest, separator) {
+			modelName = k // prefer the longest name, in case one name is a prefix of another
+		}
 	}
 
+	return modelName
+}
+
+// DefaultModel returns the model answering the messages of the user without a
+// model selector in the guild: the one the user set, or else default_model. It is
+// none if neither is offered there.
+func (a *LLMAgent) DefaultModel(guildID, user string) string {
+	settings := a.currentSettings()
+	for _, name := range []string{a.PreferredModel(user), settings.DefaultModel} {
+		if name == "" || !settings.GuildAllowsModel(guildID, name) {
+			continue
+		}
+		if _, ok := a.model(name); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// SetPreferredModel makes the model answer the messages of the user without a
+// model selector, an empty name forgets it.
+func (a *LLMAgent) SetPreferredModel(user, name string) error {
+	if name == "" {
+		a.userModels.Delete(user)
+		return nil
+	}
+	if _, ok := a.model(name); !ok {
+		return errors.New("unknown model " + name)
+	}
+	a.userModels.Store(user, name)
+	return nil
+}
+
+// PreferredModel returns the model the user set, none if the user didn't.
+func (a *LLMAgent) PreferredModel(user string) string {
+	if v, ok := a.userModels.Load(user); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// buildRequest returns the messages sent to the model: the system prompt, the
+// history under historyKey and the user input with its attachments.
+func (a *LLMAgent) buildRequest(ctx context.Context, settings config.Settings, model llms.Model, modelName, historyKey, input string, imageURLs []string, o queryOptions) ([]llms.MessageContent, error) {
 	var content []llms.MessageContent
 
 	{ // system prompt
-		parts := []llms.ContentPart{llms.TextPart(a.settings.SystemPrompt)}
+		systemPrompt := a.renderPrompt(a.SystemPrompt(o.guildID, modelName), promptVars{User: o.userName, Date: now().Format(time.DateOnly), Model: modelName})
+		if v, ok := a.summaries.Load(historyKey); ok {
+			systemPrompt += "\n\nSummary of the earlier conversation with the user: " + v.(string)
+		}
 		content = append(content, llms.MessageContent{
 			Role:  llms.ChatMessageTypeSystem,
-			Parts: parts,
+			Parts: []llms.ContentPart{llms.TextPart(systemPrompt)},
 		})
 	}
 
-	historyKey := user + "_" + modelName
 	{ // chat history
 		content = append(content, a.historyToContent(ctx, model, historyKey)...)
 	}
 
 	{ // user input
-		var parts []llms.ContentPart
+		parts := []llms.ContentPart{llms.TextPart(input)}
+
+		ps, err := parseImageParts(ctx, modelName, imageURLs, *settings.MaxImageDimension, *settings.MaxImageBytes)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, ps...)
 
-		parts = append(parts, llms.TextPart(input))
+		ps, err = parseTextParts(ctx, o.textFiles, *settings.MaxAttachmentSize)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, ps...)
 
-		ps, err := parseImageParts(modelName, imageURLs)
+		ps, err = parsePDFParts(ctx, o.pdfFiles, *settings.MaxPDFSize, *settings.MaxPDFText)
 		if err != nil {
-			close(output)
-			return output, err
+			return nil, err
 		}
 		parts = append(parts, ps...)
 
@@ -273,72 +1031,544 @@ func (a *LLMAgent) Query(ctx context.Context, modelName, user, input string, ima
 		})
 	}
 
-	slog.Debug("[LLMAgent.Query] content", "content", content)
+	return content, nil
+}
+
+func (a *LLMAgent) Query(ctx context.Context, modelName, user, input string, imageURLs []string, opts ...QueryOption) (<-chan Chunk, error) {
+	slog.Info("[LLMAgent.Query] query", "user", user, "input", input, "imageURLs", imageURLs)
+
+	// a snapshot, so that a reload doesn't change the settings in the middle of the query
+	a.mu.RLock()
+	models, modelTools, userLimiter, moderator, auditLog, slots, settings := a.models, a.tools, a.userLimiter, a.moderator, a.auditLog, a.slots, a.settings
+	a.mu.RUnlock()
+	if moderator == nil {
+		moderator = noopModerator{}
+	}
+	if auditLog == nil {
+		auditLog = noopAuditLog{}
+	}
+
+	// buffered, so that generation goes on while the consumer is busy with a slow edit
+	output := make(chan Chunk, *settings.StreamBufferSize)
+	var err error
+
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.userName == "" {
+		o.userName = user
+	}
+
+	ctx = withEndUser(ctx, settings.EndUserID, user)
+	var srcs *sources
+	if settings.ShowSources {
+		ctx, srcs = withSources(ctx)
+	}
+
+	model, ok := models[modelName]
+	if !ok {
+		close(output)
+		return output, errors.New("unknown model " + modelName)
+	}
+
+	if n := utf8.RuneCountInString(input); settings.MaxInputLength > 0 && n > settings.MaxInputLength {
+		close(output)
+		return output, fmt.Errorf("your message has %d characters, more than the limit of %d, please shorten it or attach it as a text file", n, settings.MaxInputLength)
+	}
+
+	if userLimiter != nil {
+		if ok, wait := userLimiter.allow(user); !ok {
+			go func() {
+				defer close(output)
+				send(ctx, output, Chunk{Err: fmt.Errorf("rate limited, try again in %ds", int(math.Ceil(wait.Seconds())))})
+			}()
+			return output, nil
+		}
+	}
+
+	schema, ok := settings.Schemas[o.schema]
+	if o.schema != "" && !ok {
+		close(output)
+		return output, errors.New("unknown schema " + o.schema)
+	}
+
+	if len(imageURLs) > 0 && !settings.GetVisionSupport(modelName) {
+		close(output)
+		return output, errors.New("vision of current model not enabled")
+	}
+
+	if limit := settings.GetMaxImages(modelName); limit > 0 && len(imageURLs) > limit {
+		close(output)
+		return output, fmt.Errorf("%s accepts at most %d images per message, got %d, please send fewer images", modelName, limit, len(imageURLs))
+	}
+
+	if err := moderate(ctx, moderator, input); err != nil {
+		close(output)
+		return output, err
+	}
+
+	owner := historyOwner(settings.HistoryScope, user, o)
+	historyKey := owner + "_" + modelName
+	if o.stateless {
+		historyKey = "" // no history is read or saved under the empty key
+	}
+	if settings.SwitchSummary && !o.stateless {
+		a.summarizeOnSwitch(ctx, modelName, owner)
+	}
+	if !o.stateless {
+		a.truncated.Delete(owner) // only the latest answer can be continued
+	}
+
+	content, err := a.buildRequest(ctx, settings, model, modelName, historyKey, input, imageURLs, o)
+	if err != nil {
+		close(output)
+		return output, err
+	}
+	_, trimmed := a.trimmed.LoadAndDelete(historyKey)
+	turn := len(content) - 1 // the messages of this turn start from the user input
+
+	slog.Debug("[LLMAgent.Query] content", "user", user, "model", modelName, "messages", len(content), "history_messages", turn-1, "text_files", len(o.textFiles), "pdf_files", len(o.pdfFiles), "content", content)
 
 	// parseTools
-	options := []llms.CallOption{llms.WithTemperature(*a.settings.Temperature), llms.WithMaxTokens(*a.settings.OutputMaxSize)}
+	options := callOptions(settings, modelName)
 
+	if !a.begin() {
+		close(output)
+		return output, ErrShuttingDown
+	}
 	go func() {
+		defer a.active.Done()
 		defer close(output)
 
+		// the generation is cut when the bot shuts down, the answer so far is kept
+		genCtx, cancelGen := context.WithCancel(ctx)
+		defer cancelGen()
+		defer context.AfterFunc(a.stopContext(), cancelGen)()
+		interrupted := func() bool { return a.stopContext().Err() != nil && ctx.Err() == nil }
+
+		if err := slots.acquire(genCtx); err != nil {
+			if interrupted() {
+				send(ctx, output, Chunk{Text: strings.TrimSpace(interruptedNote)})
+				return
+			}
+			send(ctx, output, Chunk{Err: err})
+			return
+		}
+		defer slots.release()
+
+		if trimmed && settings.ShowContextTrimmed && schema == nil { // tell why the earliest turns are forgotten
+			send(ctx, output, Chunk{Text: contextTrimmedNote})
+		}
+
+		var usage tokenUsage
+		generator := &usageModel{Model: model, usage: &usage}
+		defer a.recordUsage(user, modelName, &usage)
+		var toolsRan, failed bool
+		start := time.Now()
+		defer func() {
+			slog.Debug("[LLMAgent.Query] done", "user", user, "model", modelName, "tools_ran", toolsRan, "usage_reported", usage.reported, "prompt_tokens", usage.input, "completion_tokens", usage.output)
+			metrics.ObserveRequest(modelName, time.Since(start), failed)
+			if usage.reported {
+				metrics.AddTokens(modelName, usage.input, usage.output)
+			}
+		}()
+
+		if settings.IncrementalHistory { // save the user turn right away, the AI turn follows while streaming
+			if err := a.saveHistory(ctx, model, historyKey, llms.TextParts(llms.ChatMessageTypeHuman, input)); err != nil {
+				slog.Error("[LLMAgent.Query] failed to save history", "error", err)
+			}
+		}
+
+		if schema != nil { // structured output, validated as a whole so nothing is streamed
+			answer, err := generateStructured(genCtx, generator, content, options, schema, *settings.SchemaRetries)
+			if err != nil && interrupted() {
+				send(ctx, output, Chunk{Text: strings.TrimSpace(interruptedNote)})
+				return
+			}
+			if err != nil {
+				failed = true
+				send(ctx, output, Chunk{Err: err})
+				return
+			}
+			send(ctx, output, Chunk{Text: answer})
+
+			if settings.IncrementalHistory {
+				err = a.updateHistory(ctx, model, historyKey, answer)
+			} else {
+				err = a.saveHistory(ctx, model, historyKey, content[turn], llms.TextParts(llms.ChatMessageTypeAI, answer))
+			}
+			if err != nil {
+				slog.Error("[LLMAgent.Query] failed to save history", "error", err)
+			}
+			return
+		}
+
 		// function tools
-		if a.settings.GetToolSupport(modelName) {
-			ms := a.settings.GetLLMModelSetting(modelName)
-			options = append(options, llms.WithTools(availableTools(ms)))
+		if tools := modelTools[modelName]; len(tools) > 0 {
+			ms := settings.GetLLMModelSetting(modelName)
+			options = append(options, llms.WithTools(tools))
 
 			var return_direct bool
-			content, return_direct, err = executeToolCalls(ctx, model, ms, options, content, output)
+			content, return_direct, err = executeToolCalls(genCtx, generator, ms, options, content, output)
+			if err != nil && interrupted() {
+				send(ctx, output, Chunk{Text: interruptedNote})
+				return
+			}
 			if err != nil {
-				output <- err.Error()
+				failed = true
+				send(ctx, output, Chunk{Err: err})
 				return
 			}
+			toolsRan = !return_direct
 
 			if return_direct { // return directly, since stream response has been sent to output
 				slog.Debug("[LLMAgent.Query] return_direct", "content", content[len(content)-1])
 				// save chat history
-				if err = a.saveHistory(ctx, model, historyKey, content[len(content)-1]); err != nil {
+				if settings.IncrementalHistory {
+					err = a.updateHistory(ctx, model, historyKey, content[len(content)-1].Parts[0].(llms.TextContent).Text)
+				} else {
+					err = a.saveHistory(ctx, model, historyKey, content[turn:]...)
+				}
+				if err != nil {
 					slog.Error("[LLMAgent.Query] failed to save history", "error", err)
 				}
+				if v := usage.costFooter(ms); settings.ShowCost && v != "" {
+					send(ctx, output, Chunk{Text: v})
+				}
 				return
 			}
 
 			slog.Debug("[LLMAgent.Query] parsed tools", "content", content[len(content)-1])
+
+			if settings.IncrementalHistory { // keep the tool calls and their results, the answer follows while streaming
+				if err := a.saveHistory(ctx, model, historyKey, content[turn+1:]...); err != nil {
+					slog.Error("[LLMAgent.Query] failed to save history", "error", err)
+				}
+			}
 		}
 
 		// streaming
-		var isStreaming bool
+		var isStreaming, capped bool
+		var answer strings.Builder
 		options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
 			isStreaming = true
-			output <- string(chunk)
+			if limit := settings.HardOutputCap; limit > 0 && answer.Len()+len(chunk) > limit { // the provider ignores the max tokens
+				chunk = chunk[:limit-answer.Len()]
+				for len(chunk) > 0 && !utf8.Valid(chunk) { // don't split a character
+					chunk = chunk[:len(chunk)-1]
+				}
+				capped = true
+				defer cancelGen()
+			}
+			if !send(ctx, output, Chunk{Text: string(chunk)}) {
+				return ctx.Err() // nobody reads the output any more, stop generating
+			}
+			answer.Write(chunk)
+			if settings.IncrementalHistory {
+				if err := a.updateHistory(ctx, model, historyKey, answer.String()); err != nil {
+					slog.Error("[LLMAgent.Query] failed to update history", "error", err)
+				}
+			}
+			if capped {
+				return errOutputCapped
+			}
 			return nil
 		}))
-		resp, err := model.GenerateContent(ctx, content, options...)
+		resp, err := generator.GenerateContent(genCtx, content, options...)
+		if capped && ctx.Err() == nil { // keep the answer so far, as if the model stopped there
+			slog.Warn("[LLMAgent.Query] answer cut at the hard output cap", "user", user, "model", modelName, "cap", settings.HardOutputCap)
+			resp, err = &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: answer.String(), StopReason: "hard_output_cap"}}}, nil
+			send(ctx, output, Chunk{Text: "\n\n(truncated)"})
+		}
+		if err != nil && interrupted() { // likewise, the bot shuts down
+			slog.Warn("[LLMAgent.Query] answer interrupted by the shutdown", "user", user, "model", modelName)
+			resp, err = &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: answer.String(), StopReason: "interrupted"}}}, nil
+			send(ctx, output, Chunk{Text: interruptedNote})
+		}
+		if err != nil && answer.Len() > 0 { // keep the partial answer, and tell it apart from the error
+			slog.Error("[LLMAgent.Query] model failed mid-stream", "error", err)
+			if !settings.IncrementalHistory { // the incremental history has it already
+				if err := a.saveHistory(ctx, model, historyKey, append(content[turn:], llms.TextParts(llms.ChatMessageTypeAI, answer.String()))...); err != nil {
+					slog.Error("[LLMAgent.Query] failed to save history", "error", err)
+				}
+			}
+			failed = true
+			send(ctx, output, Chunk{Err: fmt.Errorf("%w: %w", ErrInterrupted, err)})
+			return
+		}
 		if err != nil {
-			output <- err.Error()
+			failed = true
+			send(ctx, output, Chunk{Err: err})
 			return
 		}
 
 		if !isStreaming {
-			slog.Warn("[LLMAgent.Query] current model does not support streaming")
+			if settings.Streams(modelName) {
+				slog.Warn("[LLMAgent.Query] current model does not support streaming")
+			}
 			if v := resp.Choices[0].Content; v != "" {
-				output <- resp.Choices[0].Content
-			} else {
-				return
+				send(ctx, output, Chunk{Text: resp.Choices[0].Content})
 			}
 		}
+		for _, image := range choiceImages(resp.Choices[0]) {
+			send(ctx, output, Chunk{Attachment: image})
+		}
+		if !isStreaming && resp.Choices[0].Content == "" { // nothing to keep in the history
+			return
+		}
 
 		// save chat history
-		if err = a.saveHistory(ctx, model, historyKey, llms.TextParts(llms.ChatMessageTypeHuman, input), llms.TextParts(llms.ChatMessageTypeAI, resp.Choices[0].Content)); err != nil {
+		if settings.IncrementalHistory {
+			err = a.updateHistory(ctx, model, historyKey, resp.Choices[0].Content)
+		} else {
+			err = a.saveHistory(ctx, model, historyKey, append(content[turn:], llms.TextParts(llms.ChatMessageTypeAI, resp.Choices[0].Content))...)
+		}
+		if err != nil {
 			slog.Error("[LLMAgent.Query] failed to save history", "error", err)
 		}
+
+		if !o.stateless && isTruncated(resp.Choices[0].StopReason) { // the history has the answer, so it can be continued
+			a.truncated.Store(owner, modelName)
+			send(ctx, output, Chunk{Truncated: true})
+		}
+
+		if settings.EnableDebug && a.Debugging(user) {
+			send(ctx, output, Chunk{Debug: debugResponse(resp.Choices[0], turnToolCalls(content[turn:]), settings.Secrets())})
+		}
+
+		if srcs != nil {
+			if v := srcs.footer(); v != "" {
+				send(ctx, output, Chunk{Text: v})
+			}
+		}
+		if v := usage.costFooter(settings.GetLLMModelSetting(modelName)); settings.ShowCost && v != "" {
+			send(ctx, output, Chunk{Text: v})
+		}
 	}()
 
-	return output, err
+	var stream <-chan Chunk = output
+	if _, ok := auditLog.(noopAuditLog); !ok { // what the model answered, before moderation holds it back
+		entry := AuditEntry{Time: now(), User: user, Model: modelName, Input: input}
+		if !settings.AuditSkipImages {
+			entry.Images = imageURLs
+		}
+		stream = auditOutput(ctx, auditLog, entry, stream, *settings.StreamBufferSize)
+	}
+	if settings.ModerateOutput {
+		stream = moderateOutput(ctx, moderator, stream, *settings.StreamBufferSize)
+	}
+	if settings.NormalizeOutput {
+		stream = normalizeOutput(ctx, stream, *settings.StreamBufferSize)
+	}
+
+	return stream, err
+}
+
+// callOptions returns the generation options of the model, reasoning models take
+// no temperature, top_p nor stop words.
+func callOptions(settings config.Settings, modelName string) []llms.CallOption {
+	if settings.IsReasoningModel(modelName) {
+		return []llms.CallOption{llms.WithMaxTokens(*settings.OutputMaxSize)}
+	}
+	options := []llms.CallOption{llms.WithTemperature(*settings.Temperature), llms.WithMaxTokens(*settings.OutputMaxSize)}
+	if topP := settings.GetTopP(modelName); topP != nil {
+		options = append(options, llms.WithTopP(*topP))
+	}
+	if stopWords := settings.GetStopWords(modelName); len(stopWords) > 0 {
+		options = append(options, llms.WithStopWords(stopWords))
+	}
+	return options
+}
+
+// errOutputCapped stops the generation of an answer reaching the hard output cap.
+var errOutputCapped = errors.New("the answer reached the hard output cap")
+
+// send sends chunk to output unless ctx is done first, so that an output nobody
+// reads doesn't block the query goroutine forever.
+func send(ctx context.Context, output chan<- Chunk, chunk Chunk) bool {
+	select {
+	case output <- chunk:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Preview renders as Markdown the request Query would send to the model for the
+// same arguments, without calling it: the options, the tools and the messages.
+// Nothing is recorded, the history summaries of a model switch are left out.
+func (a *LLMAgent) Preview(ctx context.Context, modelName, user, input string, imageURLs []string, opts ...QueryOption) ([]byte, error) {
+	a.mu.RLock()
+	models, modelTools, settings := a.models, a.tools, a.settings
+	a.mu.RUnlock()
+
+	var o queryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.userName == "" {
+		o.userName = user
+	}
+
+	model, ok := models[modelName]
+	if !ok {
+		return nil, errors.New("unknown model " + modelName)
+	}
+	if len(imageURLs) > 0 && !settings.GetVisionSupport(modelName) {
+		return nil, errors.New("vision of current model not enabled")
+	}
+
+	historyKey := historyOwner(settings.HistoryScope, user, o) + "_" + modelName
+	if o.stateless {
+		historyKey = ""
+	}
+	content, err := a.buildRequest(ctx, settings, model, modelName, historyKey, input, imageURLs, o)
+	if err != nil {
+		return nil, err
+	}
+
+	var co llms.CallOptions
+	for _, opt := range callOptions(settings, modelName) {
+		opt(&co)
+	}
+	var tools []string
+	if o.schema == "" { // structured answers are generated without tools
+		for _, t := range modelTools[modelName] {
+			tools = append(tools, t.Function.Name)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Request to %s\n\n", modelName)
+	if co.Temperature != 0 {
+		fmt.Fprintf(&b, "- temperature: %g\n", co.Temperature)
+	}
+	fmt.Fprintf(&b, "- max tokens: %d\n", co.MaxTokens)
+	if co.TopP != 0 {
+		fmt.Fprintf(&b, "- top_p: %g\n", co.TopP)
+	}
+	if len(co.StopWords) > 0 {
+		fmt.Fprintf(&b, "- stop words: %q\n", co.StopWords)
+	}
+	if o.schema != "" {
+		fmt.Fprintf(&b, "- schema: %s\n", o.schema)
+	}
+	if len(tools) > 0 {
+		fmt.Fprintf(&b, "- tools: %s\n", strings.Join(tools, ", "))
+	}
+
+	for _, m := range content {
+		fmt.Fprintf(&b, "\n## %s\n\n", m.Role)
+		for _, p := range m.Parts {
+			b.WriteString(previewPart(p))
+			b.WriteString("\n")
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// previewPart describes a part of a message, files by their type and size.
+func previewPart(p llms.ContentPart) string {
+	switch p := p.(type) {
+	case llms.TextContent:
+		return p.Text
+	case llms.ImageURLContent:
+		if strings.HasPrefix(p.URL, "data:") {
+			return fmt.Sprintf("[image, %d bytes of data url]", len(p.URL))
+		}
+		return "[image: " + p.URL + "]"
+	case llms.BinaryContent:
+		return fmt.Sprintf("[%s, %d bytes]", p.MIMEType, len(p.Data))
+	case llms.ToolCall:
+		return fmt.Sprintf("[calls %s with %s]", p.FunctionCall.Name, p.FunctionCall.Arguments)
+	case llms.ToolCallResponse:
+		return fmt.Sprintf("[%s returned: %s]", p.Name, p.Content)
+	}
+	return fmt.Sprintf("[%T]", p)
+}
+
+// QueryString is like Query but waits for the whole answer, and returns errors
+// of the model as an error instead of mixing them into the answer.
+func (a *LLMAgent) QueryString(ctx context.Context, modelName, user, input string, imageURLs []string, opts ...QueryOption) (string, error) {
+	output, err := a.Query(ctx, modelName, user, input, imageURLs, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for chunk := range output {
+		if chunk.Err != nil {
+			err = chunk.Err
+			continue
+		}
+		b.WriteString(chunk.Text)
+	}
+
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// buildToolsFromConfig checks the tools of the models with tool support once at
+// startup, so that unusable tools are never offered to the models.
+func buildToolsFromConfig(settings config.Settings) map[string][]llms.Tool {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tools := make(map[string][]llms.Tool)
+	for _, v := range settings.Models {
+		if v.Enabled && v.HasToolSupport {
+			tools[v.Name] = availableTools(ctx, settings.GetLLMModelSetting(v.Name))
+		}
+	}
+	return tools
 }
 
 func NewLLMAgent(settings config.Settings) *LLMAgent {
-	return &LLMAgent{
-		models:   buildModelsFromConfig(settings),
-		settings: settings,
+	models, rateLimits, err := buildModelsFromConfig(settings)
+	if err != nil {
+		panic(err)
+	}
+	a := &LLMAgent{
+		models:     models,
+		rateLimits: rateLimits,
+		tools:      buildToolsFromConfig(settings),
+		moderator:  newModerator(settings),
+		auditLog:   newAuditLog(settings),
+		slots:      newSemaphore(settings.MaxConcurrentRequests),
+		settings:   settings,
+	}
+	if rl := settings.RateLimit; rl != nil {
+		a.userLimiter = newUserLimiter(rl.Requests, time.Duration(rl.WindowSeconds)*time.Second)
+	}
+	a.parsePrompts(settings)
+	return a
+}
+
+// Reload rebuilds the models from settings and swaps them in at once. The history
+// is kept, and the queries in flight finish with the models they started with. If
+// a model can't be created, the current models are kept and the error returned.
+func (a *LLMAgent) Reload(settings config.Settings) error {
+	models, rateLimits, err := buildModelsFromConfig(settings)
+	if err != nil {
+		return err
 	}
+	tools := buildToolsFromConfig(settings)
+	a.parsePrompts(settings)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.models, a.rateLimits, a.tools, a.moderator, a.auditLog = models, rateLimits, tools, newModerator(settings), newAuditLog(settings)
+	if rl := settings.RateLimit; rl == nil {
+		a.userLimiter = nil
+	} else if old := a.settings.RateLimit; old == nil || *old != *rl || a.userLimiter == nil { // keep the buckets if the limit is unchanged
+		a.userLimiter = newUserLimiter(rl.Requests, time.Duration(rl.WindowSeconds)*time.Second)
+	}
+	if settings.MaxConcurrentRequests != a.settings.MaxConcurrentRequests { // the queries in flight release the slots they took
+		a.slots = newSemaphore(settings.MaxConcurrentRequests)
+	}
+	a.settings = settings
+	return nil
 }
@@ -0,0 +1,1103 @@
+package aicore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/douglarek/llmverse/config"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/memory"
+)
+
+// stubModel streams its chunks as the answer, then fails with err if set. done is
+// closed once the model returns, if set.
+type stubModel struct {
+	chunks     []string
+	err        error
+	done       chan struct{}
+	stopReason string
+}
+
+func (m *stubModel) GenerateContent(ctx context.Context, _ []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	var opts llms.CallOptions
+	for _, o := range options {
+		o(&opts)
+	}
+
+	if m.done != nil {
+		defer close(m.done)
+	}
+
+	var content string
+	for _, c := range m.chunks {
+		if opts.StreamingFunc != nil {
+			if err := opts.StreamingFunc(ctx, []byte(c)); err != nil {
+				return nil, err
+			}
+		}
+		content += c
+	}
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: content, StopReason: m.stopReason}}}, nil
+}
+
+func (m *stubModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+// scriptedModel answers each call with the next of its choices, and records the
+// messages it was called with.
+type scriptedModel struct {
+	choices []*llms.ContentChoice
+	calls   [][]llms.MessageContent
+}
+
+func (m *scriptedModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	var opts llms.CallOptions
+	for _, o := range options {
+		o(&opts)
+	}
+
+	m.calls = append(m.calls, messages)
+	if len(m.choices) == 0 {
+		return nil, errors.New("no more choices")
+	}
+	choice := m.choices[0]
+	m.choices = m.choices[1:]
+
+	if opts.StreamingFunc != nil && choice.Content != "" {
+		if err := opts.StreamingFunc(ctx, []byte(choice.Content)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{choice}}, nil
+}
+
+func (m *scriptedModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+func newTestAgent(t *testing.T, models map[string]llms.Model) *LLMAgent {
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx"}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	return &LLMAgent{models: models, settings: settings}
+}
+
+func TestLLMAgent_QueryString(t *testing.T) {
+	errModel := errors.New("model failed")
+	agent := newTestAgent(t, map[string]llms.Model{
+		"ok":   &stubModel{chunks: []string{"hello", ", ", "world"}},
+		"fail": &stubModel{err: errModel},
+	})
+
+	got, err := agent.QueryString(context.Background(), "ok", "user", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello, world" {
+		t.Fatalf("got %q, want %q", got, "hello, world")
+	}
+
+	got, err = agent.QueryString(context.Background(), "fail", "user", "hi", nil)
+	if !errors.Is(err, errModel) {
+		t.Fatalf("got error %v, want %v", err, errModel)
+	}
+	if got != "" {
+		t.Fatalf("got %q, want empty answer", got)
+	}
+
+	if _, err = agent.QueryString(context.Background(), "unknown", "user", "hi", nil); err == nil {
+		t.Fatal("expected error for unknown model")
+	}
+}
+
+func TestLLMAgent_QueryImages(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n fake image")
+	images := map[string]any{ImagesInfo: []llms.BinaryContent{
+		{MIMEType: "image/png", Data: png},
+		{MIMEType: "text/plain", Data: []byte("not an image")},
+		{Data: png},
+	}}
+
+	for _, tt := range []struct {
+		content string
+		want    string
+	}{
+		{"here is your cat", "here is your cat"},
+		{"", ""}, // the image alone
+	} {
+		model := &scriptedModel{choices: []*llms.ContentChoice{{Content: tt.content, GenerationInfo: images}}}
+		agent := newTestAgent(t, map[string]llms.Model{"stub": model})
+		agent.settings.Models = []config.LLMSetting{{Name: "stub", Enabled: true}}
+
+		output, err := agent.Query(context.Background(), "stub", "user", "draw a cat", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var text string
+		var names []string
+		for chunk := range output {
+			if chunk.Err != nil {
+				t.Fatal(chunk.Err)
+			}
+			if chunk.Attachment != nil {
+				if !bytes.Equal(chunk.Attachment.Data, png) {
+					t.Fatalf("got attachment %q, want the image", chunk.Attachment.Data)
+				}
+				names = append(names, chunk.Attachment.Name)
+			}
+			text += chunk.Text
+		}
+		if text != tt.want {
+			t.Errorf("got text %q, want %q", text, tt.want)
+		}
+		if want := []string{"image.png", "image-2.png"}; !slices.Equal(names, want) {
+			t.Errorf("got attachments %v, want %v", names, want)
+		}
+	}
+}
+
+func TestLLMAgent_QueryToolHistory(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"base":"USD","rates":{"CNY":7.1,"EUR":0.9}}`))
+	}))
+	defer ts.Close()
+
+	toolCall := llms.ToolCall{
+		ID:           "call_1",
+		Type:         "function",
+		FunctionCall: &llms.FunctionCall{Name: "getExchangeRate", Arguments: `{"currency_date":"latest","currency_from":"USD","currency_to":"CNY"}`},
+	}
+	model := &scriptedModel{choices: []*llms.ContentChoice{
+		{ToolCalls: []llms.ToolCall{toolCall}},
+		{Content: "1 USD is 7.1 CNY"},
+		{Content: "1 USD is 0.9 EUR"},
+	}}
+	agent := newTestAgent(t, map[string]llms.Model{"stub": model})
+	agent.tools = map[string][]llms.Tool{"stub": {exchangeRateTool, wikipediaTool, timeTool}}
+	agent.settings.Models = []config.LLMSetting{{Name: "stub", Enabled: true}}
+	agent.settings.ExchangeRateURL = ts.URL + "/"
+
+	for _, q := range []struct{ input, answer string }{
+		{"how much is 1 USD in CNY?", "1 USD is 7.1 CNY"},
+		{"and in euros?", "1 USD is 0.9 EUR"},
+	} {
+		got, err := agent.QueryString(context.Background(), "stub", "user", q.input, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(got, q.answer) {
+			t.Fatalf("got %q, want answer %q", got, q.answer)
+		}
+		if q.input == "how much is 1 USD in CNY?" && !strings.Contains(got, "||*** Fetching the latest exchange rates... ***||") {
+			t.Fatalf("got %q, want the tool status", got)
+		}
+	}
+
+	// the follow-up question must still see the tool call and its result
+	if len(model.calls) != 3 {
+		t.Fatalf("got %d model calls, want 3", len(model.calls))
+	}
+	var roles []llms.ChatMessageType
+	for _, m := range model.calls[2] {
+		roles = append(roles, m.Role)
+	}
+	want := []llms.ChatMessageType{
+		llms.ChatMessageTypeSystem,
+		llms.ChatMessageTypeHuman,
+		llms.ChatMessageTypeAI,
+		llms.ChatMessageTypeTool,
+		llms.ChatMessageTypeAI,
+		llms.ChatMessageTypeHuman,
+	}
+	if len(roles) != len(want) {
+		t.Fatalf("got roles %v, want %v", roles, want)
+	}
+	for i := range want {
+		if roles[i] != want[i] {
+			t.Fatalf("got roles %v, want %v", roles, want)
+		}
+	}
+
+	ai := model.calls[2][2]
+	if tc, ok := ai.Parts[len(ai.Parts)-1].(llms.ToolCall); !ok || tc.ID != "call_1" {
+		t.Fatalf("got AI parts %v, want the tool call", ai.Parts)
+	}
+	tr, ok := model.calls[2][3].Parts[0].(llms.ToolCallResponse)
+	if !ok {
+		t.Fatalf("got tool parts %v, want a tool call response", model.calls[2][3].Parts)
+	}
+	if tr.ToolCallID != "call_1" || tr.Name != "getExchangeRate" || !strings.Contains(tr.Content, `"CNY":7.1`) {
+		t.Fatalf("got tool call response %+v", tr)
+	}
+
+	// the direct answer of the follow-up is saved together with its question
+	history := agent.historyToContent(context.Background(), model, "user_stub")
+	if len(history) != 6 {
+		t.Fatalf("got %d history messages, want 6", len(history))
+	}
+	if v := history[5].Parts[0].(llms.TextContent).Text; v != "1 USD is 0.9 EUR" {
+		t.Fatalf("got last history message %q", v)
+	}
+}
+
+func TestLLMAgent_ParseModelName(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{
+		"openai":  &stubModel{},
+		"google":  &stubModel{},
+		"open":    &stubModel{},
+		"mistral": &stubModel{},
+	})
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"openai: hello", "openai"},
+		{"openai:hello", "openai"},
+		{"  openai : hello", "openai"},
+		{"\nopenai: hello", "openai"},
+		{"open: hello", "open"},
+		{"openai: here is json: {\"a\": 1}", "openai"},
+		{"here's a ratio 3:4, openai answer this", ""},
+		{"what time is it? 12:30 google: ", ""},
+		{"google maps: how to use it", ""},
+		{"openaix: hello", ""},
+		{"time: openai: hello", ""},
+		{"mistral\n: hello", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := agent.ParseModelName(tt.input, ""); got != tt.want {
+			t.Errorf("ParseModelName(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+
+	agent.settings.GuildModels = map[string][]config.LLMModel{"cheap": {"mistral"}}
+	if got := agent.ParseModelName("openai: hello", "cheap"); got != "" {
+		t.Errorf("got model %q, want none outside the allowlist of the guild", got)
+	}
+	if got := agent.ParseModelName("mistral: hello", "cheap"); got != "mistral" {
+		t.Errorf("got model %q, want mistral", got)
+	}
+	if got := agent.AvailableModelNames("cheap"); got != "`mistral`" {
+		t.Errorf("got available models %q in the guild", got)
+	}
+	if got := agent.ParseModelName("openai: hello", ""); got != "openai" {
+		t.Errorf("got model %q, want openai in DMs", got)
+	}
+
+	agent.settings.ModelSeparator = ">"
+	if got := agent.ParseModelName("openai> hello", ""); got != "openai" {
+		t.Errorf("got model %q, want openai with a custom separator", got)
+	}
+	if got := agent.ParseModelName("openai: hello", ""); got != "" {
+		t.Errorf("got model %q, want none with a custom separator", got)
+	}
+}
+
+func TestLLMAgent_DefaultModel(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"openai": &stubModel{}, "mistral": &stubModel{}, "google": &stubModel{}})
+
+	resolve := func(input, guildID, user string) string {
+		if name := agent.ParseModelName(input, guildID); name != "" {
+			return name
+		}
+		return agent.DefaultModel(guildID, user)
+	}
+
+	if got := resolve("hello", "", "alice"); got != "" {
+		t.Fatalf("got model %q without a default, want none", got)
+	}
+
+	agent.settings.DefaultModel = "mistral"
+	if got := resolve("hello", "", "alice"); got != "mistral" {
+		t.Errorf("got model %q, want the default mistral", got)
+	}
+	if got := resolve("openai: hello", "", "alice"); got != "openai" {
+		t.Errorf("got model %q, want the selected openai over the default", got)
+	}
+
+	if err := agent.SetPreferredModel("alice", "google"); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.SetPreferredModel("alice", "groq"); err == nil {
+		t.Fatal("got groq set, want an error for a model not built")
+	}
+	if got := resolve("hello", "", "alice"); got != "google" {
+		t.Errorf("got model %q, want the google of alice over the default", got)
+	}
+	if got := resolve("openai: hello", "", "alice"); got != "openai" {
+		t.Errorf("got model %q, want the selected openai over the model of alice", got)
+	}
+	if got := resolve("hello", "", "bob"); got != "mistral" {
+		t.Errorf("got model %q for bob, want the default mistral", got)
+	}
+
+	agent.settings.GuildModels = map[string][]config.LLMModel{"cheap": {"mistral"}, "none": {"openai"}}
+	if got := resolve("hello", "cheap", "alice"); got != "mistral" {
+		t.Errorf("got model %q, want the default where the model of alice isn't offered", got)
+	}
+	if got := resolve("hello", "none", "alice"); got != "" {
+		t.Errorf("got model %q, want none where neither is offered", got)
+	}
+
+	agent.SetPreferredModel("alice", "")
+	agent.settings.DefaultModel = "groq" // not built
+	if got := resolve("hello", "", "alice"); got != "" {
+		t.Errorf("got model %q, want none for a default not built", got)
+	}
+}
+
+func TestLLMAgent_QueryNotThrottledByConsumer(t *testing.T) {
+	chunks := make([]string, 200)
+	for i := range chunks {
+		chunks[i] = "x"
+	}
+	done := make(chan struct{})
+	agent := newTestAgent(t, map[string]llms.Model{"fast": &stubModel{chunks: chunks, done: done}})
+
+	output, err := agent.Query(context.Background(), "fast", "user", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is consumed yet, the generation must finish anyway
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("generation is throttled by the consumer")
+	}
+
+	var got strings.Builder
+	for chunk := range output {
+		time.Sleep(1 * time.Millisecond) // a slow consumer
+		got.WriteString(chunk.Text)
+	}
+	if got.Len() != len(chunks) {
+		t.Fatalf("got %d chars, want %d", got.Len(), len(chunks))
+	}
+}
+
+func TestLLMAgent_QueryAbandonedOutput(t *testing.T) {
+	done := make(chan struct{})
+	agent := newTestAgent(t, map[string]llms.Model{"stub": &stubModel{chunks: []string{"a", "b", "c"}, done: done}})
+	*agent.settings.StreamBufferSize = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	output, err := agent.Query(ctx, "stub", "user", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the consumer goes away without reading anything
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("generation is still blocked on the abandoned output")
+	}
+
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case _, ok := <-output:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("output is never closed")
+		}
+	}
+}
+
+func TestLLMAgent_QueryMidStreamError(t *testing.T) {
+	errModel := errors.New("connection reset")
+	agent := newTestAgent(t, map[string]llms.Model{
+		"flaky": &stubModel{chunks: []string{"hello", ", wor"}, err: errModel},
+	})
+
+	output, err := agent.Query(context.Background(), "flaky", "user", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text string
+	var errs []error
+	for chunk := range output {
+		if chunk.Err != nil {
+			errs = append(errs, chunk.Err)
+			continue
+		}
+		text += chunk.Text
+	}
+
+	if text != "hello, wor" {
+		t.Fatalf("got answer %q, want the partial answer only", text)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrInterrupted) || !errors.Is(errs[0], errModel) {
+		t.Fatalf("got errors %v, want one interrupted error", errs)
+	}
+
+	history := agent.historyToContent(context.Background(), agent.models["flaky"], "user_flaky")
+	if len(history) != 2 || history[1].Parts[0].(llms.TextContent).Text != "hello, wor" {
+		t.Fatalf("got history %v, want the partial answer kept", history)
+	}
+}
+
+func TestLLMAgent_CheckImage(t *testing.T) {
+	agent := newTestAgent(t, nil)
+
+	if err := agent.CheckImage("cat.PNG", 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.CheckImage("cat.gif", 50*1024*1024); err == nil {
+		t.Fatal("expected error for an oversized image")
+	}
+	if err := agent.CheckImage("cat.bmp", 1024); err == nil {
+		t.Fatal("expected error for an image type not allowed")
+	}
+}
+
+func TestHistoryOwner(t *testing.T) {
+	inChannel := queryOptions{channelID: "c1"}
+	inThread := queryOptions{channelID: "t1", threadID: "t1"}
+
+	tests := []struct {
+		scope string
+		o     queryOptions
+		want  string
+	}{
+		{config.HistoryScopeUser, inChannel, "alice"},
+		{config.HistoryScopeUser, inThread, "alice"},
+		{config.HistoryScopeChannel, inChannel, "channel:c1"},
+		{config.HistoryScopeChannel, inThread, "channel:t1"},
+		{config.HistoryScopeChannel, queryOptions{}, "alice"},
+		{config.HistoryScopeThread, inChannel, "alice"},
+		{config.HistoryScopeThread, inThread, "thread:t1"},
+	}
+	for _, tt := range tests {
+		if got := historyOwner(tt.scope, "alice", tt.o); got != tt.want {
+			t.Errorf("historyOwner(%q, %+v) = %q, want %q", tt.scope, tt.o, got, tt.want)
+		}
+	}
+}
+
+func TestLLMAgent_ClearHistoryScope(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"ok": &stubModel{chunks: []string{"hi"}}})
+	agent.settings.HistoryScope = config.HistoryScopeChannel
+
+	for _, c := range []string{"c1", "c2"} {
+		if _, err := agent.QueryString(context.Background(), "ok", "alice", "hello", nil, WithChannelID(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	agent.ClearHistory(context.Background(), "bob", WithChannelID("c1"))
+	if h := agent.historyToContent(context.Background(), agent.models["ok"], "channel:c1_ok"); len(h) != 0 {
+		t.Fatalf("got %d history messages in c1, want them cleared", len(h))
+	}
+	if h := agent.historyToContent(context.Background(), agent.models["ok"], "channel:c2_ok"); len(h) != 2 {
+		t.Fatalf("got %d history messages in c2, want 2", len(h))
+	}
+}
+
+func TestLLMAgent_SetSystemPrompt(t *testing.T) {
+	agent := newTestAgent(t, nil)
+
+	if v := agent.GlobalSystemPrompt(); v != "You are a helpful AI assistant." {
+		t.Fatalf("got %q, want the configured prompt", v)
+	}
+
+	agent.SetSystemPrompt("You are a pirate.")
+	if v := agent.SystemPrompt("", "openai"); v != "You are a pirate." {
+		t.Fatalf("got %q, want the runtime prompt", v)
+	}
+	agent.SetGuildSystemPrompt("g1", "You are a poet.")
+	if v := agent.SystemPrompt("g1", "openai"); v != "You are a poet." {
+		t.Fatalf("got %q, want the guild prompt to win", v)
+	}
+
+	agent.SetSystemPrompt("")
+	if v := agent.GlobalSystemPrompt(); v != "You are a helpful AI assistant." {
+		t.Fatalf("got %q, want the configured prompt after reset", v)
+	}
+}
+
+func TestParseImageParts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG\r\n\x1a\n" + r.URL.Path)) // not decodable, so sent as is
+	}))
+	defer ts.Close()
+	urls := []string{ts.URL + "/1", ts.URL + "/2"}
+
+	for _, tt := range []struct {
+		model  string
+		prefix string
+	}{
+		{config.ChatGLM, "iVBORw0KGgo"},
+		{config.Qwen, "data:image/png;base64,iVBORw0KGgo"},
+	} {
+		parts, err := parseImageParts(context.Background(), tt.model, urls, 2048, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != len(urls) {
+			t.Fatalf("got %d parts for %s, want %d", len(parts), tt.model, len(urls))
+		}
+		for i, p := range parts {
+			v, ok := p.(llms.ImageURLContent)
+			if !ok || !strings.HasPrefix(v.URL, tt.prefix) {
+				t.Fatalf("got part %d %v for %s, want prefix %q", i, p, tt.model, tt.prefix)
+			}
+		}
+		if parts[0].(llms.ImageURLContent).URL == parts[1].(llms.ImageURLContent).URL {
+			t.Fatalf("got the same image twice for %s, want the order kept", tt.model)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := parseImageParts(ctx, config.ChatGLM, urls, 2048, 1024); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want the download stopped with the request", err)
+	}
+}
+
+func TestLLMAgent_QueryMaxImages(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{config.ChatGLM: &stubModel{}})
+	agent.settings.Models = []config.LLMSetting{{Name: config.ChatGLM, Enabled: true, HasVisionSupport: true}}
+
+	_, err := agent.Query(context.Background(), config.ChatGLM, "user", "compare these", []string{"https://example.com/1.png", "https://example.com/2.png"})
+	if err == nil || !strings.Contains(err.Error(), "at most 1 images") {
+		t.Fatalf("got error %v, want the images refused", err)
+	}
+}
+
+func TestLLMAgent_Reload(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"old": &stubModel{chunks: []string{"hi"}}})
+	if _, err := agent.QueryString(context.Background(), "old", "user", "hello", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [{"name": "openai", "api_key": "xxx", "enabled": true}]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.Reload(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := agent.ModelNames(); len(names) != 1 || names[0] != "openai" {
+		t.Fatalf("got models %v, want the reloaded ones", names)
+	}
+	if _, err := agent.QueryString(context.Background(), "old", "user", "hello", nil); err == nil {
+		t.Fatal("expected error for the model removed by the reload")
+	}
+	if h := agent.historyToContent(context.Background(), &stubModel{}, "user_old"); len(h) != 2 {
+		t.Fatalf("got %d history messages, want the history kept", len(h))
+	}
+}
+
+func TestLLMAgent_ReloadFailed(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"old": &stubModel{chunks: []string{"hi"}}})
+
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "help_message": "new", "models": [{"name": "openai", "enabled": true}]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.Reload(settings); err == nil || !strings.Contains(err.Error(), "openai") {
+		t.Fatalf("got error %v, want the model without an api key refused", err)
+	}
+
+	if names := agent.ModelNames(); len(names) != 1 || names[0] != "old" {
+		t.Fatalf("got models %v, want the previous ones kept", names)
+	}
+	if agent.settings.HelpMessage == "new" {
+		t.Fatal("the settings of the failed reload were applied")
+	}
+	if _, err := agent.QueryString(context.Background(), "old", "user", "hello", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallOptions(t *testing.T) {
+	var settings config.Settings
+	s := `{"discord_bot_token": "xxxx", "models": [
+		{"name": "openai", "api_key": "xxx", "enabled": true, "model": "o3-mini"},
+		{"name": "groq", "api_key": "xxx", "enabled": true}
+	]}`
+	if err := json.Unmarshal([]byte(s), &settings); err != nil {
+		t.Fatal(err)
+	}
+
+	apply := func(options []llms.CallOption) llms.CallOptions {
+		var o llms.CallOptions
+		for _, opt := range options {
+			opt(&o)
+		}
+		return o
+	}
+
+	reasoning := callOptions(settings, config.OpenAI)
+	standard := callOptions(settings, config.Groq)
+	if len(reasoning) >= len(standard) {
+		t.Fatalf("got %d reasoning options and %d standard options, want fewer for the reasoning model", len(reasoning), len(standard))
+	}
+	if o := apply(reasoning); o.Temperature != 0 || o.MaxTokens != *settings.OutputMaxSize {
+		t.Fatalf("got reasoning options %+v, want no temperature", o)
+	}
+	if o := apply(standard); o.Temperature != *settings.Temperature || o.MaxTokens != *settings.OutputMaxSize || o.TopP != 0 || o.StopWords != nil {
+		t.Fatalf("got standard options %+v, want no top_p nor stop words", o)
+	}
+
+	s = `{"discord_bot_token": "xxxx", "top_p": 0.9, "stop_words": ["END"], "models": [
+		{"name": "openai", "api_key": "xxx", "enabled": true, "model": "o3-mini"},
+		{"name": "groq", "api_key": "xxx", "enabled": true, "top_p": 0.5},
+		{"name": "mistral", "api_key": "xxx", "enabled": true, "stop_words": ["STOP", "HALT"]}
+	]}`
+	settings = config.Settings{}
+	if err := json.Unmarshal([]byte(s), &settings); err != nil {
+		t.Fatal(err)
+	}
+	if o := apply(callOptions(settings, config.Groq)); o.TopP != 0.5 || !slices.Equal(o.StopWords, []string{"END"}) {
+		t.Errorf("got groq options %+v, want its top_p and the global stop words", o)
+	}
+	if o := apply(callOptions(settings, config.Mistral)); o.TopP != 0.9 || !slices.Equal(o.StopWords, []string{"STOP", "HALT"}) {
+		t.Errorf("got mistral options %+v, want the global top_p and its stop words", o)
+	}
+	if o := apply(callOptions(settings, config.OpenAI)); o.TopP != 0 || o.StopWords != nil {
+		t.Errorf("got reasoning options %+v, want no top_p nor stop words", o)
+	}
+}
+
+func TestReasoningDoer(t *testing.T) {
+	var got map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/v1/chat/completions", strings.NewReader(`{"model":"o1","temperature":0,"max_tokens":100}`))
+	resp, err := (&reasoningDoer{next: http.DefaultClient}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if _, ok := got["temperature"]; ok {
+		t.Fatalf("got %v, want no temperature", got)
+	}
+	if _, ok := got["max_tokens"]; ok || got["max_completion_tokens"] != float64(100) {
+		t.Fatalf("got %v, want max_completion_tokens", got)
+	}
+}
+
+func TestLLMAgent_ExportHistory(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"a": &stubModel{chunks: []string{"hello"}}, "b": &stubModel{}})
+	ctx := context.Background()
+
+	if b, err := agent.ExportHistory(ctx, "alice", ""); err != nil || b != nil {
+		t.Fatalf("got %q, %v, want nothing to export", b, err)
+	}
+
+	if _, err := agent.QueryString(ctx, "a", "alice", "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := agent.ExportHistory(ctx, "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# Conversation with a\n\n**User:** hi\n\n**AI:** hello\n\n"; string(b) != want {
+		t.Fatalf("got %q, want %q", b, want)
+	}
+
+	if b, _ := agent.ExportHistory(ctx, "alice", "b"); b != nil {
+		t.Fatalf("got %q, want nothing for a model not asked", b)
+	}
+	if b, _ := agent.ExportHistory(ctx, "bob", ""); b != nil {
+		t.Fatalf("got %q, want nothing for another user", b)
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	countTokens = func(text string) int { return len(strings.Fields(text)) }
+	defer func() { countTokens = func(text string) int { return llms.CountTokens("", text) } }()
+
+	ctx := context.Background()
+	history := func(maxTokens int) *memory.ConversationTokenBuffer {
+		tb := memory.NewConversationTokenBuffer(&stubModel{}, maxTokens)
+		tb.ChatHistory.SetMessages(ctx, []llms.ChatMessage{
+			llms.SystemChatMessage{Content: "be nice"},
+			llms.HumanChatMessage{Content: "one two"},
+			llms.AIChatMessage{Content: "three", ToolCalls: []llms.ToolCall{{ID: "1"}}},
+			llms.ToolChatMessage{ID: "1", Content: "four"},
+			llms.AIChatMessage{Content: "five"},
+			llms.HumanChatMessage{Content: "six"},
+			llms.AIChatMessage{Content: "seven eight"},
+		})
+		return tb
+	}
+	contents := func(tb *memory.ConversationTokenBuffer) []string {
+		messages, _ := tb.ChatHistory.Messages(ctx)
+		var v []string
+		for _, m := range messages {
+			v = append(v, m.GetContent())
+		}
+		return v
+	}
+
+	tests := []struct {
+		maxTokens   int
+		maxMessages int
+		want        []string
+	}{
+		{100, 0, []string{"be nice", "one two", "three", "four", "five", "six", "seven eight"}},
+		{100, 4, []string{"be nice", "six", "seven eight"}}, // the tool result isn't kept without its call
+		{100, 6, []string{"be nice", "one two", "three", "four", "five", "six", "seven eight"}},
+		{100, 5, []string{"be nice", "six", "seven eight"}},
+		{3, 0, []string{"be nice", "six", "seven eight"}},
+		{8, 10, []string{"be nice", "one two", "three", "four", "five", "six", "seven eight"}}, // system messages don't count
+		{5, 10, []string{"be nice", "six", "seven eight"}},
+		{1, 10, []string{"be nice"}},
+	}
+	for _, tt := range tests {
+		tb := history(tt.maxTokens)
+		if _, err := trimHistory(ctx, tb, tt.maxMessages); err != nil {
+			t.Fatal(err)
+		}
+		if got := contents(tb); !slices.Equal(got, tt.want) {
+			t.Errorf("trimHistory(%d tokens, %d messages) = %v, want %v", tt.maxTokens, tt.maxMessages, got, tt.want)
+		}
+	}
+}
+
+func TestLLMAgent_QueryStateless(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"a": &stubModel{chunks: []string{"hello"}}})
+	ctx := context.Background()
+
+	for _, incremental := range []bool{false, true} {
+		agent.settings.IncrementalHistory = incremental
+		if _, err := agent.QueryString(ctx, "a", "alice", "secret", nil, WithStateless()); err != nil {
+			t.Fatal(err)
+		}
+		agent.history.Range(func(k, _ any) bool {
+			t.Fatalf("got history %v, want none in stateless mode (incremental %v)", k, incremental)
+			return false
+		})
+	}
+
+	if _, err := agent.QueryString(ctx, "a", "alice", "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+	m := &scriptedModel{choices: []*llms.ContentChoice{{Content: "ok"}}}
+	agent.models["a"] = m
+	if _, err := agent.QueryString(ctx, "a", "alice", "once more", nil, WithStateless()); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.calls) != 1 || len(m.calls[0]) != 2 {
+		t.Fatalf("got calls %v, want the system prompt and the input only", m.calls)
+	}
+}
+
+// gateModel answers once gate is closed, started is closed when it is called.
+type gateModel struct {
+	started, gate chan struct{}
+}
+
+func (m *gateModel) GenerateContent(ctx context.Context, _ []llms.MessageContent, _ ...llms.CallOption) (*llms.ContentResponse, error) {
+	close(m.started)
+	<-m.gate
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: "slow"}}}, nil
+}
+
+func (m *gateModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+func TestLLMAgent_QueryConcurrencyLimit(t *testing.T) {
+	slow := &gateModel{started: make(chan struct{}), gate: make(chan struct{})}
+	done := make(chan struct{})
+	agent := newTestAgent(t, map[string]llms.Model{"slow": slow, "fast": &stubModel{chunks: []string{"fast"}, done: done}})
+	agent.slots = newSemaphore(1)
+
+	if _, err := agent.Query(context.Background(), "slow", "user1", "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-slow.started
+
+	output, err := agent.Query(context.Background(), "fast", "user2", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatal("the second query ran over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(slow.gate)
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("the second query didn't run after the first finished")
+	}
+	for range output {
+	}
+
+	defer func(d time.Duration) { queueTimeout = d }(queueTimeout)
+	queueTimeout = 10 * time.Millisecond
+	agent.slots <- struct{}{} // the only slot is taken
+	if _, err := agent.QueryString(context.Background(), "fast", "user2", "hi", nil); !errors.Is(err, ErrBusy) {
+		t.Fatalf("got error %v, want %v", err, ErrBusy)
+	}
+}
+
+func TestLLMAgent_QueryContextTrimmed(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"a": &stubModel{chunks: []string{"hello"}}})
+	agent.settings.HistoryMaxMessages = 2
+	agent.settings.ShowContextTrimmed = true
+	ctx := context.Background()
+
+	var answers []string
+	for _, q := range []string{"one", "two", "three"} {
+		got, err := agent.QueryString(ctx, "a", "alice", q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, got)
+	}
+
+	// the second answer makes the history overflow, so the third one notes it
+	if answers[0] != "hello" || answers[1] != "hello" {
+		t.Fatalf("got answers %q, want no note before the history overflows", answers[:2])
+	}
+	if answers[2] != contextTrimmedNote+"hello" {
+		t.Fatalf("got answer %q, want the note", answers[2])
+	}
+
+	agent.settings.ShowContextTrimmed = false
+	if got, _ := agent.QueryString(ctx, "a", "alice", "four", nil); got != "hello" {
+		t.Fatalf("got answer %q, want no note when show_context_trimmed is off", got)
+	}
+}
+
+func TestLLMAgent_QueryTruncated(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{
+		"cut":  &stubModel{chunks: []string{"hello"}, stopReason: "length"},
+		"full": &stubModel{chunks: []string{"hello"}, stopReason: "stop"},
+	})
+	ctx := context.Background()
+
+	truncated := func(modelName string, opts ...QueryOption) bool {
+		output, err := agent.Query(ctx, modelName, "alice", "hi", nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got bool
+		for chunk := range output {
+			got = got || chunk.Truncated
+		}
+		return got
+	}
+
+	if !truncated("cut") || agent.TruncatedModel("alice") != "cut" {
+		t.Fatalf("got truncated model %q, want cut", agent.TruncatedModel("alice"))
+	}
+	if agent.TruncatedModel("bob") != "" {
+		t.Fatal("got a truncated model for another user")
+	}
+	if truncated("full") || agent.TruncatedModel("alice") != "" {
+		t.Fatal("the next answer must replace the cut one")
+	}
+	if truncated("cut", WithStateless()) || agent.TruncatedModel("alice") != "" {
+		t.Fatal("a stateless answer has no history to continue")
+	}
+
+	truncated("cut")
+	agent.ClearHistory(ctx, "alice")
+	if agent.TruncatedModel("alice") != "" {
+		t.Fatal("clearing the history must forget the cut answer")
+	}
+}
+
+func TestIsTruncated(t *testing.T) {
+	for reason, want := range map[string]bool{
+		"length": true, "max_tokens": true, "MAX_TOKENS": true, "FinishReasonMaxTokens": true, "LENGTH": true,
+		"stop": false, "end_turn": false, "FinishReasonStop": false, "": false,
+	} {
+		if got := isTruncated(reason); got != want {
+			t.Errorf("isTruncated(%q) = %v, want %v", reason, got, want)
+		}
+	}
+}
+
+func TestLLMAgent_BuildRequest(t *testing.T) {
+	model := &stubModel{chunks: []string{"hello"}}
+	agent := newTestAgent(t, map[string]llms.Model{"a": model})
+	ctx := context.Background()
+
+	if _, err := agent.QueryString(ctx, "a", "alice", "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	roles := func(content []llms.MessageContent) []llms.ChatMessageType {
+		var v []llms.ChatMessageType
+		for _, m := range content {
+			v = append(v, m.Role)
+		}
+		return v
+	}
+
+	content, err := agent.buildRequest(ctx, agent.settings, model, "a", "alice_a", "again", nil, queryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman}
+	if got := roles(content); !slices.Equal(got, want) {
+		t.Fatalf("got roles %v, want %v", got, want)
+	}
+	if got := content[3].Parts[0].(llms.TextContent).Text; got != "again" {
+		t.Fatalf("got input %q", got)
+	}
+
+	agent.summaries.Store("alice_a", "they said hi")
+	content, err = agent.buildRequest(ctx, agent.settings, model, "a", "", "again", nil, queryOptions{stateless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roles(content); len(got) != 2 {
+		t.Fatalf("got roles %v, want no history when stateless", got)
+	}
+	if strings.Contains(content[0].Parts[0].(llms.TextContent).Text, "they said hi") {
+		t.Fatal("got the summary of the history when stateless")
+	}
+
+	content, _ = agent.buildRequest(ctx, agent.settings, model, "a", "alice_a", "again", nil, queryOptions{})
+	if !strings.HasSuffix(content[0].Parts[0].(llms.TextContent).Text, "conversation with the user: they said hi") {
+		t.Fatalf("got system prompt %q, want the summary", content[0].Parts[0])
+	}
+}
+
+func TestLLMAgent_Preview(t *testing.T) {
+	model := &stubModel{chunks: []string{"hello"}}
+	agent := newTestAgent(t, map[string]llms.Model{"a": model})
+	agent.tools = map[string][]llms.Tool{"a": {{Function: &llms.FunctionDefinition{Name: "getTime"}}}}
+	ctx := context.Background()
+
+	if _, err := agent.QueryString(ctx, "a", "alice", "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := agent.Preview(ctx, "a", "alice", "again", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+	for _, want := range []string{"# Request to a", "- max tokens: 4096", "- tools: getTime", "## system", "## human\n\nhi\n", "## ai\n\nhello\n", "## human\n\nagain\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("preview lacks %q:\n%s", want, got)
+		}
+	}
+
+	if messages, _ := agent.loadHistory(ctx, model, "alice_a").ChatHistory.Messages(ctx); len(messages) != 2 {
+		t.Fatalf("got %d messages in the history, want the preview to keep none", len(messages))
+	}
+	if _, err := agent.Preview(ctx, "b", "alice", "again", nil); err == nil {
+		t.Fatal("expected error for an unknown model")
+	}
+}
+
+// endlessModel streams its chunk until it is stopped.
+type endlessModel struct {
+	chunk string
+}
+
+func (m *endlessModel) GenerateContent(ctx context.Context, _ []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	var opts llms.CallOptions
+	for _, o := range options {
+		o(&opts)
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := opts.StreamingFunc(ctx, []byte(m.chunk)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (m *endlessModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+func TestLLMAgent_QueryHardOutputCap(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"openai": &endlessModel{chunk: "héllo "}})
+	agent.settings.HardOutputCap = 16 // 2 chunks of 7 bytes, then h and half of é
+	ctx := context.Background()
+
+	got, err := agent.QueryString(ctx, "openai", "alice", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, ok := strings.CutSuffix(got, "\n\n(truncated)")
+	if !ok {
+		t.Fatalf("got answer %q, want it marked truncated", got)
+	}
+	if answer != "héllo héllo h" || !utf8.ValidString(answer) {
+		t.Fatalf("got answer %q, want it cut at 20 bytes", answer)
+	}
+
+	history, err := agent.ExportHistory(ctx, "alice", "openai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(history), "héllo héllo h") {
+		t.Fatalf("got history %s, want the answer kept", history)
+	}
+}
+
+func TestParseTextParts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired.txt" {
+			http.Error(w, "<Error>AccessDenied</Error>", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("hello notes"))
+	}))
+	defer ts.Close()
+
+	parts, err := parseTextParts(context.Background(), []string{ts.URL + "/notes.txt"}, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 {
+		t.Fatalf("got %d parts, want 1", len(parts))
+	}
+	if got := parts[0].(llms.TextContent).Text; !strings.Contains(got, "notes.txt") || !strings.Contains(got, "hello notes") {
+		t.Fatalf("got part %q", got)
+	}
+
+	if _, err := parseTextParts(context.Background(), []string{ts.URL + "/expired.txt"}, 1<<20); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got error %v, want the failed download refused", err)
+	}
+}
@@ -0,0 +1,123 @@
+package aicore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/douglarek/llmverse/config"
+)
+
+// AuditEntry is a question to a model and its answer, as recorded by an AuditLog.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Model  string    `json:"model"`
+	Input  string    `json:"input"`
+	Images []string  `json:"images,omitempty"` // the urls, left out with audit_skip_images
+	Answer string    `json:"answer"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// AuditLog records the queries once they are answered.
+type AuditLog interface {
+	Record(ctx context.Context, e AuditEntry) error
+}
+
+// noopAuditLog records nothing, it is used when no audit log is configured.
+type noopAuditLog struct{}
+
+func (noopAuditLog) Record(context.Context, AuditEntry) error {
+	return nil
+}
+
+// newAuditLog returns the audit log configured by settings.
+func newAuditLog(settings config.Settings) AuditLog {
+	if settings.AuditLogPath == "" {
+		return noopAuditLog{}
+	}
+	return &fileAuditLog{path: settings.AuditLogPath}
+}
+
+// fileAuditLog appends the entries to a file as JSON lines. The file is opened for
+// each entry, so it can be rotated.
+type fileAuditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (l *fileAuditLog) Record(_ context.Context, e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// auditLogs records the entries to each of its logs.
+type auditLogs []AuditLog
+
+func (ls auditLogs) Record(ctx context.Context, e AuditEntry) error {
+	var errs []error
+	for _, l := range ls {
+		errs = append(errs, l.Record(ctx, e))
+	}
+	return errors.Join(errs...)
+}
+
+// AddAuditLog records the queries to l as well, until the next Reload.
+func (a *LLMAgent) AddAuditLog(l AuditLog) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.auditLog.(noopAuditLog); ok || a.auditLog == nil {
+		a.auditLog = l
+		return
+	}
+	a.auditLog = auditLogs{a.auditLog, l}
+}
+
+// auditOutput passes output through, into a channel buffered like output, and
+// records the entry with the answer and the error once output is closed.
+func auditOutput(ctx context.Context, l AuditLog, e AuditEntry, output <-chan Chunk, bufferSize int) <-chan Chunk {
+	audited := make(chan Chunk, bufferSize)
+	go func() {
+		defer close(audited)
+
+		var answer strings.Builder
+		var errs []error
+		for chunk := range output {
+			answer.WriteString(chunk.Text)
+			if chunk.Err != nil {
+				errs = append(errs, chunk.Err)
+			}
+			send(ctx, audited, chunk)
+		}
+
+		e.Answer = answer.String()
+		if err := errors.Join(errs...); err != nil {
+			e.Error = err.Error()
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second) // record cancelled answers too
+		defer cancel()
+		if err := l.Record(ctx, e); err != nil {
+			slog.Error("[auditOutput] failed to record the query", "user", e.User, "model", e.Model, "error", err)
+		}
+	}()
+	return audited
+}
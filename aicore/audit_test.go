@@ -0,0 +1,92 @@
+package aicore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// readAuditLog returns the entries of the audit log file.
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestFileAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l := &fileAuditLog{path: path}
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, e := range []AuditEntry{
+		{Time: at, User: "alice", Model: "openai", Input: "hi", Answer: "hello"},
+		{Time: at, User: "bob", Model: "groq", Input: "why?", Images: []string{"https://example.com/cat.png"}, Error: "rate limited"},
+	} {
+		if err := l.Record(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.User != "alice" || e.Model != "openai" || e.Answer != "hello" || !e.Time.Equal(at) {
+		t.Errorf("got entry %+v", e)
+	}
+	if e := entries[1]; len(e.Images) != 1 || e.Error != "rate limited" {
+		t.Errorf("got entry %+v", e)
+	}
+}
+
+func TestLLMAgent_QueryAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	errModel := errors.New("model failed")
+	agent := newTestAgent(t, map[string]llms.Model{
+		"ok":   &stubModel{chunks: []string{"hello", ", world"}},
+		"fail": &stubModel{err: errModel},
+	})
+	agent.settings.AuditLogPath = path
+	agent.settings.AuditSkipImages = true
+	agent.auditLog = newAuditLog(agent.settings)
+
+	ctx := context.Background()
+	if _, err := agent.QueryString(ctx, "ok", "alice", "hi", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.QueryString(ctx, "fail", "bob", "hi", nil); !errors.Is(err, errModel) {
+		t.Fatalf("got error %v, want %v", err, errModel)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.User != "alice" || e.Model != "ok" || e.Input != "hi" || e.Answer != "hello, world" || e.Error != "" {
+		t.Errorf("got entry %+v", e)
+	}
+	if e := entries[1]; e.User != "bob" || e.Error != errModel.Error() {
+		t.Errorf("got entry %+v", e)
+	}
+}
@@ -0,0 +1,90 @@
+package aicore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream"
+	"github.com/douglarek/llmverse/config"
+)
+
+// writeBedrockChunk writes an event of a claude answer streamed by bedrock.
+func writeBedrockChunk(t *testing.T, w http.ResponseWriter, event string) {
+	payload, _ := json.Marshal(map[string]string{"bytes": base64.StdEncoding.EncodeToString([]byte(event))})
+	err := eventstream.NewEncoder().Encode(w, eventstream.Message{
+		Headers: eventstream.Headers{
+			{Name: ":event-type", Value: eventstream.StringValue("chunk")},
+			{Name: ":message-type", Value: eventstream.StringValue("event")},
+			{Name: ":content-type", Value: eventstream.StringValue("application/json")},
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	w.(http.Flusher).Flush()
+}
+
+func TestLLMAgent_QueryBedrockStreaming(t *testing.T) {
+	next := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/invoke-with-response-stream") {
+			t.Errorf("got path %s, want the streaming api", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		writeBedrockChunk(t, w, `{"type":"message_start","message":{"usage":{"input_tokens":10}}}`)
+		writeBedrockChunk(t, w, `{"type":"content_block_delta","delta":{"type":"text_delta","text":"Hello"}}`)
+		select { // the rest only once the first chunk got through
+		case <-next:
+		case <-time.After(5 * time.Second):
+			t.Error("got no chunk before the end of the answer")
+		}
+		writeBedrockChunk(t, w, `{"type":"content_block_delta","delta":{"type":"text_delta","text":", world"}}`)
+		writeBedrockChunk(t, w, `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`)
+	}))
+	defer ts.Close()
+
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [
+		{"name": "bedrock", "access_key_id": "id", "secret_access_key": "secret", "base_url": "`+ts.URL+`", "enabled": true}
+	]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	agent := NewLLMAgent(settings)
+	if !agent.Streams("bedrock") {
+		t.Fatal("got the claude model on bedrock not streaming")
+	}
+
+	output, err := agent.Query(context.Background(), "bedrock", "alice", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case chunk := <-output:
+		if chunk.Err != nil || chunk.Text != "Hello" {
+			t.Fatalf("got first chunk %+v, want Hello", chunk)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("got no chunk while the answer is generated")
+	}
+	close(next)
+
+	var rest string
+	for chunk := range output {
+		if chunk.Err != nil {
+			t.Fatal(chunk.Err)
+		}
+		rest += chunk.Text
+	}
+	if rest != ", world" {
+		t.Fatalf("got the rest %q, want , world", rest)
+	}
+}
@@ -0,0 +1,99 @@
+package aicore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ToggleDebug switches the raw responses after the answers to the user on or off,
+// and reports whether they are on. They are only sent with enable_debug.
+func (a *LLMAgent) ToggleDebug(user string) bool {
+	if _, loaded := a.debug.LoadAndDelete(user); loaded {
+		return false
+	}
+	a.debug.Store(user, true)
+	return true
+}
+
+// Debugging reports whether the user turned the raw responses on.
+func (a *LLMAgent) Debugging(user string) bool {
+	_, ok := a.debug.Load(user)
+	return ok
+}
+
+// DebugEnabled reports whether the users can turn the raw responses on.
+func (a *LLMAgent) DebugEnabled() bool {
+	return a.currentSettings().EnableDebug
+}
+
+// turnToolCalls returns the tools called by the model in the messages of a turn.
+func turnToolCalls(messages []llms.MessageContent) []llms.ToolCall {
+	var calls []llms.ToolCall
+	for _, m := range messages {
+		for _, p := range m.Parts {
+			if tc, ok := p.(llms.ToolCall); ok {
+				calls = append(calls, tc)
+			}
+		}
+	}
+	return calls
+}
+
+// sensitiveKeys are the parts of the names of the generation info left out of the
+// debug output, whatever their values.
+var sensitiveKeys = []string{"key", "token", "secret", "auth", "password"}
+
+// debugResponse renders the choice of the model as a JSON code block: the stop
+// reason, the generation info with the token usage and the tools called during
+// the turn. The content is the answer already sent, so only its length is given.
+// The secrets are redacted wherever they show up.
+func debugResponse(choice *llms.ContentChoice, toolCalls []llms.ToolCall, secrets []string) string {
+	info := map[string]any{}
+	for k, v := range choice.GenerationInfo {
+		if name := strings.ToLower(k); strings.Contains(name, "tokens") || !containsAny(name, sensitiveKeys) {
+			info[k] = v
+		}
+	}
+
+	var calls []map[string]string
+	for _, tc := range append(toolCalls, choice.ToolCalls...) {
+		if tc.FunctionCall != nil {
+			calls = append(calls, map[string]string{"id": tc.ID, "name": tc.FunctionCall.Name, "arguments": tc.FunctionCall.Arguments})
+		}
+	}
+
+	v := struct {
+		StopReason     string              `json:"stop_reason"`
+		ContentLength  int                 `json:"content_length"`
+		GenerationInfo map[string]any      `json:"generation_info,omitempty"`
+		ToolCalls      []map[string]string `json:"tool_calls,omitempty"`
+	}{choice.StopReason, len(choice.Content), info, calls}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil { // a provider put a value json can't encode in the generation info
+		v.GenerationInfo = nil
+		data, _ = json.MarshalIndent(v, "", "  ")
+		data = append(data, fmt.Sprintf("\n(generation info left out: %v)", err)...)
+	}
+
+	text := string(data)
+	for _, s := range secrets {
+		if s != "" {
+			text = strings.ReplaceAll(text, s, "[redacted]")
+		}
+	}
+	return "```json\n" + text + "\n```"
+}
+
+// containsAny reports whether s contains any of the substrings.
+func containsAny(s string, substrings []string) bool {
+	for _, v := range substrings {
+		if strings.Contains(s, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package aicore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestDebugResponse(t *testing.T) {
+	choice := &llms.ContentChoice{
+		Content:    "hello",
+		StopReason: "stop",
+		GenerationInfo: map[string]any{
+			"PromptTokens":     12,
+			"CompletionTokens": 3,
+			"Authorization":    "Bearer sk-header",
+			"api_key":          "sk-info",
+			"model":            "gpt-4o via sk-secret",
+		},
+		ToolCalls: []llms.ToolCall{{ID: "call_2", FunctionCall: &llms.FunctionCall{Name: "getTime", Arguments: `{"timezone":"UTC"}`}}},
+	}
+	earlier := []llms.ToolCall{{ID: "call_1", FunctionCall: &llms.FunctionCall{Name: "wikipedia", Arguments: `{"topic":"Go"}`}}}
+
+	got := debugResponse(choice, earlier, []string{"sk-secret", ""})
+	if !strings.HasPrefix(got, "```json\n") || !strings.HasSuffix(got, "\n```") {
+		t.Fatalf("got %q, want a json code block", got)
+	}
+	for _, want := range []string{`"stop_reason": "stop"`, `"content_length": 5`, `"PromptTokens": 12`, `"CompletionTokens": 3`, `"name": "wikipedia"`, `"name": "getTime"`, "[redacted]"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %s, want %s in it", got, want)
+		}
+	}
+	for _, leaked := range []string{"sk-header", "sk-info", "sk-secret", "hello"} {
+		if strings.Contains(got, leaked) {
+			t.Errorf("got %s, want no %s in it", got, leaked)
+		}
+	}
+
+	choice.GenerationInfo = map[string]any{"fn": func() {}}
+	if got := debugResponse(choice, nil, nil); !strings.Contains(got, "generation info left out") {
+		t.Errorf("got %s, want the generation info left out", got)
+	}
+}
+
+func TestLLMAgent_QueryDebug(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"openai": &stubModel{chunks: []string{"hello"}, stopReason: "stop"}})
+	ctx := context.Background()
+
+	debug := func() string {
+		output, err := agent.Query(ctx, "openai", "alice", "hi", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		for chunk := range output {
+			got += chunk.Debug
+		}
+		return got
+	}
+
+	if !agent.ToggleDebug("alice") || !agent.Debugging("alice") || agent.Debugging("bob") {
+		t.Fatal("got the toggle of alice wrong")
+	}
+	if got := debug(); got != "" {
+		t.Fatalf("got debug output %q without enable_debug", got)
+	}
+
+	agent.settings.EnableDebug = true
+	if got := debug(); !strings.Contains(got, `"stop_reason": "stop"`) || strings.Contains(got, "xxxx") {
+		t.Fatalf("got debug output %q", got)
+	}
+
+	if agent.ToggleDebug("alice") {
+		t.Fatal("toggling again must turn the debug output off")
+	}
+	if got := debug(); got != "" {
+		t.Fatalf("got debug output %q once turned off", got)
+	}
+}
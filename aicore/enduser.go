@@ -0,0 +1,126 @@
+package aicore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/douglarek/llmverse/config"
+)
+
+type endUserKey struct{}
+
+// withEndUser carries the end-user identifier of the user in ctx according to
+// the end_user_id setting, so the provider can attribute the request to them.
+func withEndUser(ctx context.Context, mode, user string) context.Context {
+	switch mode {
+	case config.EndUserIDHashed:
+		sum := sha256.Sum256([]byte(user))
+		return context.WithValue(ctx, endUserKey{}, hex.EncodeToString(sum[:]))
+	case config.EndUserIDPlain:
+		return context.WithValue(ctx, endUserKey{}, user)
+	}
+	return ctx
+}
+
+// endUserDoer is the http client of OpenAI compatible models, it sets the end-user
+// identifier carried by the request context as the "user" field of chat requests.
+type endUserDoer struct{}
+
+func (endUserDoer) Do(req *http.Request) (*http.Response, error) {
+	if user, _ := req.Context().Value(endUserKey{}).(string); user != "" {
+		if err := setChatRequestFields(req, map[string]any{"user": user}); err != nil {
+			return nil, err
+		}
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// fieldsDoer sets fields on the chat requests of an OpenAI compatible model, for
+// the parameters langchaingo has no call option for.
+type fieldsDoer struct {
+	next   doer
+	fields map[string]any
+}
+
+func (d *fieldsDoer) Do(req *http.Request) (*http.Response, error) {
+	if err := setChatRequestFields(req, d.fields); err != nil {
+		return nil, err
+	}
+	return d.next.Do(req)
+}
+
+// headerDoer sets header on the requests of an OpenAI compatible model.
+type headerDoer struct {
+	next   doer
+	header http.Header
+}
+
+func (d *headerDoer) Do(req *http.Request) (*http.Response, error) {
+	for k, v := range d.header {
+		req.Header[k] = v
+	}
+	return d.next.Do(req)
+}
+
+// reasoningDoer adapts the chat requests of an OpenAI compatible model to a
+// reasoning model, which rejects temperature and max_tokens.
+type reasoningDoer struct {
+	next doer
+}
+
+func (d *reasoningDoer) Do(req *http.Request) (*http.Response, error) {
+	err := editChatRequest(req, func(payload map[string]json.RawMessage) {
+		delete(payload, "temperature")
+		if v, ok := payload["max_tokens"]; ok {
+			payload["max_completion_tokens"] = v
+			delete(payload, "max_tokens")
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.next.Do(req)
+}
+
+// setChatRequestFields sets fields on the JSON body of req if it is a chat request.
+func setChatRequestFields(req *http.Request, fields map[string]any) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return editChatRequest(req, func(payload map[string]json.RawMessage) {
+		for k, v := range fields {
+			payload[k], _ = json.Marshal(v)
+		}
+	})
+}
+
+// editChatRequest edits the JSON body of req with edit if it is a chat request.
+func editChatRequest(req *http.Request, edit func(payload map[string]json.RawMessage)) error {
+	if req.Body == nil || !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err == nil {
+		edit(payload)
+		if b, err := json.Marshal(payload); err == nil {
+			body = b
+		}
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return nil
+}
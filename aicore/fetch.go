@@ -0,0 +1,185 @@
+package aicore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/llms"
+	"golang.org/x/net/html"
+)
+
+const (
+	maxFetchSize = 2 << 20 // bytes of a page read at most
+	maxFetchText = 10000   // characters of the text of a page given to the model
+)
+
+var fetchTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "fetchURL",
+		Description: "Fetch a web page and get its readable text, e.g. to summarize it",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"url": map[string]any{
+					"type":        "string",
+					"description": "The http or https url of the page",
+				},
+			},
+			"required": []string{"url"},
+		},
+	},
+}
+
+func init() {
+	RegisterTool(newTool(fetchTool, nil, func(ctx context.Context, args struct {
+		URL string `json:"url"`
+	}) (string, error) {
+		toolStatus(ctx, "Reading %s", args.URL)
+		rs, err := fetchURL(ctx, args.URL)
+		if err != nil { // the model tells the user why the page can't be read
+			return "cannot fetch the page: " + err.Error(), nil
+		}
+		return rs, nil
+	}))
+}
+
+var errBlockedAddress = errors.New("the address is not public")
+
+// isBlockedIP reports whether ip is an address the tools must not reach, tests
+// replace it to fetch from local servers.
+var isBlockedIP = func(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// fetchClient checks the address of every connection once resolved, so neither a
+// redirect nor a DNS answer can lead it to a private network.
+var fetchClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+					return errBlockedAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// fetchURL downloads the HTML page at rawURL and returns its title and readable text,
+// truncated to maxFetchText characters.
+func fetchURL(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid url %q, only http and https urls can be fetched", rawURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "llmverse (https://github.com/douglarek/llmverse)")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errBlockedAddress) {
+			return "", fmt.Errorf("%s: %w", u.Host, errBlockedAddress)
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(u.Host + ": " + resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return "", fmt.Errorf("unsupported content type %q, only HTML pages can be fetched", mediaType)
+	}
+
+	doc, err := html.Parse(io.LimitReader(resp.Body, maxFetchSize))
+	if err != nil {
+		return "", err
+	}
+	title, text := htmlText(doc)
+
+	if utf8.RuneCountInString(text) > maxFetchText {
+		text = string([]rune(text)[:maxFetchText]) + "\n(truncated)"
+	}
+	addSource(ctx, u.String())
+	if title != "" {
+		return "Title: " + title + "\n\n" + text, nil
+	}
+	return text, nil
+}
+
+// skippedElements hold no readable text.
+var skippedElements = map[string]bool{
+	"title": true, "script": true, "style": true, "noscript": true, "template": true, "svg": true,
+	"iframe": true, "nav": true, "footer": true, "form": true,
+}
+
+// blockElements start a new line of text.
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true, "section": true, "article": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "pre": true, "blockquote": true,
+	"td": true, "th": true, "dt": true, "dd": true, "main": true, "header": true, "aside": true,
+}
+
+// htmlText returns the title of the document and its text, a line per block with the
+// spaces collapsed.
+func htmlText(doc *html.Node) (title, text string) {
+	var lines []string
+	var line strings.Builder
+	flush := func() {
+		if s := strings.Join(strings.Fields(line.String()), " "); s != "" {
+			lines = append(lines, s)
+		}
+		line.Reset()
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if n.Data == "title" && title == "" && n.FirstChild != nil {
+				title = strings.Join(strings.Fields(n.FirstChild.Data), " ")
+			}
+			if skippedElements[n.Data] {
+				return
+			}
+			if blockElements[n.Data] {
+				flush()
+				defer flush()
+			}
+		}
+		if n.Type == html.TextNode {
+			line.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	flush()
+
+	return title, strings.Join(lines, "\n")
+}
@@ -0,0 +1,60 @@
+package aicore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<html><head><title>The  Page</title><style>p {}</style></head><body>
+				<nav>Home | About</nav>
+				<h1>Hello</h1><p>Hello <b>world</b>,
+				again.</p><script>alert(1)</script><p>` + strings.Repeat("x", maxFetchText) + `</p></body></html>`))
+		case "/file":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write([]byte("%PDF-1.4"))
+		case "/redirect":
+			http.Redirect(w, r, "http://10.0.0.1/", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	// the test server listens on loopback, which is blocked
+	if _, err := fetchURL(context.Background(), ts.URL+"/page"); !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("got error %v, want %v", err, errBlockedAddress)
+	}
+
+	blocked := isBlockedIP
+	isBlockedIP = func(ip net.IP) bool { return !ip.IsLoopback() } // only the test server is reachable
+	defer func() { isBlockedIP = blocked }()
+
+	got, err := fetchURL(context.Background(), ts.URL+"/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "Title: The Page\n\nHello\nHello world, again.\n") || !strings.HasSuffix(got, "\n(truncated)") {
+		t.Errorf("got %.100q", got)
+	}
+	if strings.Contains(got, "alert") || strings.Contains(got, "Home") {
+		t.Errorf("got scripts or navigation in %.100q", got)
+	}
+
+	if _, err := fetchURL(context.Background(), ts.URL+"/file"); err == nil || !strings.Contains(err.Error(), "application/pdf") {
+		t.Errorf("got error %v, want an unsupported content type", err)
+	}
+	if _, err := fetchURL(context.Background(), ts.URL+"/redirect"); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("got error %v, want %v for a redirect to a private address", err, errBlockedAddress)
+	}
+	if _, err := fetchURL(context.Background(), "file:///etc/passwd"); err == nil {
+		t.Error("expected error for a file url")
+	}
+}
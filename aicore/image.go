@@ -0,0 +1,111 @@
+package aicore
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ImagesInfo is the key of the generation info under which a model returns the
+// images it generated, as []llms.BinaryContent, since a choice has only text.
+const ImagesInfo = "images"
+
+// choiceImages returns the images the model generated in the choice, as the
+// attachments of the answer.
+func choiceImages(choice *llms.ContentChoice) []*Attachment {
+	parts, _ := choice.GenerationInfo[ImagesInfo].([]llms.BinaryContent)
+	var v []*Attachment
+	for _, p := range parts {
+		mime := p.MIMEType
+		if mime == "" {
+			mime = http.DetectContentType(p.Data)
+		}
+		ext, ok := strings.CutPrefix(mime, "image/")
+		if !ok || len(p.Data) == 0 {
+			continue
+		}
+		name := "image"
+		if len(v) > 0 {
+			name += "-" + strconv.Itoa(len(v)+1)
+		}
+		v = append(v, &Attachment{Name: name + "." + ext, Data: p.Data})
+	}
+	return v
+}
+
+// maxImagePixels is the most pixels an image may have to be decoded, since a
+// small, highly compressed file can claim dimensions needing gigabytes of memory.
+const maxImagePixels = 50_000_000
+
+// errImageTooLarge is returned for the images with more than maxImagePixels pixels.
+var errImageTooLarge = errors.New("the image is too large")
+
+// downscaleImage shrinks the image so that neither side exceeds maxDimension and
+// re-encodes it as JPEG on a white background. Images already within bounds, or in
+// a format that can't be decoded, are returned unchanged along with their detected
+// MIME type.
+func downscaleImage(data []byte, maxDimension int) ([]byte, string, error) {
+	mime := http.DetectContentType(data)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, mime, nil
+	}
+	if maxDimension <= 0 || (cfg.Width <= maxDimension && cfg.Height <= maxDimension) {
+		return data, mime, nil
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return nil, "", errImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, mime, nil
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	nw, nh := maxDimension, maxDimension
+	if w > h {
+		nh = max(h*maxDimension/w, 1)
+	} else {
+		nw = max(w*maxDimension/h, 1)
+	}
+
+	// box filter: every destination pixel is the average of the source pixels it covers,
+	// laid over white since JPEG has no alpha and transparent pixels would turn black
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		sy0, sy1 := bounds.Min.Y+y*h/nh, bounds.Min.Y+(y+1)*h/nh
+		for x := 0; x < nw; x++ {
+			sx0, sx1 := bounds.Min.X+x*w/nw, bounds.Min.X+(x+1)*w/nw
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			// the colors are premultiplied, so white shows through by what the alpha leaves
+			bg := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{R: uint8((r/n + bg) >> 8), G: uint8((g/n + bg) >> 8), B: uint8((b/n + bg) >> 8), A: 0xff})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), "image/jpeg", nil
+}
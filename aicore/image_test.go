@@ -0,0 +1,94 @@
+package aicore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// encodePNG returns img encoded as PNG.
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// pngHeader returns the start of a PNG claiming to be w×h pixels, with no pixels.
+func pngHeader(w, h uint32) []byte {
+	ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0) // 8-bit RGB
+	b := append([]byte("\x89PNG\r\n\x1a\n"), 0, 0, 0, 13)
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestDownscaleImage(t *testing.T) {
+	opaque := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			opaque.Set(x, y, color.RGBA{R: 0xff, A: 0xff})
+		}
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 400, 200)) // every pixel fully transparent
+
+	tests := []struct {
+		name      string
+		data      []byte
+		unchanged bool
+		mime      string
+		w, h      int
+		color     color.RGBA // of the top left pixel of the result, if resized
+		err       error
+	}{
+		{name: "oversized", data: encodePNG(t, opaque), mime: "image/jpeg", w: 100, h: 50, color: color.RGBA{R: 0xff, A: 0xff}},
+		{name: "within bounds", data: encodePNG(t, opaque.SubImage(image.Rect(0, 0, 100, 50))), unchanged: true, mime: "image/png"},
+		{name: "undecodable", data: []byte("not an image"), unchanged: true, mime: "text/plain; charset=utf-8"},
+		{name: "transparent", data: encodePNG(t, transparent), mime: "image/jpeg", w: 100, h: 50, color: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		{name: "too many pixels", data: pngHeader(30000, 30000), err: errImageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, mime, err := downscaleImage(tt.data, 100)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if mime != tt.mime {
+				t.Fatalf("got MIME type %q, want %q", mime, tt.mime)
+			}
+			if tt.unchanged {
+				if !bytes.Equal(got, tt.data) {
+					t.Fatal("the image was changed")
+				}
+				return
+			}
+
+			img, err := jpeg.Decode(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+				t.Fatalf("got %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.w, tt.h)
+			}
+			// JPEG is lossy, so allow the colors to be a little off
+			r, g, b, _ := img.At(0, 0).RGBA()
+			for i, c := range [][2]uint32{{r >> 8, uint32(tt.color.R)}, {g >> 8, uint32(tt.color.G)}, {b >> 8, uint32(tt.color.B)}} {
+				if c[0]+8 < c[1] || c[0] > c[1]+8 {
+					t.Fatalf("got channel %d of %d, want %d", i, c[0], c[1])
+				}
+			}
+		})
+	}
+}
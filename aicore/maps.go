@@ -0,0 +1,303 @@
+package aicore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/douglarek/llmverse/config"
+	"github.com/tmc/langchaingo/llms"
+	"golang.org/x/net/html"
+)
+
+// maxDirectionSteps is the number of steps of a route given to the model at most.
+const maxDirectionSteps = 20
+
+var geocodeTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "geocode",
+		Description: "Get the coordinates and the full address of a place",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"place": map[string]any{
+					"type":        "string",
+					"description": "The name or address of the place, e.g. 'Eiffel Tower, Paris'",
+				},
+			},
+			"required": []string{"place"},
+		},
+	},
+}
+
+var directionsTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "getDirections",
+		Description: "Get the distance, the travel time and the steps of a route between two places",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"origin": map[string]any{
+					"type":        "string",
+					"description": "The name or address of the place to start from",
+				},
+				"destination": map[string]any{
+					"type":        "string",
+					"description": "The name or address of the place to go to",
+				},
+				"mode": map[string]any{
+					"type":        "string",
+					"description": "The means of travel, driving if not specified",
+					"enum":        directionModes,
+				},
+			},
+			"required": []string{"origin", "destination"},
+		},
+	},
+}
+
+func init() {
+	mapsKey := requireKey("maps_api_key", func(ms config.LLMSetting) *string { return ms.MapsAPIKey })
+	RegisterTool(newTool(geocodeTool, mapsKey, func(ctx context.Context, args struct {
+		Place string `json:"place"`
+	}) (string, error) {
+		toolStatus(ctx, "Looking up %s on the map", args.Place)
+		return geocode(ctx, args.Place, toolSetting(ctx))
+	}))
+	RegisterTool(newTool(directionsTool, mapsKey, func(ctx context.Context, args struct {
+		Origin      string `json:"origin"`
+		Destination string `json:"destination"`
+		Mode        string `json:"mode"`
+	}) (string, error) {
+		toolStatus(ctx, "Finding the way from %s to %s", args.Origin, args.Destination)
+		return getDirections(ctx, args.Origin, args.Destination, args.Mode, toolSetting(ctx))
+	}))
+}
+
+// directionModes are the means of travel of getDirections.
+var directionModes = []string{"driving", "walking", "cycling", "transit"}
+
+// base urls of the maps providers.
+var (
+	googleMapsBaseURL = "https://maps.googleapis.com/maps/api/"
+	mapboxBaseURL     = "https://api.mapbox.com/"
+)
+
+type geocodeResult struct {
+	Place     string  `json:"place"`
+	Address   string  `json:"address"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type directionsResult struct {
+	Origin          string   `json:"origin"`
+	Destination     string   `json:"destination"`
+	Mode            string   `json:"mode"`
+	DistanceKm      float64  `json:"distance_km"`
+	DurationMinutes float64  `json:"duration_minutes"`
+	Steps           []string `json:"steps,omitempty"`
+}
+
+// geocode looks up place with the configured maps provider and returns its
+// coordinates as JSON. Unknown places are reported as text.
+func geocode(ctx context.Context, place string, ms config.LLMSetting) (string, error) {
+	r, ok, err := lookupPlace(ctx, strings.TrimSpace(place), ms)
+	if err != nil || !ok {
+		return fmt.Sprintf("no place found for %q", place), err
+	}
+	rs, err := json.Marshal(r)
+	return string(rs), err
+}
+
+// lookupPlace returns the first match of place, ok is false if there is none.
+func lookupPlace(ctx context.Context, place string, ms config.LLMSetting) (geocodeResult, bool, error) {
+	r := geocodeResult{Place: place}
+
+	switch ms.MapsProvider {
+	case config.MapsProviderMapbox:
+		var resp struct {
+			Features []struct {
+				Properties struct {
+					FullAddress string `json:"full_address"`
+					Coordinates struct {
+						Latitude  float64 `json:"latitude"`
+						Longitude float64 `json:"longitude"`
+					} `json:"coordinates"`
+				} `json:"properties"`
+			} `json:"features"`
+		}
+		q := url.Values{"q": {place}, "limit": {"1"}, "access_token": {*ms.MapsAPIKey}}
+		if err := getJSON(ctx, mapboxBaseURL+"search/geocode/v6/forward?"+q.Encode(), &resp); err != nil {
+			return r, false, err
+		}
+		if len(resp.Features) == 0 {
+			return r, false, nil
+		}
+		p := resp.Features[0].Properties
+		r.Address, r.Latitude, r.Longitude = p.FullAddress, p.Coordinates.Latitude, p.Coordinates.Longitude
+	default:
+		var resp struct {
+			Status       string `json:"status"`
+			ErrorMessage string `json:"error_message"`
+			Results      []struct {
+				FormattedAddress string `json:"formatted_address"`
+				Geometry         struct {
+					Location struct {
+						Lat float64 `json:"lat"`
+						Lng float64 `json:"lng"`
+					} `json:"location"`
+				} `json:"geometry"`
+			} `json:"results"`
+		}
+		q := url.Values{"address": {place}, "key": {*ms.MapsAPIKey}}
+		if err := getJSON(ctx, googleMapsBaseURL+"geocode/json?"+q.Encode(), &resp); err != nil {
+			return r, false, err
+		}
+		if err := googleStatusError(resp.Status, resp.ErrorMessage); err != nil || len(resp.Results) == 0 {
+			return r, false, err
+		}
+		res := resp.Results[0]
+		r.Address, r.Latitude, r.Longitude = res.FormattedAddress, res.Geometry.Location.Lat, res.Geometry.Location.Lng
+	}
+
+	return r, true, nil
+}
+
+// googleStatusError returns the error of a Google Maps answer, nil if it succeeded
+// or found nothing.
+func googleStatusError(status, message string) error {
+	switch status {
+	case "OK", "ZERO_RESULTS", "NOT_FOUND":
+		return nil
+	}
+	if message != "" {
+		return errors.New("google maps: " + status + ": " + message)
+	}
+	return errors.New("google maps: " + status)
+}
+
+// getDirections returns the route from origin to destination by mode as JSON,
+// with at most maxDirectionSteps steps. Places or routes that can't be found are
+// reported as text.
+func getDirections(ctx context.Context, origin, destination, mode string, ms config.LLMSetting) (string, error) {
+	origin, destination = strings.TrimSpace(origin), strings.TrimSpace(destination)
+	if mode = strings.ToLower(strings.TrimSpace(mode)); mode == "" {
+		mode = "driving"
+	}
+	if !slices.Contains(directionModes, mode) {
+		return fmt.Sprintf("unknown mode %q, use one of %s", mode, strings.Join(directionModes, ", ")), nil
+	}
+	r := directionsResult{Origin: origin, Destination: destination, Mode: mode}
+
+	switch ms.MapsProvider {
+	case config.MapsProviderMapbox:
+		if mode == "transit" {
+			return "transit directions are not available, use driving, walking or cycling", nil
+		}
+		from, ok, err := lookupPlace(ctx, origin, ms)
+		if err != nil || !ok {
+			return fmt.Sprintf("no place found for %q", origin), err
+		}
+		to, ok, err := lookupPlace(ctx, destination, ms)
+		if err != nil || !ok {
+			return fmt.Sprintf("no place found for %q", destination), err
+		}
+		r.Origin, r.Destination = from.Address, to.Address
+
+		var resp struct {
+			Routes []struct {
+				Distance float64 `json:"distance"` // in meters
+				Duration float64 `json:"duration"` // in seconds
+				Legs     []struct {
+					Steps []struct {
+						Maneuver struct {
+							Instruction string `json:"instruction"`
+						} `json:"maneuver"`
+					} `json:"steps"`
+				} `json:"legs"`
+			} `json:"routes"`
+		}
+		coordinates := fmt.Sprintf("%f,%f;%f,%f", from.Longitude, from.Latitude, to.Longitude, to.Latitude)
+		q := url.Values{"steps": {"true"}, "access_token": {*ms.MapsAPIKey}}
+		if err := getJSON(ctx, mapboxBaseURL+"directions/v5/mapbox/"+mode+"/"+url.PathEscape(coordinates)+"?"+q.Encode(), &resp); err != nil {
+			return "", err
+		}
+		if len(resp.Routes) == 0 {
+			return fmt.Sprintf("no %s route found from %q to %q", mode, origin, destination), nil
+		}
+		route := resp.Routes[0]
+		r.DistanceKm, r.DurationMinutes = route.Distance/1000, route.Duration/60
+		for _, leg := range route.Legs {
+			for _, step := range leg.Steps {
+				r.Steps = append(r.Steps, step.Maneuver.Instruction)
+			}
+		}
+	default:
+		if mode == "cycling" {
+			mode = "bicycling"
+		}
+		var resp struct {
+			Status       string `json:"status"`
+			ErrorMessage string `json:"error_message"`
+			Routes       []struct {
+				Legs []struct {
+					StartAddress string `json:"start_address"`
+					EndAddress   string `json:"end_address"`
+					Distance     struct {
+						Value float64 `json:"value"` // in meters
+					} `json:"distance"`
+					Duration struct {
+						Value float64 `json:"value"` // in seconds
+					} `json:"duration"`
+					Steps []struct {
+						HTMLInstructions string `json:"html_instructions"`
+					} `json:"steps"`
+				} `json:"legs"`
+			} `json:"routes"`
+		}
+		q := url.Values{"origin": {origin}, "destination": {destination}, "mode": {mode}, "key": {*ms.MapsAPIKey}}
+		if err := getJSON(ctx, googleMapsBaseURL+"directions/json?"+q.Encode(), &resp); err != nil {
+			return "", err
+		}
+		if err := googleStatusError(resp.Status, resp.ErrorMessage); err != nil {
+			return "", err
+		}
+		if len(resp.Routes) == 0 || len(resp.Routes[0].Legs) == 0 {
+			return fmt.Sprintf("no %s route found from %q to %q", r.Mode, origin, destination), nil
+		}
+		legs := resp.Routes[0].Legs
+		r.Origin, r.Destination = legs[0].StartAddress, legs[len(legs)-1].EndAddress
+		for _, leg := range legs {
+			r.DistanceKm += leg.Distance.Value / 1000
+			r.DurationMinutes += leg.Duration.Value / 60
+			for _, step := range leg.Steps {
+				r.Steps = append(r.Steps, htmlInstruction(step.HTMLInstructions))
+			}
+		}
+	}
+
+	r.DistanceKm, r.DurationMinutes = math.Round(r.DistanceKm*10)/10, math.Round(r.DurationMinutes)
+	if len(r.Steps) > maxDirectionSteps {
+		r.Steps = append(r.Steps[:maxDirectionSteps], fmt.Sprintf("(%d more steps)", len(r.Steps)-maxDirectionSteps))
+	}
+	rs, err := json.Marshal(r)
+	return string(rs), err
+}
+
+// htmlInstruction returns the text of a step of Google directions, which comes as HTML.
+func htmlInstruction(s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return s
+	}
+	_, text := htmlText(doc)
+	return strings.Join(strings.Fields(text), " ")
+}
@@ -0,0 +1,135 @@
+package aicore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/douglarek/llmverse/config"
+)
+
+func TestGeocode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "key" && r.URL.Query().Get("access_token") != "key" {
+			w.Write([]byte(`{"status":"REQUEST_DENIED","error_message":"The provided API key is invalid."}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/geocode/json":
+			if r.URL.Query().Get("address") != "Eiffel Tower" {
+				w.Write([]byte(`{"status":"ZERO_RESULTS","results":[]}`))
+				return
+			}
+			w.Write([]byte(`{"status":"OK","results":[{"formatted_address":"Av. Gustave Eiffel, 75007 Paris, France","geometry":{"location":{"lat":48.8584,"lng":2.2945}}}]}`))
+		case "/search/geocode/v6/forward":
+			w.Write([]byte(`{"features":[{"properties":{"full_address":"Eiffel Tower, Paris, France","coordinates":{"latitude":48.8584,"longitude":2.2945}}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	googleMapsBaseURL, mapboxBaseURL = ts.URL+"/", ts.URL+"/"
+	defer func() {
+		googleMapsBaseURL, mapboxBaseURL = "https://maps.googleapis.com/maps/api/", "https://api.mapbox.com/"
+	}()
+
+	key := "key"
+	google := config.LLMSetting{MapsAPIKey: &key, MapsProvider: config.MapsProviderGoogle}
+
+	rs, err := geocode(context.Background(), " Eiffel Tower ", google)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r geocodeResult
+	if err := json.Unmarshal([]byte(rs), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r != (geocodeResult{Place: "Eiffel Tower", Address: "Av. Gustave Eiffel, 75007 Paris, France", Latitude: 48.8584, Longitude: 2.2945}) {
+		t.Fatalf("got %+v", r)
+	}
+
+	if rs, err = geocode(context.Background(), "nowhere", google); err != nil || !strings.Contains(rs, "no place found") {
+		t.Fatalf("got %q, %v, want no place found", rs, err)
+	}
+
+	mapbox := config.LLMSetting{MapsAPIKey: &key, MapsProvider: config.MapsProviderMapbox}
+	if rs, err = geocode(context.Background(), "Eiffel Tower", mapbox); err != nil || !strings.Contains(rs, `"address":"Eiffel Tower, Paris, France"`) {
+		t.Fatalf("got %q, %v", rs, err)
+	}
+
+	bad := "bad"
+	if _, err := geocode(context.Background(), "Eiffel Tower", config.LLMSetting{MapsAPIKey: &bad}); err == nil || !strings.Contains(err.Error(), "REQUEST_DENIED") {
+		t.Fatalf("got error %v, want REQUEST_DENIED", err)
+	}
+}
+
+func TestGetDirections(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/directions/json":
+			if r.URL.Query().Get("mode") != "bicycling" {
+				w.Write([]byte(`{"status":"ZERO_RESULTS","routes":[]}`))
+				return
+			}
+			w.Write([]byte(`{"status":"OK","routes":[{"legs":[{"start_address":"Louvre, Paris","end_address":"Eiffel Tower, Paris",
+				"distance":{"value":4321},"duration":{"value":1250},
+				"steps":[{"html_instructions":"Head <b>west</b> on <b>Rue de Rivoli</b>"},{"html_instructions":"Turn <b>left</b>"}]}]}]}`))
+		case r.URL.Path == "/search/geocode/v6/forward":
+			w.Write([]byte(`{"features":[{"properties":{"full_address":"` + r.URL.Query().Get("q") + `, Paris","coordinates":{"latitude":48.86,"longitude":2.33}}}]}`))
+		case strings.HasPrefix(r.URL.Path, "/directions/v5/mapbox/walking/"):
+			w.Write([]byte(`{"code":"Ok","routes":[{"distance":3000,"duration":2400,"legs":[{"steps":[{"maneuver":{"instruction":"Walk west"}},{"maneuver":{"instruction":"You have arrived"}}]}]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	googleMapsBaseURL, mapboxBaseURL = ts.URL+"/", ts.URL+"/"
+	defer func() {
+		googleMapsBaseURL, mapboxBaseURL = "https://maps.googleapis.com/maps/api/", "https://api.mapbox.com/"
+	}()
+
+	key := "key"
+	google := config.LLMSetting{MapsAPIKey: &key, MapsProvider: config.MapsProviderGoogle}
+
+	rs, err := getDirections(context.Background(), "Louvre", "Eiffel Tower", "Cycling", google)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r directionsResult
+	if err := json.Unmarshal([]byte(rs), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Origin != "Louvre, Paris" || r.Destination != "Eiffel Tower, Paris" || r.Mode != "cycling" || r.DistanceKm != 4.3 || r.DurationMinutes != 21 {
+		t.Fatalf("got %+v", r)
+	}
+	if want := []string{"Head west on Rue de Rivoli", "Turn left"}; !slices.Equal(r.Steps, want) {
+		t.Fatalf("got steps %q, want %q", r.Steps, want)
+	}
+
+	if rs, _ = getDirections(context.Background(), "Louvre", "Eiffel Tower", "", google); !strings.Contains(rs, "no driving route found") {
+		t.Fatalf("got %q, want no driving route", rs)
+	}
+	if rs, _ = getDirections(context.Background(), "Louvre", "Eiffel Tower", "flying", google); !strings.Contains(rs, "unknown mode") {
+		t.Fatalf("got %q, want unknown mode", rs)
+	}
+
+	mapbox := config.LLMSetting{MapsAPIKey: &key, MapsProvider: config.MapsProviderMapbox}
+	r = directionsResult{}
+	rs, err = getDirections(context.Background(), "Louvre", "Eiffel Tower", "walking", mapbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(rs), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Origin != "Louvre, Paris" || r.DistanceKm != 3 || r.DurationMinutes != 40 || len(r.Steps) != 2 {
+		t.Fatalf("got %+v", r)
+	}
+	if rs, _ = getDirections(context.Background(), "Louvre", "Eiffel Tower", "transit", mapbox); !strings.Contains(rs, "not available") {
+		t.Fatalf("got %q, want transit not available", rs)
+	}
+}
@@ -0,0 +1,135 @@
+package aicore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/douglarek/llmverse/config"
+)
+
+// Moderator screens the text sent to and received from the models.
+type Moderator interface {
+	// Moderate returns the categories the text is flagged for, or none if it's fine.
+	Moderate(ctx context.Context, text string) ([]string, error)
+}
+
+// noopModerator flags nothing, it is used when moderation is not configured.
+type noopModerator struct{}
+
+func (noopModerator) Moderate(context.Context, string) ([]string, error) {
+	return nil, nil
+}
+
+// newModerator returns the moderator configured by settings.
+func newModerator(settings config.Settings) Moderator {
+	if settings.ModerationAPIKey == nil || *settings.ModerationAPIKey == "" {
+		return noopModerator{}
+	}
+	return &openAIModerator{url: settings.ModerationURL, apiKey: *settings.ModerationAPIKey}
+}
+
+// openAIModerator screens text with an OpenAI compatible moderation endpoint.
+type openAIModerator struct {
+	url    string
+	apiKey string
+}
+
+func (m *openAIModerator) Moderate(ctx context.Context, text string) ([]string, error) {
+	body, err := json.Marshal(map[string]string{"input": text})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(req.URL.Host + ": " + resp.Status)
+	}
+
+	var result struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	var flagged []string
+	for _, r := range result.Results {
+		if !r.Flagged {
+			continue
+		}
+		for c, ok := range r.Categories {
+			if ok {
+				flagged = append(flagged, c)
+			}
+		}
+		if len(flagged) == 0 {
+			flagged = append(flagged, "flagged")
+		}
+	}
+	slices.Sort(flagged)
+	return flagged, nil
+}
+
+// ErrFlagged is the error of the text refused by the moderator.
+var ErrFlagged = errors.New("content flagged by moderation")
+
+// moderate returns an ErrFlagged error if the moderator flags text. The text is
+// refused as well if it can't be screened.
+func moderate(ctx context.Context, m Moderator, text string) error {
+	categories, err := m.Moderate(ctx, text)
+	if err != nil {
+		return fmt.Errorf("moderation failed: %w", err)
+	}
+	if len(categories) > 0 {
+		return fmt.Errorf("%w: %s", ErrFlagged, strings.Join(categories, ", "))
+	}
+	return nil
+}
+
+// moderateOutput holds the text of output back until it is complete, and passes
+// it on only if the moderator doesn't flag it.
+func moderateOutput(ctx context.Context, m Moderator, output <-chan Chunk, bufferSize int) <-chan Chunk {
+	screened := make(chan Chunk, bufferSize)
+	go func() {
+		defer close(screened)
+
+		var chunks []Chunk
+		var text strings.Builder
+		for chunk := range output {
+			chunks = append(chunks, chunk)
+			text.WriteString(chunk.Text)
+		}
+
+		if text.Len() > 0 {
+			if err := moderate(ctx, m, text.String()); err != nil {
+				send(ctx, screened, Chunk{Err: err})
+				return
+			}
+		}
+		for _, chunk := range chunks {
+			send(ctx, screened, chunk)
+		}
+	}()
+	return screened
+}
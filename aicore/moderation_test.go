@@ -0,0 +1,67 @@
+package aicore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// stubModerator flags the text containing word.
+type stubModerator struct {
+	word string
+}
+
+func (m stubModerator) Moderate(_ context.Context, text string) ([]string, error) {
+	if strings.Contains(text, m.word) {
+		return []string{"violence"}, nil
+	}
+	return nil, nil
+}
+
+func TestLLMAgent_QueryModeration(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"ok": &stubModel{chunks: []string{"a fight", " story"}}})
+	agent.moderator = stubModerator{word: "fight"}
+
+	if _, err := agent.QueryString(context.Background(), "ok", "user", "tell me about a fight", nil); !errors.Is(err, ErrFlagged) {
+		t.Fatalf("got error %v, want the input flagged", err)
+	}
+
+	got, err := agent.QueryString(context.Background(), "ok", "user", "tell me a story", nil)
+	if err != nil || got != "a fight story" {
+		t.Fatalf("got %q, %v, want the answer unscreened without moderate_output", got, err)
+	}
+
+	agent.settings.ModerateOutput = true
+	if _, err := agent.QueryString(context.Background(), "ok", "user", "tell me a story", nil); !errors.Is(err, ErrFlagged) {
+		t.Fatalf("got error %v, want the answer flagged", err)
+	}
+}
+
+func TestOpenAIModerator(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"results":[{"flagged":true,"categories":{"violence":true,"hate":true,"sexual":false}}]}`))
+	}))
+	defer ts.Close()
+
+	categories, err := (&openAIModerator{url: ts.URL, apiKey: "key"}).Moderate(context.Background(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(categories, []string{"hate", "violence"}) {
+		t.Fatalf("got categories %v", categories)
+	}
+
+	if _, err := (&openAIModerator{url: ts.URL, apiKey: "bad"}).Moderate(context.Background(), "text"); err == nil {
+		t.Fatal("expected error for invalid api key")
+	}
+}
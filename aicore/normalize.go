@@ -0,0 +1,100 @@
+package aicore
+
+import (
+	"context"
+	"strings"
+)
+
+// whitespaceNormalizer collapses runs of blank lines and strips trailing whitespace
+// from streamed text, leaving fenced code blocks untouched. Since a chunk may end
+// in the middle of a line, the incomplete line is held back until it is finished.
+type whitespaceNormalizer struct {
+	line    strings.Builder
+	inFence bool
+	blank   bool // the last emitted line was blank, or nothing is emitted yet
+}
+
+func newWhitespaceNormalizer() *whitespaceNormalizer {
+	return &whitespaceNormalizer{blank: true}
+}
+
+// write consumes a chunk and returns the normalized text of the lines it completed.
+func (n *whitespaceNormalizer) write(chunk string) string {
+	var b strings.Builder
+	for {
+		index := strings.IndexByte(chunk, '\n')
+		if index == -1 {
+			n.line.WriteString(chunk)
+			return b.String()
+		}
+		n.line.WriteString(chunk[:index])
+		chunk = chunk[index+1:]
+
+		if line, ok := n.normalizeLine(); ok {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+}
+
+// flush returns what is left of the last, unterminated line.
+func (n *whitespaceNormalizer) flush() string {
+	if n.line.Len() == 0 {
+		return ""
+	}
+	line, _ := n.normalizeLine()
+	return line
+}
+
+func (n *whitespaceNormalizer) normalizeLine() (string, bool) {
+	line := n.line.String()
+	n.line.Reset()
+
+	if strings.HasPrefix(strings.TrimSpace(line), "```") {
+		n.inFence = !n.inFence
+		n.blank = false
+		return strings.TrimRight(line, " \t"), true
+	}
+	if n.inFence {
+		return line, true
+	}
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" {
+		if n.blank {
+			return "", false
+		}
+		n.blank = true
+		return "", true
+	}
+
+	n.blank = false
+	return line, true
+}
+
+// normalizeOutput pipes the text of output through a whitespaceNormalizer, into a
+// channel buffered like output.
+func normalizeOutput(ctx context.Context, output <-chan Chunk, bufferSize int) <-chan Chunk {
+	normalized := make(chan Chunk, bufferSize)
+	go func() {
+		defer close(normalized)
+
+		n := newWhitespaceNormalizer()
+		for chunk := range output {
+			if chunk.Err != nil || chunk.Attachment != nil || chunk.Truncated || chunk.Debug != "" {
+				if v := n.flush(); v != "" {
+					send(ctx, normalized, Chunk{Text: v})
+				}
+				send(ctx, normalized, chunk)
+				continue
+			}
+			if v := n.write(chunk.Text); v != "" {
+				send(ctx, normalized, Chunk{Text: v})
+			}
+		}
+		if v := n.flush(); v != "" {
+			send(ctx, normalized, Chunk{Text: v})
+		}
+	}()
+	return normalized
+}
@@ -0,0 +1,21 @@
+package aicore
+
+import (
+	"testing"
+)
+
+func TestWhitespaceNormalizer(t *testing.T) {
+	chunks := []string{"\n\nhello  ", "\n\n\n\nwor", "ld\t\n```go\nfunc main() {  \n\n\n", "}\n```\n\n\nbye  "}
+	want := "hello\n\nworld\n```go\nfunc main() {  \n\n\n}\n```\n\nbye"
+
+	n := newWhitespaceNormalizer()
+	var got string
+	for _, c := range chunks {
+		got += n.write(c)
+	}
+	got += n.flush()
+
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package aicore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ledongthuc/pdf"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// errPDFEncrypted is returned for the PDFs that can't be read without a password.
+var errPDFEncrypted = errors.New("the PDF is encrypted")
+
+// extractPDFText returns the plain text of the PDF b, cut to its first maxChars
+// characters, and whether it was cut.
+func extractPDFText(b []byte, maxChars int) (text string, truncated bool, err error) {
+	defer func() { // the parser panics on some malformed files
+		if r := recover(); r != nil {
+			err = fmt.Errorf("the PDF cannot be read: %v", r)
+		}
+	}()
+
+	r, err := pdf.NewReader(bytes.NewReader(b), int64(len(b)))
+	if errors.Is(err, pdf.ErrInvalidPassword) || err != nil && strings.Contains(err.Error(), "encryption") { // or an unsupported encryption
+		return "", false, errPDFEncrypted
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("the PDF cannot be read: %w", err)
+	}
+
+	rd, err := r.GetPlainText()
+	if err != nil {
+		return "", false, fmt.Errorf("the PDF cannot be read: %w", err)
+	}
+	tb, err := io.ReadAll(rd)
+	if err != nil {
+		return "", false, fmt.Errorf("the PDF cannot be read: %w", err)
+	}
+
+	runes := []rune(strings.TrimSpace(string(tb)))
+	if len(runes) > maxChars {
+		return string(runes[:maxChars]), true, nil
+	}
+	return string(runes), false, nil
+}
+
+// parsePDFParts downloads the PDFs at urls and turns their text into parts, files
+// larger than maxSize bytes, encrypted or unreadable are refused. The text of each
+// file is cut to maxChars characters.
+func parsePDFParts(ctx context.Context, urls []string, maxSize, maxChars int) ([]llms.ContentPart, error) {
+	var parts []llms.ContentPart
+	for _, u := range urls {
+		name := path.Base(u)
+		if pu, err := url.Parse(u); err == nil {
+			name = path.Base(pu.Path)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := (&http.Client{Timeout: 1 * time.Minute}).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to download file %s: %s", name, resp.Status)
+		}
+
+		if len(b) > maxSize {
+			return nil, fmt.Errorf("file %s is larger than %d bytes", name, maxSize)
+		}
+		text, truncated, err := extractPDFText(b, maxChars)
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %w", name, err)
+		}
+		if text == "" {
+			return nil, fmt.Errorf("file %s has no text, scanned documents are not supported", name)
+		}
+		if truncated {
+			text += fmt.Sprintf("\n[the document was truncated to its first %d characters]", maxChars)
+		}
+		parts = append(parts, llms.TextPart(fmt.Sprintf("Content of the attached file %s:\n%s", name, text)))
+	}
+	return parts, nil
+}
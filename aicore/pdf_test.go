@@ -0,0 +1,86 @@
+package aicore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// buildPDF returns a one page PDF showing text, with trailer added to its trailer dictionary.
+func buildPDF(text, trailer string) []byte {
+	content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+	objs := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objs))
+	for i, o := range objs {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R %s>>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, trailer, xref)
+	return b.Bytes()
+}
+
+func TestExtractPDFText(t *testing.T) {
+	text, truncated, err := extractPDFText(buildPDF("Hello PDF", ""), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated || !strings.Contains(text, "Hello PDF") {
+		t.Fatalf("got %q, truncated %v", text, truncated)
+	}
+
+	text, truncated, err = extractPDFText(buildPDF("Hello PDF", ""), 5)
+	if err != nil || !truncated || len([]rune(text)) != 5 {
+		t.Fatalf("got %q, truncated %v, %v, want 5 characters truncated", text, truncated, err)
+	}
+
+	encrypted := buildPDF("secret", "/Encrypt << /Filter /Standard /V 1 /R 2 /Length 40 /P -4 /O (0123456789abcdef0123456789abcdef) /U (0123456789abcdef0123456789abcdef) >> /ID [(0123456789abcdef) (0123456789abcdef)] ")
+	if _, _, err := extractPDFText(encrypted, 100); !errors.Is(err, errPDFEncrypted) {
+		t.Fatalf("got error %v, want %v", err, errPDFEncrypted)
+	}
+
+	if _, _, err := extractPDFText([]byte("not a pdf"), 100); err == nil {
+		t.Fatal("expected error for an invalid PDF")
+	}
+}
+
+func TestParsePDFParts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buildPDF("A long document", ""))
+	}))
+	defer ts.Close()
+
+	parts, err := parsePDFParts(context.Background(), []string{ts.URL + "/doc.pdf"}, 1<<20, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 {
+		t.Fatalf("got %d parts, want 1", len(parts))
+	}
+	got := fmt.Sprint(parts[0])
+	if !strings.Contains(got, "doc.pdf") || !strings.Contains(got, "truncated to its first 6 characters") {
+		t.Fatalf("got part %q", got)
+	}
+
+	if _, err := parsePDFParts(context.Background(), []string{ts.URL + "/doc.pdf"}, 10, 6); err == nil {
+		t.Fatal("expected error for an oversized PDF")
+	}
+}
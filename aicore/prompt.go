@@ -0,0 +1,57 @@
+package aicore
+
+import (
+	"log/slog"
+	"strings"
+	"text/template"
+
+	"github.com/douglarek/llmverse/config"
+)
+
+// promptVars are the variables of the system prompt, like {{.Date}}.
+type promptVars struct {
+	User  string // the name of the user, or its id
+	Date  string // today, like 2024-09-02
+	Model string
+}
+
+// parsePrompt returns the template of the system prompt, parsed on first use and
+// kept. It is nil for a prompt without variables or that isn't a valid template.
+func (a *LLMAgent) parsePrompt(prompt string) *template.Template {
+	if !strings.Contains(prompt, "{{") {
+		return nil
+	}
+	if v, ok := a.prompts.Load(prompt); ok {
+		return v.(*template.Template)
+	}
+	t, err := template.New("system_prompt").Parse(prompt)
+	if err != nil {
+		slog.Warn("[LLMAgent.parsePrompt] system prompt is not a valid template, used as is", "error", err)
+		t = nil
+	}
+	a.prompts.Store(prompt, t)
+	return t
+}
+
+// parsePrompts parses the system prompts of the settings ahead of the queries.
+func (a *LLMAgent) parsePrompts(settings config.Settings) {
+	a.parsePrompt(settings.SystemPrompt)
+	for _, v := range settings.Models {
+		a.parsePrompt(v.SystemPrompt)
+	}
+}
+
+// renderPrompt fills in the variables of the system prompt, which is used as is if
+// it isn't a valid template.
+func (a *LLMAgent) renderPrompt(prompt string, vars promptVars) string {
+	t := a.parsePrompt(prompt)
+	if t == nil {
+		return prompt
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, vars); err != nil {
+		slog.Warn("[LLMAgent.renderPrompt] cannot fill in the system prompt, used as is", "error", err)
+		return prompt
+	}
+	return b.String()
+}
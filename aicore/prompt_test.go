@@ -0,0 +1,48 @@
+package aicore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestLLMAgent_RenderPrompt(t *testing.T) {
+	agent := newTestAgent(t, nil)
+	vars := promptVars{User: "alice", Date: "2024-09-02", Model: "openai"}
+
+	tests := []struct {
+		prompt string
+		want   string
+	}{
+		{"You talk to {{.User}} on {{.Date}}, as {{.Model}}.", "You talk to alice on 2024-09-02, as openai."},
+		{"You are a helpful AI assistant.", "You are a helpful AI assistant."},
+		{"Today is {{.Date", "Today is {{.Date"},                       // not parsed
+		{"Hello {{.Name}}", "Hello {{.Name}}"},                         // no such variable
+		{"Reply with {{ and }} as is.", "Reply with {{ and }} as is."}, // no action at all
+	}
+	for _, tt := range tests {
+		if got := agent.renderPrompt(tt.prompt, vars); got != tt.want {
+			t.Errorf("renderPrompt(%q) = %q, want %q", tt.prompt, got, tt.want)
+		}
+	}
+}
+
+func TestLLMAgent_BuildRequestPromptVars(t *testing.T) {
+	now = func() time.Time { return time.Date(2024, 9, 2, 8, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	model := &stubModel{}
+	agent := newTestAgent(t, map[string]llms.Model{"openai": model})
+	agent.settings.SystemPrompt = "You talk to {{.User}} on {{.Date}}, as {{.Model}}."
+	ctx := context.Background()
+
+	content, err := agent.buildRequest(ctx, agent.settings, model, "openai", "", "hi", nil, queryOptions{userName: "alice", stateless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := content[0].Parts[0].(llms.TextContent).Text; got != "You talk to alice on 2024-09-02, as openai." {
+		t.Fatalf("got system prompt %q", got)
+	}
+}
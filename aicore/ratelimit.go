@@ -0,0 +1,127 @@
+package aicore
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimit is the request quota of a provider, as reported by the rate-limit
+// headers of its last response.
+type rateLimit struct {
+	mu        sync.Mutex
+	known     bool
+	remaining int
+	reset     time.Time
+}
+
+// update records the quota reported by the headers of resp.
+func (r *rateLimit) update(resp *http.Response) {
+	remaining, err := strconv.Atoi(firstHeader(resp.Header, "x-ratelimit-remaining-requests", "x-ratelimit-remaining"))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		remaining, err = 0, nil
+	}
+	if err != nil {
+		return
+	}
+
+	reset, ok := parseReset(firstHeader(resp.Header, "x-ratelimit-reset-requests", "x-ratelimit-reset", "retry-after"))
+	if !ok {
+		reset = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.known, r.remaining, r.reset = true, remaining, reset
+}
+
+// wait blocks until the quota resets if it is used up.
+func (r *rateLimit) wait(ctx context.Context) error {
+	r.mu.Lock()
+	d := time.Until(r.reset)
+	exhausted := r.known && r.remaining <= 0 && d > 0
+	r.mu.Unlock()
+
+	if !exhausted {
+		return nil
+	}
+
+	slog.Warn("[rateLimit.wait] quota used up, waiting for reset", "reset", d)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// status returns the remaining requests and when the quota resets, ok is false if
+// the provider reported no quota yet.
+func (r *rateLimit) status() (remaining int, reset time.Time, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remaining, r.reset, r.known
+}
+
+func firstHeader(h http.Header, keys ...string) string {
+	for _, k := range keys {
+		if v := h.Get(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseReset parses the reset time of a quota, providers report it as a duration
+// ("6m0s"), in seconds ("20") or as a timestamp.
+func parseReset(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(d), true
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		if secs > 1e9 { // unix timestamp
+			return time.Unix(int64(secs), 0), true
+		}
+		return time.Now().Add(time.Duration(secs * float64(time.Second))), true
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+type doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// rateLimitDoer records the quota of the provider from its responses, and holds
+// requests back until the quota resets when throttle is on.
+type rateLimitDoer struct {
+	next     doer
+	limit    *rateLimit
+	throttle bool
+}
+
+func (d *rateLimitDoer) Do(req *http.Request) (*http.Response, error) {
+	if d.throttle {
+		if err := d.limit.wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := d.next.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	d.limit.update(resp)
+	return resp, nil
+}
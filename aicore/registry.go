@@ -0,0 +1,163 @@
+package aicore
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/douglarek/llmverse/config"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Tool is a function the models can call.
+type Tool interface {
+	Name() string
+	Definition() llms.Tool
+	// Execute runs the tool with the arguments in JSON the model called it with,
+	// and returns the result given back to the model.
+	Execute(ctx context.Context, args string) (string, error)
+}
+
+// toolChecker is implemented by the tools that can't work with every model
+// setting, like those needing a key.
+type toolChecker interface {
+	// Check returns why the tool can't be used with the model setting, or nil if it can.
+	Check(ctx context.Context, ms config.LLMSetting) error
+}
+
+var (
+	toolsMu sync.RWMutex
+	tools   = map[string]Tool{} // the registered tools by name
+)
+
+// RegisterTool offers the tool to the models, it panics if a tool of the same
+// name is registered already.
+func RegisterTool(t Tool) {
+	toolsMu.Lock()
+	defer toolsMu.Unlock()
+	if _, ok := tools[t.Name()]; ok {
+		panic("tool " + t.Name() + " is registered twice")
+	}
+	tools[t.Name()] = t
+}
+
+// lookupTool returns the registered tool of the name.
+func lookupTool(name string) (Tool, bool) {
+	toolsMu.RLock()
+	defer toolsMu.RUnlock()
+	t, ok := tools[name]
+	return t, ok
+}
+
+// registeredTools returns the registered tools sorted by name.
+func registeredTools() []Tool {
+	toolsMu.RLock()
+	defer toolsMu.RUnlock()
+	v := make([]Tool, 0, len(tools))
+	for _, t := range tools {
+		v = append(v, t)
+	}
+	slices.SortFunc(v, func(a, b Tool) int { return cmp.Compare(a.Name(), b.Name()) })
+	return v
+}
+
+// availableTools returns the tools the model can use, tools that can't work with
+// the model setting are left out and logged.
+func availableTools(ctx context.Context, modelSetting config.LLMSetting) []llms.Tool {
+	var usable []llms.Tool
+	for _, t := range registeredTools() {
+		if len(modelSetting.EnabledTools) > 0 && !slices.Contains(modelSetting.EnabledTools, t.Name()) {
+			continue
+		}
+		if c, ok := t.(toolChecker); ok {
+			if err := c.Check(ctx, modelSetting); err != nil {
+				slog.Warn("[availableTools] tool disabled", "model", modelSetting.Name, "tool", t.Name(), "reason", err)
+				continue
+			}
+		}
+		usable = append(usable, t.Definition())
+	}
+	return usable
+}
+
+// funcTool is a tool of a definition, whose arguments are decoded into A for execute.
+type funcTool[A any] struct {
+	definition llms.Tool
+	check      func(ctx context.Context, ms config.LLMSetting) error // nil if the tool always works
+	execute    func(ctx context.Context, args A) (string, error)
+}
+
+// newTool returns the tool of the definition, run by execute and usable where
+// check, if not nil, allows it.
+func newTool[A any](definition llms.Tool, check func(context.Context, config.LLMSetting) error, execute func(context.Context, A) (string, error)) Tool {
+	return &funcTool[A]{definition: definition, check: check, execute: execute}
+}
+
+func (t *funcTool[A]) Name() string { return t.definition.Function.Name }
+
+func (t *funcTool[A]) Definition() llms.Tool { return t.definition }
+
+func (t *funcTool[A]) Execute(ctx context.Context, args string) (string, error) {
+	var v A
+	if err := json.Unmarshal([]byte(args), &v); err != nil {
+		return "", fmt.Errorf("bad arguments of the tool %s: %w", t.Name(), err)
+	}
+	return t.execute(ctx, v)
+}
+
+func (t *funcTool[A]) Check(ctx context.Context, ms config.LLMSetting) error {
+	if t.check == nil {
+		return nil
+	}
+	return t.check(ctx, ms)
+}
+
+// requireKey returns a check that the key of the model setting is set, name is
+// the name of the key in the config.
+func requireKey(name string, key func(config.LLMSetting) *string) func(context.Context, config.LLMSetting) error {
+	return func(_ context.Context, ms config.LLMSetting) error {
+		if v := key(ms); v == nil || *v == "" {
+			return errors.New(name + " is not set")
+		}
+		return nil
+	}
+}
+
+type toolEnvKey struct{}
+
+// toolEnv is what the running tools get from the query calling them.
+type toolEnv struct {
+	ms     config.LLMSetting
+	output chan<- Chunk
+}
+
+// withToolEnv returns ctx for the tools called by the model of the setting, which
+// stream to output.
+func withToolEnv(ctx context.Context, ms config.LLMSetting, output chan<- Chunk) context.Context {
+	return context.WithValue(ctx, toolEnvKey{}, toolEnv{ms: ms, output: output})
+}
+
+// toolSetting returns the setting of the model calling the tool, with its keys.
+func toolSetting(ctx context.Context) config.LLMSetting {
+	env, _ := ctx.Value(toolEnvKey{}).(toolEnv)
+	return env.ms
+}
+
+// toolStatus tells the user what the running tool is doing.
+func toolStatus(ctx context.Context, format string, args ...any) {
+	if env, ok := ctx.Value(toolEnvKey{}).(toolEnv); ok && env.output != nil {
+		sendToolStatus(ctx, env.output, format, args...)
+	}
+}
+
+// toolAttach sends the attachment along with the answer.
+func toolAttach(ctx context.Context, a *Attachment) {
+	if env, ok := ctx.Value(toolEnvKey{}).(toolEnv); ok && env.output != nil {
+		send(ctx, env.output, Chunk{Attachment: a})
+	}
+}
@@ -0,0 +1,132 @@
+package aicore
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/douglarek/llmverse/config"
+	"github.com/tmc/langchaingo/llms"
+)
+
+var echoTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "echo",
+		Description: "Echo the text",
+		Parameters: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"text": map[string]any{"type": "string"}},
+		},
+	},
+}
+
+// registerTestTool registers t until the test ends.
+func registerTestTool(t *testing.T, tool Tool) {
+	RegisterTool(tool)
+	t.Cleanup(func() {
+		toolsMu.Lock()
+		delete(tools, tool.Name())
+		toolsMu.Unlock()
+	})
+}
+
+func TestRegisterTool(t *testing.T) {
+	for _, name := range []string{"getExchangeRate", "getWeather", "fetchURL", "geocode", "getDirections"} {
+		if tool, ok := lookupTool(name); !ok || tool.Name() != name {
+			t.Errorf("lookupTool(%q) = %v, %v", name, tool, ok)
+		}
+	}
+	if _, ok := lookupTool("echo"); ok {
+		t.Fatal("echo is registered before the test")
+	}
+
+	registerTestTool(t, newTool(echoTool, nil, func(_ context.Context, args struct{ Text string }) (string, error) {
+		return args.Text, nil
+	}))
+	if !slices.ContainsFunc(registeredTools(), func(tool Tool) bool { return tool.Name() == "echo" }) {
+		t.Fatal("echo is not in the registered tools")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering echo twice should panic")
+		}
+	}()
+	RegisterTool(newTool(echoTool, nil, func(context.Context, struct{}) (string, error) { return "", nil }))
+}
+
+func TestFuncTool(t *testing.T) {
+	tool := newTool(echoTool, requireKey("echo_key", func(ms config.LLMSetting) *string { return ms.NewsAPIKey }),
+		func(_ context.Context, args struct{ Text string }) (string, error) {
+			if args.Text == "" {
+				return "", errors.New("no text")
+			}
+			return strings.ToUpper(args.Text), nil
+		})
+
+	if v, err := tool.Execute(context.Background(), `{"text":"hi"}`); err != nil || v != "HI" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if _, err := tool.Execute(context.Background(), `{"text":`); err == nil {
+		t.Fatal("expected error for bad arguments")
+	}
+	if _, err := tool.Execute(context.Background(), `{}`); err == nil {
+		t.Fatal("expected error from the tool")
+	}
+
+	c := tool.(toolChecker)
+	if err := c.Check(context.Background(), config.LLMSetting{}); err == nil || err.Error() != "echo_key is not set" {
+		t.Fatalf("got %v, want echo_key is not set", err)
+	}
+	key := "key"
+	if err := c.Check(context.Background(), config.LLMSetting{NewsAPIKey: &key}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLLMAgent_QueryRegisteredTool(t *testing.T) {
+	registerTestTool(t, newTool(echoTool, nil, func(ctx context.Context, args struct{ Text string }) (string, error) {
+		toolStatus(ctx, "Echoing %s", args.Text)
+		return "echo: " + args.Text, nil
+	}))
+
+	model := &scriptedModel{choices: []*llms.ContentChoice{
+		{ToolCalls: []llms.ToolCall{
+			{ID: "call_0", Type: "function", FunctionCall: &llms.FunctionCall{Name: "unknown", Arguments: `{}`}},
+			{ID: "call_1", Type: "function", FunctionCall: &llms.FunctionCall{Name: "echo", Arguments: `{"text":"ping"}`}},
+		}},
+		{Content: "pong"},
+	}}
+	agent := newTestAgent(t, map[string]llms.Model{"stub": model})
+	agent.tools = map[string][]llms.Tool{"stub": {echoTool}}
+	agent.settings.Models = []config.LLMSetting{{Name: "stub", Enabled: true}}
+
+	got, err := agent.QueryString(context.Background(), "stub", "user", "ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(got, "pong") || !strings.Contains(got, "Echoing ping") {
+		t.Fatalf("got %q, want the tool status and the answer", got)
+	}
+
+	if len(model.calls) != 2 {
+		t.Fatalf("got %d model calls, want 2", len(model.calls))
+	}
+	var results []string
+	for _, m := range model.calls[1] {
+		if m.Role != llms.ChatMessageTypeTool {
+			continue
+		}
+		for _, p := range m.Parts {
+			if r, ok := p.(llms.ToolCallResponse); ok {
+				results = append(results, r.Name+"="+r.Content)
+			}
+		}
+	}
+	if want := []string{"echo=echo: ping"}; !slices.Equal(results, want) {
+		t.Fatalf("got tool results %v, want %v", results, want)
+	}
+}
@@ -0,0 +1,150 @@
+package aicore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/douglarek/llmverse/config"
+	"github.com/koffeinsource/go-imgur"
+)
+
+// imageRehoster copies a generated image to a host whose links do not expire. The
+// image is given as data, or downloaded from url if data is nil.
+type imageRehoster interface {
+	rehost(ctx context.Context, url string, data []byte, desc string) (string, error)
+}
+
+// rehostedImage returns data, or the image downloaded from url if data is nil.
+func rehostedImage(ctx context.Context, url string, data []byte) ([]byte, error) {
+	if data != nil {
+		return data, nil
+	}
+	return downloadImage(ctx, url, maxGeneratedImageSize)
+}
+
+// newImageRehoster returns the rehoster of the configured image host, or nil if none is configured.
+func newImageRehoster(ms config.LLMSetting) imageRehoster {
+	switch ms.ImageHost {
+	case config.ImageHostImgur:
+		return &imgurRehoster{clientID: *ms.ImgurClientID, retries: ms.ImgurRetries}
+	case config.ImageHostS3:
+		return &s3Rehoster{setting: *ms.S3}
+	}
+	return nil
+}
+
+// imgurClient is the part of the imgur client used by imgurRehoster.
+type imgurClient interface {
+	GetRateLimit() (*imgur.RateLimit, error)
+	UploadImage(image []byte, album string, dtype string, title string, description string) (*imgur.ImageInfo, int, error)
+}
+
+type imgurRehoster struct {
+	clientID string
+	retries  *int
+	client   imgurClient // created from clientID if nil
+}
+
+// rehost uploads the image to imgur, retrying transient failures. When the imgur
+// rate limit is exceeded the original url is returned.
+func (r *imgurRehoster) rehost(ctx context.Context, url string, data []byte, desc string) (string, error) {
+	ic := r.client
+	if ic == nil {
+		c, err := imgur.NewClient(&http.Client{Timeout: 1 * time.Minute}, r.clientID, "")
+		if err != nil {
+			return "", err
+		}
+		ic = c
+	}
+
+	upload := func() (string, error) {
+		rl, err := ic.GetRateLimit()
+		if err != nil {
+			return "", err
+		}
+		if rl.ClientRemaining == 0 {
+			slog.Warn("[imgurRehoster.rehost] imgur rate limit exceeded", "reset_time", rl.UserReset)
+			return url, nil
+		}
+
+		if data, err = rehostedImage(ctx, url, data); err != nil { // kept for the retries
+			return "", err
+		}
+
+		slog.Debug("[imgurRehoster.rehost] uploading image to imgur", "url", url, "size", len(data))
+		// the upload is form encoded, so the image is sent as base64 rather than raw bytes
+		ii, _, err := ic.UploadImage([]byte(base64.StdEncoding.EncodeToString(data)), "", "base64", "", desc)
+		if err != nil {
+			return "", err
+		}
+		return ii.Link, nil
+	}
+
+	link, err := upload()
+	for attempt := 1; err != nil && r.retries != nil && attempt <= *r.retries; attempt++ {
+		slog.Warn("[imgurRehoster.rehost] retrying imgur upload", "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+		link, err = upload()
+	}
+
+	return link, err
+}
+
+type s3Rehoster struct {
+	setting config.S3Setting
+}
+
+// rehost puts the image into the S3 compatible bucket, the object is named after
+// the hash of its content.
+func (r *s3Rehoster) rehost(ctx context.Context, url string, data []byte, _ string) (string, error) {
+	data, err := rehostedImage(ctx, url, data)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	payloadHash := hex.EncodeToString(sum[:])
+	key := "llmverse/" + payloadHash + ".png"
+	endpoint := strings.TrimRight(r.setting.Endpoint, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"/"+r.setting.Bucket+"/"+key, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	creds := aws.Credentials{AccessKeyID: r.setting.AccessKeyID, SecretAccessKey: r.setting.SecretAccessKey}
+	signer := v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	if err := signer.SignHTTP(ctx, creds, req, payloadHash, "s3", r.setting.Region, time.Now()); err != nil {
+		return "", err
+	}
+
+	resp, err := (&http.Client{Timeout: 1 * time.Minute}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("s3 upload failed: " + resp.Status)
+	}
+
+	if r.setting.PublicURL != "" {
+		return strings.TrimRight(r.setting.PublicURL, "/") + "/" + key, nil
+	}
+	return endpoint + "/" + r.setting.Bucket + "/" + key, nil
+}
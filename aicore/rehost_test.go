@@ -0,0 +1,70 @@
+package aicore
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/koffeinsource/go-imgur"
+)
+
+type fakeImgur struct {
+	remaining int64
+	uploaded  []byte
+	dtype     string
+}
+
+func (f *fakeImgur) GetRateLimit() (*imgur.RateLimit, error) {
+	return &imgur.RateLimit{ClientRemaining: f.remaining}, nil
+}
+
+func (f *fakeImgur) UploadImage(image []byte, _ string, dtype string, _ string, _ string) (*imgur.ImageInfo, int, error) {
+	f.uploaded, f.dtype = image, dtype
+	return &imgur.ImageInfo{Link: "https://i.imgur.com/abc.png"}, http.StatusOK, nil
+}
+
+func TestImgurRehoster(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nimage")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.png" {
+			w.WriteHeader(http.StatusForbidden) // an expired link
+			return
+		}
+		w.Write(png)
+	}))
+	defer ts.Close()
+
+	client := &fakeImgur{remaining: 10}
+	r := &imgurRehoster{client: client}
+
+	link, err := r.rehost(context.Background(), ts.URL+"/image.png", nil, "a cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://i.imgur.com/abc.png" {
+		t.Fatalf("got link %q", link)
+	}
+	if client.dtype != "base64" || string(client.uploaded) != base64.StdEncoding.EncodeToString(png) {
+		t.Fatalf("got upload %q of type %q, want the image bytes", client.uploaded, client.dtype)
+	}
+
+	if _, err := r.rehost(context.Background(), ts.URL+"/expired.png", nil, "a cat"); err == nil {
+		t.Fatal("expected error for an image that can't be downloaded")
+	}
+
+	client.uploaded = nil
+	if _, err := r.rehost(context.Background(), ts.URL+"/expired.png", png, "a cat"); err != nil {
+		t.Fatalf("got error %v, want the image given uploaded without downloading it", err)
+	}
+	if string(client.uploaded) != base64.StdEncoding.EncodeToString(png) {
+		t.Fatalf("got upload %q, want the image given", client.uploaded)
+	}
+
+	client = &fakeImgur{}
+	r = &imgurRehoster{client: client}
+	if link, err := r.rehost(context.Background(), ts.URL+"/image.png", nil, "a cat"); err != nil || link != ts.URL+"/image.png" {
+		t.Fatalf("got %q, %v, want the original url when rate limited", link, err)
+	}
+}
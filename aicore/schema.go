@@ -0,0 +1,159 @@
+package aicore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// validateSchema checks v, as decoded by encoding/json, against schema and returns
+// the violations found. Only the commonly used keywords of JSON Schema are supported:
+// type, enum, properties, required, additionalProperties, items, minimum, maximum,
+// minLength, maxLength, minItems and maxItems.
+func validateSchema(schema map[string]any, v any, path string) []string {
+	var problems []string
+
+	if t, ok := schema["type"]; ok && !matchType(t, v) {
+		return []string{fmt.Sprintf("%s: must be of type %v", path, t)}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return fmt.Sprint(e) == fmt.Sprint(v) }) {
+		problems = append(problems, fmt.Sprintf("%s: must be one of %v", path, enum))
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, r := range required {
+				if _, ok := v[fmt.Sprint(r)]; !ok {
+					problems = append(problems, fmt.Sprintf("%s: missing required property %q", path, r))
+				}
+			}
+		}
+		for k, pv := range v {
+			if ps, ok := properties[k].(map[string]any); ok {
+				problems = append(problems, validateSchema(ps, pv, path+"."+k)...)
+			} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				problems = append(problems, fmt.Sprintf("%s: unexpected property %q", path, k))
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, iv := range v {
+				problems = append(problems, validateSchema(items, iv, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+		if n, ok := schema["minItems"].(float64); ok && float64(len(v)) < n {
+			problems = append(problems, fmt.Sprintf("%s: must have at least %v items", path, n))
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(v)) > n {
+			problems = append(problems, fmt.Sprintf("%s: must have at most %v items", path, n))
+		}
+	case string:
+		if n, ok := schema["minLength"].(float64); ok && float64(len([]rune(v))) < n {
+			problems = append(problems, fmt.Sprintf("%s: must be at least %v characters", path, n))
+		}
+		if n, ok := schema["maxLength"].(float64); ok && float64(len([]rune(v))) > n {
+			problems = append(problems, fmt.Sprintf("%s: must be at most %v characters", path, n))
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && v < n {
+			problems = append(problems, fmt.Sprintf("%s: must be >= %v", path, n))
+		}
+		if n, ok := schema["maximum"].(float64); ok && v > n {
+			problems = append(problems, fmt.Sprintf("%s: must be <= %v", path, n))
+		}
+	}
+
+	return problems
+}
+
+// matchType reports whether v is of the schema type t, a type name or a list of them.
+func matchType(t any, v any) bool {
+	if types, ok := t.([]any); ok {
+		return slices.ContainsFunc(types, func(t any) bool { return matchType(t, v) })
+	}
+
+	switch t {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == float64(int64(n))
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return true
+}
+
+// trimCodeFence strips the markdown code fence models like to wrap JSON in.
+func trimCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	s = strings.TrimPrefix(s, "```")
+	if i := strings.IndexByte(s, '\n'); i != -1 {
+		s = s[i+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "```"))
+}
+
+// generateStructured asks the model for JSON conforming to schema, and re-prompts
+// it with the violations until the answer is valid or the retries are used up.
+func generateStructured(ctx context.Context, model llms.Model, content []llms.MessageContent, options []llms.CallOption, schema json.RawMessage, retries int) (string, error) {
+	var s map[string]any
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return "", fmt.Errorf("invalid schema: %w", err)
+	}
+
+	content = slices.Clone(content)
+	systemPrompt := content[0].Parts[0].(llms.TextContent).Text
+	content[0] = llms.TextParts(llms.ChatMessageTypeSystem, systemPrompt+"\n\nRespond only with JSON that conforms to this JSON Schema:\n"+string(schema))
+	options = append(options, llms.WithJSONMode())
+
+	for attempt := 0; ; attempt++ {
+		resp, err := model.GenerateContent(ctx, content, options...)
+		if err != nil {
+			return "", err
+		}
+
+		answer := trimCodeFence(resp.Choices[0].Content)
+		var v any
+		var problems []string
+		if err := json.Unmarshal([]byte(answer), &v); err != nil {
+			problems = []string{"invalid JSON: " + err.Error()}
+		} else {
+			problems = validateSchema(s, v, "$")
+		}
+		if len(problems) == 0 {
+			return answer, nil
+		}
+
+		if attempt >= retries {
+			return "", fmt.Errorf("structured output is still invalid after %d retries: %s", retries, strings.Join(problems, "; "))
+		}
+		content = append(content,
+			llms.TextParts(llms.ChatMessageTypeAI, resp.Choices[0].Content),
+			llms.TextParts(llms.ChatMessageTypeHuman, "Your answer does not conform to the JSON Schema:\n- "+strings.Join(problems, "\n- ")+"\nAnswer again with the corrected JSON only."),
+		)
+	}
+}
@@ -0,0 +1,83 @@
+package aicore
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+const contactSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"enum": ["friend", "work"]}}
+	},
+	"required": ["name"],
+	"additionalProperties": false
+}`
+
+func TestValidateSchema(t *testing.T) {
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(contactSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input    string
+		problems int
+	}{
+		{`{"name": "Ada"}`, 0},
+		{`{"name": "Ada", "age": 36, "tags": ["work"]}`, 0},
+		{`{}`, 1},
+		{`{"name": ""}`, 1},
+		{`{"name": "Ada", "age": 36.5}`, 1},
+		{`{"name": "Ada", "age": -1, "tags": ["family"]}`, 2},
+		{`{"name": "Ada", "email": "ada@example.com"}`, 1},
+		{`["Ada"]`, 1},
+	}
+
+	for _, tt := range tests {
+		var v any
+		if err := json.Unmarshal([]byte(tt.input), &v); err != nil {
+			t.Fatal(err)
+		}
+		if problems := validateSchema(schema, v, "$"); len(problems) != tt.problems {
+			t.Errorf("validateSchema(%s) = %v, want %d problems", tt.input, problems, tt.problems)
+		}
+	}
+}
+
+func TestGenerateStructured(t *testing.T) {
+	system := llms.TextParts(llms.ChatMessageTypeSystem, "You are a helpful AI assistant.")
+	human := llms.TextParts(llms.ChatMessageTypeHuman, "Ada Lovelace, 36")
+
+	model := &scriptedModel{choices: []*llms.ContentChoice{
+		{Content: `{"fullname": "Ada Lovelace"}`},
+		{Content: "```json\n{\"name\": \"Ada Lovelace\", \"age\": 36}\n```"},
+	}}
+	got, err := generateStructured(context.Background(), model, []llms.MessageContent{system, human}, nil, json.RawMessage(contactSchema), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != `{"name": "Ada Lovelace", "age": 36}` {
+		t.Fatalf("got %q", got)
+	}
+
+	// the retry carries the violations of the first answer
+	retry := model.calls[1]
+	if v := retry[len(retry)-1].Parts[0].(llms.TextContent).Text; !strings.Contains(v, `missing required property "name"`) {
+		t.Fatalf("got retry prompt %q", v)
+	}
+	if v := retry[0].Parts[0].(llms.TextContent).Text; !strings.Contains(v, "JSON Schema") {
+		t.Fatalf("got system prompt %q", v)
+	}
+
+	model = &scriptedModel{choices: []*llms.ContentChoice{{Content: "not json"}, {Content: "{}"}}}
+	if _, err := generateStructured(context.Background(), model, []llms.MessageContent{system, human}, nil, json.RawMessage(contactSchema), 1); err == nil {
+		t.Fatal("expected error after the retries are used up")
+	}
+}
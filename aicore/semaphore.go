@@ -0,0 +1,52 @@
+package aicore
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrBusy is returned when a query waited too long for a free slot.
+var ErrBusy = errors.New("busy, try again shortly")
+
+// queueTimeout is how long a query waits for a free slot.
+var queueTimeout = 30 * time.Second
+
+// semaphore caps the number of queries generating at once, nil means no cap.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire takes a slot, waiting up to queueTimeout for one to be released.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	default:
+	}
+
+	t := time.NewTimer(queueTimeout)
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-t.C:
+		return ErrBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,65 @@
+package aicore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrShuttingDown is returned for the queries made once Shutdown is called.
+var ErrShuttingDown = errors.New("shutting down, try again shortly")
+
+// interruptedNote ends the answers cut by a shutdown.
+const interruptedNote = "\n\n(interrupted)"
+
+// stopContext returns the context done once Shutdown is called.
+func (a *LLMAgent) stopContext() context.Context {
+	a.stopOnce.Do(func() { a.stopCtx, a.stop = context.WithCancel(context.Background()) })
+	return a.stopCtx
+}
+
+// begin counts a generation in, unless Shutdown was called.
+func (a *LLMAgent) begin() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.stopContext().Err() != nil {
+		return false
+	}
+	a.active.Add(1)
+	return true
+}
+
+// Shutdown stops the generations in progress, their answers so far end with an
+// interrupted note, and waits up to timeout for them to finish. It reports whether
+// they all did. The queries made afterwards fail with ErrShuttingDown.
+func (a *LLMAgent) Shutdown(timeout time.Duration) bool {
+	a.stopContext()
+	a.mu.Lock() // no generation is counted in once the wait starts
+	a.stop()
+	a.mu.Unlock()
+	return waitTimeout(&a.active, timeout)
+}
+
+// ShutdownTimeout returns how long the answers in progress are waited for on shutdown.
+func (a *LLMAgent) ShutdownTimeout() time.Duration {
+	return time.Duration(*a.currentSettings().ShutdownTimeout) * time.Second
+}
+
+// waitTimeout waits up to timeout for wg, and reports whether it is done.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
@@ -0,0 +1,77 @@
+package aicore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// stuckModel ignores the cancellation until released.
+type stuckModel struct {
+	release chan struct{}
+}
+
+func (m *stuckModel) GenerateContent(ctx context.Context, _ []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	<-m.release
+	return nil, ctx.Err()
+}
+
+func (m *stuckModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+func TestLLMAgent_Shutdown(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"openai": &endlessModel{chunk: "hello "}})
+	ctx := context.Background()
+
+	output, err := agent.Query(ctx, "openai", "alice", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-output // the generation is under way
+	answer := make(chan string)
+	go func() {
+		text := first.Text
+		for chunk := range output {
+			text += chunk.Text
+		}
+		answer <- text
+	}()
+
+	if !agent.Shutdown(5 * time.Second) {
+		t.Fatal("got the generation still running after the shutdown")
+	}
+	got := <-answer
+	if !strings.HasPrefix(got, "hello ") || !strings.HasSuffix(got, "\n\n(interrupted)") {
+		t.Fatalf("got answer %q, want the answer so far marked interrupted", got)
+	}
+	if _, err := agent.Query(ctx, "openai", "alice", "hi", nil); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("got error %v, want ErrShuttingDown", err)
+	}
+}
+
+func TestLLMAgent_ShutdownTimeout(t *testing.T) {
+	model := &stuckModel{release: make(chan struct{})}
+	agent := newTestAgent(t, map[string]llms.Model{"openai": model})
+
+	output, err := agent.Query(context.Background(), "openai", "alice", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Shutdown(10 * time.Millisecond) {
+		t.Fatal("got the shutdown done, want it to give up on the stuck generation")
+	}
+
+	close(model.release)
+	var got string
+	for chunk := range output {
+		got += chunk.Text
+	}
+	if got != "\n\n(interrupted)" {
+		t.Fatalf("got answer %q, want the interrupted note", got)
+	}
+}
@@ -0,0 +1,48 @@
+package aicore
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type sourcesKey struct{}
+
+// sources collects the URLs the tools of a query accessed, so they can be shown
+// to the user along with the answer.
+type sources struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+// withSources returns a ctx the tools record their sources in.
+func withSources(ctx context.Context) (context.Context, *sources) {
+	s := &sources{}
+	return context.WithValue(ctx, sourcesKey{}, s), s
+}
+
+// addSource records url as a source of the answer, if ctx collects sources.
+func addSource(ctx context.Context, url string) {
+	s, _ := ctx.Value(sourcesKey{}).(*sources)
+	if s == nil || url == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.urls, url) {
+		s.urls = append(s.urls, url)
+	}
+}
+
+// footer returns the sources appended to an answer, or "" if there are none.
+func (s *sources) footer() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.urls) == 0 {
+		return ""
+	}
+	return "\n\nSources:\n- " + strings.Join(s.urls, "\n- ")
+}
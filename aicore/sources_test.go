@@ -0,0 +1,22 @@
+package aicore
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSources(t *testing.T) {
+	addSource(context.Background(), "https://example.com") // not collecting, ignored
+
+	ctx, s := withSources(context.Background())
+	if v := s.footer(); v != "" {
+		t.Fatalf("got %q, want no footer without sources", v)
+	}
+
+	addSource(ctx, "https://en.wikipedia.org/wiki/Go")
+	addSource(ctx, "https://example.com")
+	addSource(ctx, "https://en.wikipedia.org/wiki/Go")
+	if v := s.footer(); v != "\n\nSources:\n- https://en.wikipedia.org/wiki/Go\n- https://example.com" {
+		t.Fatalf("got %q", v)
+	}
+}
@@ -3,99 +3,327 @@ package aicore
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/douglarek/llmverse/config"
-	"github.com/koffeinsource/go-imgur"
+	"github.com/douglarek/llmverse/metrics"
 	"github.com/sashabaranov/go-openai"
 	"github.com/tmc/langchaingo/llms"
 )
 
-func availableTools(modelSetting config.LLMSetting) []llms.Tool {
-	switch modelSetting.Name {
-	case config.OpenAI:
-		imageTool := llms.Tool{
-			Type: "function",
-			Function: &llms.FunctionDefinition{
-				Name:        "generateImage",
-				Description: "Generate a detailed prompt to generate an image based on the following description: {image_desc}",
-				Parameters: map[string]any{
-					"type": "object",
-					"properties": map[string]any{
-						"image_desc": map[string]any{
-							"type":        "string",
-							"description": "A description of the image to generate",
-						},
-					},
-					"required": []string{"image_desc"},
-				},
-			},
+func init() {
+	RegisterTool(newTool(exchangeRateTool, nil, func(ctx context.Context, args struct {
+		CurrencyDate string `json:"currency_date"`
+		CurrencyFrom string `json:"currency_from"`
+		CurrencyTo   string `json:"currency_to"`
+	}) (string, error) {
+		toolStatus(ctx, "Fetching the %s exchange rates", args.CurrencyDate)
+		rs, err := getExchangeRate(ctx, args.CurrencyDate, args.CurrencyFrom, args.CurrencyTo, toolSetting(ctx))
+		return string(rs), err
+	}))
+	RegisterTool(newTool(wikipediaTool, nil, func(ctx context.Context, args struct {
+		Topic string `json:"topic"`
+	}) (string, error) {
+		toolStatus(ctx, "Looking up %s on Wikipedia", args.Topic)
+		return getWikipedia(ctx, args.Topic)
+	}))
+	RegisterTool(newTool(timeTool, nil, func(ctx context.Context, args struct {
+		Timezone string `json:"timezone"`
+	}) (string, error) {
+		toolStatus(ctx, "Checking the time in %s", args.Timezone)
+		return getTime(args.Timezone), nil
+	}))
+	RegisterTool(newTool(imageTool, checkImage, func(ctx context.Context, args struct {
+		ImageDesc string `json:"image_desc"`
+	}) (string, error) {
+		toolStatus(ctx, "Generating the image")
+		rs, image, err := generateImage(ctx, args.ImageDesc, toolSetting(ctx))
+		if err != nil {
+			return "", err
 		}
-		defaultTools = append(defaultTools, imageTool)
-	default:
+		if image != nil { // the image itself goes with the answer, so the model needn't give the link
+			toolAttach(ctx, &Attachment{Name: "image.png", Data: image})
+			return fmt.Sprintf("the generated image is attached to your answer, don't repeat its url: %s", rs), nil
+		}
+		return fmt.Sprintf("the generated image url is: %s", rs), nil
+	}))
+	RegisterTool(newTool(weatherTool, checkWeather, func(ctx context.Context, args struct {
+		Location string `json:"location"`
+	}) (string, error) {
+		toolStatus(ctx, "Fetching the weather for %s", args.Location)
+		rs, err := getWeather(ctx, args.Location, toolSetting(ctx))
+		return string(rs), err
+	}))
+	RegisterTool(newTool(stockTool, requireKey("stock_api_key", func(ms config.LLMSetting) *string { return ms.StockAPIKey }), func(ctx context.Context, args struct {
+		Symbol string `json:"symbol"`
+	}) (string, error) {
+		toolStatus(ctx, "Fetching the stock price of %s", args.Symbol)
+		rs, err := getStockPrice(ctx, args.Symbol, toolSetting(ctx))
+		return string(rs), err
+	}))
+	RegisterTool(newTool(newsTool, requireKey("news_api_key", func(ms config.LLMSetting) *string { return ms.NewsAPIKey }), func(ctx context.Context, args struct {
+		Topic    string `json:"topic"`
+		Category string `json:"category"`
+	}) (string, error) {
+		if args.Topic != "" {
+			toolStatus(ctx, "Fetching the news about %s", args.Topic)
+		} else {
+			toolStatus(ctx, "Fetching the headlines")
+		}
+		return getNews(ctx, args.Topic, args.Category, toolSetting(ctx))
+	}))
+	RegisterTool(newTool(cryptoTool, nil, func(ctx context.Context, args struct {
+		Symbol string `json:"symbol"`
+		Fiat   string `json:"fiat"`
+	}) (string, error) {
+		toolStatus(ctx, "Fetching the price of %s", strings.ToUpper(args.Symbol))
+		return getCryptoPrice(ctx, args.Symbol, args.Fiat)
+	}))
+	RegisterTool(newTool(defineTool, nil, func(ctx context.Context, args struct {
+		Word string `json:"word"`
+	}) (string, error) {
+		toolStatus(ctx, "Looking up %s in the dictionary", args.Word)
+		return define(ctx, args.Word)
+	}))
+}
+
+// checkImage returns why the images can't be generated for the model setting,
+// only openai has an image model.
+func checkImage(_ context.Context, ms config.LLMSetting) error {
+	if ms.Name != config.OpenAI {
+		return errors.New("only openai generates images")
+	}
+	if ms.APIKey == "" {
+		return errors.New("api_key is not set")
+	}
+	return nil
+}
+
+// checkWeather returns why the weather can't be fetched with the model setting.
+func checkWeather(ctx context.Context, ms config.LLMSetting) error {
+	if ms.OpenWeatherKey == nil || *ms.OpenWeatherKey == "" {
+		return errors.New("openweather_key is not set")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.openweathermap.org/data/2.5/weather?q=London&appid="+*ms.OpenWeatherKey, nil)
+	if err != nil {
+		return err
 	}
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil { // the service may be temporarily unreachable, keep the tool
+		slog.Warn("[checkWeather] cannot reach openweather", "error", err)
+		return nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("openweather_key is invalid")
+	}
+	return nil
+}
 
-	if modelSetting.OpenWeatherKey != nil && *modelSetting.OpenWeatherKey != "" {
-		weatherTool := llms.Tool{
-			Type: "function",
-			Function: &llms.FunctionDefinition{
-				Name:        "getWeather",
-				Description: "Get the weather for a specific location based on the following location: {location}",
-				Parameters: map[string]any{
-					"type": "object",
-					"properties": map[string]any{
-						"location": map[string]any{
-							"type":        "string",
-							"description": "The location to get the weather for, formatted as 'City,Country', e.g. 'New York,US', and the city and country code must be in ISO 3166-1 alpha-2 format",
-						},
-					},
-					"required": []string{"location"},
+var imageTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "generateImage",
+		Description: "Generate a detailed prompt to generate an image based on the following description: {image_desc}",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"image_desc": map[string]any{
+					"type":        "string",
+					"description": "A description of the image to generate",
 				},
 			},
-		}
-		defaultTools = append(defaultTools, weatherTool)
-	}
+			"required": []string{"image_desc"},
+		},
+	},
+}
 
-	return defaultTools
+var weatherTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "getWeather",
+		Description: "Get the weather for a specific location based on the following location: {location}",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"location": map[string]any{
+					"type":        "string",
+					"description": "The location to get the weather for, formatted as 'City,Country', e.g. 'New York,US', and the city and country code must be in ISO 3166-1 alpha-2 format",
+				},
+			},
+			"required": []string{"location"},
+		},
+	},
 }
 
-// defaultTools is a list of tools that the agent can use to help answer questions.
-var defaultTools = []llms.Tool{
-	{
-		Type: "function",
-		Function: &llms.FunctionDefinition{
-			Name:        "getExchangeRate",
-			Description: "Get the exchange rate for currencies between countries",
-			Parameters: map[string]any{
-				"type": "object",
-				"properties": map[string]any{
-					"currency_date": map[string]any{
-						"type":        "string",
-						"description": "A date that must always be in YYYY-MM-DD format or the value 'latest' if a time period is not specified",
-					},
-					"currency_from": map[string]any{
-						"type":        "string",
-						"description": "The currency to convert from in ISO 4217 format",
-					},
-					"currency_to": map[string]any{
-						"type":        "string",
-						"description": "The currency to convert to in ISO 4217 format",
-					},
+var stockTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "getStockPrice",
+		Description: "Get the latest stock price of a company based on the following ticker symbol: {symbol}",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"symbol": map[string]any{
+					"type":        "string",
+					"description": "The ticker symbol of the stock, e.g. 'AAPL'",
 				},
-				"required": []string{"currency_from", "currency_date"},
 			},
+			"required": []string{"symbol"},
+		},
+	},
+}
+
+var newsTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "getNews",
+		Description: "Get the latest news headlines about a topic or in a category",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"topic": map[string]any{
+					"type":        "string",
+					"description": "Keywords of the news to look for, e.g. 'electric cars'",
+				},
+				"category": map[string]any{
+					"type":        "string",
+					"description": "The category of the headlines",
+					"enum":        newsCategories,
+				},
+			},
+		},
+	},
+}
+
+var cryptoTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "getCryptoPrice",
+		Description: "Get the current price of a cryptocurrency",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"symbol": map[string]any{
+					"type":        "string",
+					"description": "The symbol of the cryptocurrency, e.g. 'BTC'",
+				},
+				"fiat": map[string]any{
+					"type":        "string",
+					"description": "The currency of the price in ISO 4217 format, USD if not specified",
+				},
+			},
+			"required": []string{"symbol"},
+		},
+	},
+}
+
+var defineTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "define",
+		Description: "Look up the definitions of an English word in a dictionary",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"word": map[string]any{
+					"type":        "string",
+					"description": "The word to define, e.g. 'serendipity'",
+				},
+			},
+			"required": []string{"word"},
+		},
+	},
+}
+
+// newsCategories are the categories of the headlines of NewsAPI.
+var newsCategories = []string{"business", "entertainment", "general", "health", "science", "sports", "technology"}
+
+var exchangeRateTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "getExchangeRate",
+		Description: "Get the exchange rate for currencies between countries",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"currency_date": map[string]any{
+					"type":        "string",
+					"description": "A date that must always be in YYYY-MM-DD format or the value 'latest' if a time period is not specified",
+				},
+				"currency_from": map[string]any{
+					"type":        "string",
+					"description": "The currency to convert from in ISO 4217 format",
+				},
+				"currency_to": map[string]any{
+					"type":        "string",
+					"description": "The currency to convert to in ISO 4217 format",
+				},
+			},
+			"required": []string{"currency_from", "currency_date"},
+		},
+	},
+}
+
+var wikipediaTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "wikipedia",
+		Description: "Look up the summary of a topic on Wikipedia based on the following topic: {topic}",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"topic": map[string]any{
+					"type":        "string",
+					"description": "The title of the Wikipedia article to look up, e.g. 'Alan Turing'",
+				},
+			},
+			"required": []string{"topic"},
+		},
+	},
+}
+
+var timeTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "getTime",
+		Description: "Get the current date and time in a timezone",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"timezone": map[string]any{
+					"type":        "string",
+					"description": "The IANA timezone name, e.g. 'Asia/Tokyo' or 'UTC'",
+				},
+			},
+			"required": []string{"timezone"},
 		},
 	},
 }
 
 // getExchangeRate is a helper function that makes a request to the Frankfurter API
-// to get the exchange rate for currencies between countries.
-func getExchangeRate(ctx context.Context, currencyDate string) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.frankfurter.app/"+currencyDate, nil)
+// to get the exchange rate from a currency to another, or to all currencies if to
+// is empty, on the date or the latest if the date is empty.
+func getExchangeRate(ctx context.Context, date, from, to string, ms config.LLMSetting) ([]byte, error) {
+	if date = strings.TrimSpace(date); date == "" {
+		date = "latest"
+	}
+	q := url.Values{"from": {strings.ToUpper(strings.TrimSpace(from))}}
+	if to = strings.ToUpper(strings.TrimSpace(to)); to != "" {
+		q.Set("to", to)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ms.ExchangeRateURL+url.PathEscape(date)+"?"+q.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -107,9 +335,292 @@ func getExchangeRate(ctx context.Context, currencyDate string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK { // an unknown currency or date, not rates to give the model
+		return nil, errors.New(req.URL.Host + ": " + resp.Status)
+	}
 	return io.ReadAll(resp.Body)
 }
 
+// base urls of the stock market data providers.
+var (
+	finnhubBaseURL      = "https://finnhub.io/api/v1/"
+	alphaVantageBaseURL = "https://www.alphavantage.co/"
+)
+
+type stockQuote struct {
+	Symbol        string  `json:"symbol"`
+	Price         float64 `json:"price"`
+	Currency      string  `json:"currency,omitempty"`
+	ChangePercent float64 `json:"change_percent"`
+}
+
+// coinGeckoBaseURL is the base url of the free CoinGecko API.
+var coinGeckoBaseURL = "https://api.coingecko.com/api/v3/"
+
+// getCryptoPrice returns the current price of the cryptocurrency symbol in fiat,
+// USD if empty. Unknown symbols and currencies are reported as text.
+func getCryptoPrice(ctx context.Context, symbol, fiat string) (string, error) {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	if fiat = strings.ToLower(strings.TrimSpace(fiat)); fiat == "" {
+		fiat = "usd"
+	}
+
+	var r map[string]map[string]float64
+	if err := getJSON(ctx, coinGeckoBaseURL+"simple/price?symbols="+url.QueryEscape(symbol)+"&vs_currencies="+url.QueryEscape(fiat), &r); err != nil {
+		return "", err
+	}
+	prices, ok := r[symbol]
+	if !ok {
+		return fmt.Sprintf("unknown cryptocurrency %q, use its symbol like 'BTC'", strings.ToUpper(symbol)), nil
+	}
+	price, ok := prices[fiat]
+	if !ok {
+		return fmt.Sprintf("no price of %s in %s", strings.ToUpper(symbol), strings.ToUpper(fiat)), nil
+	}
+	return fmt.Sprintf("1 %s = %s %s", strings.ToUpper(symbol), strconv.FormatFloat(price, 'f', -1, 64), strings.ToUpper(fiat)), nil
+}
+
+// getStockPrice is a helper function that gets the latest quote of the symbol
+// from the configured stock provider, and returns it as JSON.
+func getStockPrice(ctx context.Context, symbol string, ms config.LLMSetting) ([]byte, error) {
+	symbol = strings.ToUpper(strings.TrimSpace(symbol))
+	q := stockQuote{Symbol: symbol}
+
+	switch ms.StockProvider {
+	case config.StockProviderAlphaVantage:
+		var r struct {
+			GlobalQuote struct {
+				Price         string `json:"05. price"`
+				ChangePercent string `json:"10. change percent"`
+			} `json:"Global Quote"`
+		}
+		if err := getJSON(ctx, alphaVantageBaseURL+"query?function=GLOBAL_QUOTE&symbol="+url.QueryEscape(symbol)+"&apikey="+*ms.StockAPIKey, &r); err != nil {
+			return nil, err
+		}
+		if r.GlobalQuote.Price == "" {
+			return []byte(fmt.Sprintf("no quote found for symbol %q", symbol)), nil
+		}
+		q.Price, _ = strconv.ParseFloat(r.GlobalQuote.Price, 64)
+		q.ChangePercent, _ = strconv.ParseFloat(strings.TrimSuffix(r.GlobalQuote.ChangePercent, "%"), 64)
+	default:
+		var r struct {
+			Current       float64 `json:"c"`
+			ChangePercent float64 `json:"dp"`
+		}
+		if err := getJSON(ctx, finnhubBaseURL+"quote?symbol="+url.QueryEscape(symbol)+"&token="+*ms.StockAPIKey, &r); err != nil {
+			return nil, err
+		}
+		if r.Current == 0 { // finnhub answers unknown symbols with an empty quote
+			return []byte(fmt.Sprintf("no quote found for symbol %q", symbol)), nil
+		}
+		var profile struct {
+			Currency string `json:"currency"`
+		}
+		if err := getJSON(ctx, finnhubBaseURL+"stock/profile2?symbol="+url.QueryEscape(symbol)+"&token="+*ms.StockAPIKey, &profile); err != nil {
+			slog.Warn("[getStockPrice] failed to get the currency", "symbol", symbol, "error", err)
+		}
+		q.Price, q.ChangePercent, q.Currency = r.Current, r.ChangePercent, profile.Currency
+	}
+
+	return json.Marshal(q)
+}
+
+// getNews gets the latest headlines about the topic, or in the category if there
+// is no topic, from the configured NewsAPI compatible service, and returns them
+// as a list of titles and sources.
+func getNews(ctx context.Context, topic, category string, ms config.LLMSetting) (string, error) {
+	q := url.Values{"apiKey": {*ms.NewsAPIKey}, "pageSize": {"5"}}
+	endpoint := "top-headlines"
+	if topic = strings.TrimSpace(topic); topic != "" {
+		endpoint = "everything"
+		q.Set("q", topic)
+		q.Set("sortBy", "publishedAt")
+	} else {
+		if !slices.Contains(newsCategories, category) {
+			category = "general"
+		}
+		q.Set("category", category)
+	}
+
+	var r struct {
+		Articles []struct {
+			Title  string `json:"title"`
+			URL    string `json:"url"`
+			Source struct {
+				Name string `json:"name"`
+			} `json:"source"`
+		} `json:"articles"`
+	}
+	if err := getJSON(ctx, ms.NewsAPIURL+endpoint+"?"+q.Encode(), &r); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, a := range r.Articles {
+		if a.Title == "" || a.Title == "[Removed]" {
+			continue
+		}
+		fmt.Fprintf(&b, "- %s (%s)\n", a.Title, a.Source.Name)
+		if a.URL != "" {
+			addSource(ctx, a.URL)
+		}
+	}
+	if b.Len() == 0 {
+		if topic != "" {
+			return fmt.Sprintf("no news found about %q", topic), nil
+		}
+		return fmt.Sprintf("no %s headlines found", category), nil
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// getJSON gets rawURL and decodes its JSON response into v.
+func getJSON(ctx context.Context, rawURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := (&http.Client{Timeout: 1 * time.Minute}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(req.URL.Host + ": " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// now returns the current time, tests replace it with a fixed clock.
+var now = time.Now
+
+// getTime returns the current time in the IANA timezone, unknown timezones are
+// reported as text, so the model can correct itself or tell the user.
+func getTime(timezone string) string {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "" || strings.EqualFold(timezone, "local") {
+		return fmt.Sprintf("unknown timezone %q, use an IANA timezone name like 'Asia/Tokyo'", timezone)
+	}
+	return now().In(loc).Format("Monday, 2006-01-02 15:04:05 MST (UTC-07:00)")
+}
+
+// wikipediaBaseURL is the base url of the Wikipedia REST API.
+var wikipediaBaseURL = "https://en.wikipedia.org/api/rest_v1/"
+
+// getWikipedia is a helper function that gets the summary of the topic from Wikipedia.
+// Missing and ambiguous topics are reported as text, so the model can tell the user.
+func getWikipedia(ctx context.Context, topic string) (string, error) {
+	title := url.PathEscape(strings.ReplaceAll(strings.TrimSpace(topic), " ", "_"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wikipediaBaseURL+"page/summary/"+title, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "llmverse (https://github.com/douglarek/llmverse)")
+
+	resp, err := (&http.Client{Timeout: 1 * time.Minute}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Sprintf("no Wikipedia article found for %q, try a different or more exact title", topic), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("wikipedia: " + resp.Status)
+	}
+
+	var summary struct {
+		Type        string `json:"type"`
+		Title       string `json:"title"`
+		Extract     string `json:"extract"`
+		ContentURLs struct {
+			Desktop struct {
+				Page string `json:"page"`
+			} `json:"desktop"`
+		} `json:"content_urls"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return "", err
+	}
+	addSource(ctx, summary.ContentURLs.Desktop.Page)
+
+	if summary.Type == "disambiguation" {
+		return fmt.Sprintf("%q is ambiguous on Wikipedia, ask the user which one is meant: %s", summary.Title, summary.Extract), nil
+	}
+	return summary.Extract, nil
+}
+
+// dictionaryBaseURL is the base url of the Free Dictionary API.
+var dictionaryBaseURL = "https://api.dictionaryapi.dev/api/v2/"
+
+// maxDefinitions is the number of definitions given per part of speech at most.
+const maxDefinitions = 3
+
+// define returns the definitions of the English word by part of speech, with an
+// example if there is one. Unknown words are reported as text.
+func define(ctx context.Context, word string) (string, error) {
+	word = strings.ToLower(strings.TrimSpace(word))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dictionaryBaseURL+"entries/en/"+url.PathEscape(word), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := (&http.Client{Timeout: 1 * time.Minute}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Sprintf("no definition found for %q, check its spelling or use its base form", word), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("dictionary: " + resp.Status)
+	}
+
+	var entries []struct {
+		Word     string `json:"word"`
+		Phonetic string `json:"phonetic"`
+		Meanings []struct {
+			PartOfSpeech string `json:"partOfSpeech"`
+			Definitions  []struct {
+				Definition string `json:"definition"`
+				Example    string `json:"example"`
+			} `json:"definitions"`
+		} `json:"meanings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return fmt.Sprintf("no definition found for %q, check its spelling or use its base form", word), nil
+	}
+
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(e.Word)
+		if e.Phonetic != "" {
+			b.WriteString(" " + e.Phonetic)
+		}
+		b.WriteString("\n")
+		for _, m := range e.Meanings {
+			for i, d := range m.Definitions {
+				if i == maxDefinitions {
+					break
+				}
+				fmt.Fprintf(&b, "- (%s) %s\n", m.PartOfSpeech, d.Definition)
+				if d.Example != "" {
+					fmt.Fprintf(&b, "  e.g. %s\n", d.Example)
+				}
+			}
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
 const dalle3SystemPrompt = `
 Certainly, here are all the instructions from the guidelines:
 
@@ -128,47 +639,59 @@ Now, please generate the image based on the below description:
 
 `
 
-// generateImage is a helper function that generates an image based on the imageDesc
-func generateImage(ctx context.Context, imageDesc string, ms config.LLMSetting) (string, error) {
+// imagePrompt returns the prompt of the image model for the description, after the
+// prefix, or after the built-in guidelines if prefix is nil.
+func imagePrompt(prefix *string, imageDesc string) string {
+	switch {
+	case prefix == nil:
+		return dalle3SystemPrompt + imageDesc
+	case *prefix == "":
+		return imageDesc
+	default:
+		return strings.TrimRightFunc(*prefix, unicode.IsSpace) + "\n\n" + imageDesc
+	}
+}
+
+// maxGeneratedImageSize caps the download of a generated image to attach it.
+const maxGeneratedImageSize = 20 * 1024 * 1024
+
+// generateImage is a helper function that generates an image based on the imageDesc,
+// it returns the link to the image and the image itself, nil if it can't be downloaded.
+func generateImage(ctx context.Context, imageDesc string, ms config.LLMSetting) (string, []byte, error) {
 	conf := openai.DefaultConfig(ms.APIKey)
 	conf.BaseURL = ms.BaseURL
 
 	c := openai.NewClientWithConfig(conf)
 	resp, err := c.CreateImage(ctx, openai.ImageRequest{
-		Prompt: dalle3SystemPrompt + imageDesc,
-		Model:  openai.CreateImageModelDallE3,
-		Size:   openai.CreateImageSize1024x1024,
+		Prompt: imagePrompt(ms.ImagePromptPrefix, imageDesc),
+		Model:  ms.ImageModel,
+		Size:   ms.ImageSize,
 	})
 
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-
-	if ms.ImgurClientID == nil || *ms.ImgurClientID == "" {
-		return resp.Data[0].URL, nil
+	if resp.Data[0].URL == "" {
+		return "", nil, errors.New("image model " + ms.ImageModel + " returned no image url")
 	}
 
-	ic, err := imgur.NewClient(&http.Client{Timeout: 1 * time.Minute}, *ms.ImgurClientID, "")
+	image, err := downloadImage(ctx, resp.Data[0].URL, maxGeneratedImageSize)
 	if err != nil {
-		return "", err
+		slog.Error("[generateImage] failed to download image, only the url is given", "error", err)
 	}
 
-	rl, err := ic.GetRateLimit()
-	if err != nil {
-		return "", err
-	}
-	if rl.ClientRemaining == 0 {
-		slog.Warn("[generateImage] imgur rate limit exceeded", "reset_time", rl.UserReset)
-		return resp.Data[0].URL, nil
+	r := newImageRehoster(ms)
+	if r == nil {
+		return resp.Data[0].URL, image, nil
 	}
 
-	slog.Debug("[generateImage] uploading image to imgur", "url", resp.Data[0].URL)
-	ii, _, err := ic.UploadImage([]byte(resp.Data[0].URL), "", "URL", "", imageDesc)
+	link, err := r.rehost(ctx, resp.Data[0].URL, image, imageDesc) // downloaded again only if the first download failed
 	if err != nil {
-		return "", err
+		slog.Error("[generateImage] failed to rehost image, falling back to the original url", "host", ms.ImageHost, "error", err)
+		return resp.Data[0].URL, image, nil
 	}
 
-	return ii.Link, nil
+	return link, image, nil
 }
 
 // getWeather is a helper function that makes a request to the OpenWeather API
@@ -184,12 +707,14 @@ func getWeather(_ context.Context, location string, ms config.LLMSetting) ([]byt
 // executeToolCalls is a helper function that parses the response from a tool call
 // and returns the content to be sent to the user, whether the response should be
 // returned directly to the user, and any error that occurred.
-func executeToolCalls(ctx context.Context, model llms.Model, ms config.LLMSetting, options []llms.CallOption, content []llms.MessageContent, output chan<- string) ([]llms.MessageContent, bool, error) { // content, return_direct, error
+func executeToolCalls(ctx context.Context, model llms.Model, ms config.LLMSetting, options []llms.CallOption, content []llms.MessageContent, output chan<- Chunk) ([]llms.MessageContent, bool, error) { // content, return_direct, error
 	var isStreaming bool
 	var chunks []byte
 	options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
 		isStreaming = true
-		output <- parseToolCallStreamingChunk(chunk, false)
+		if !send(ctx, output, Chunk{Text: parseToolCallStreamingChunk(chunk, false)}) {
+			return ctx.Err()
+		}
 		chunks = append(chunks, chunk...)
 		return nil
 	}))
@@ -199,101 +724,92 @@ func executeToolCalls(ctx context.Context, model llms.Model, ms config.LLMSettin
 	}
 
 	respChoice := resp.Choices[0]
+	slog.Debug("[executeToolCalls] response", "model", ms.Name, "messages", len(content), "tool_calls", len(respChoice.ToolCalls), "streaming", isStreaming)
 	ar := llms.TextParts(llms.ChatMessageTypeAI, respChoice.Content)
 	if len(respChoice.ToolCalls) == 0 {
+		for _, image := range choiceImages(respChoice) {
+			send(ctx, output, Chunk{Attachment: image})
+		}
 		content = append(content, ar)
 		return content, true, nil
 	}
 
 	if isStreaming && len(chunks) > 0 {
-		go func() { output <- parseToolCallStreamingChunk(nil, true) }()
+		send(ctx, output, Chunk{Text: parseToolCallStreamingChunk(nil, true)})
 	}
 
+	ctx = withToolEnv(ctx, ms, output)
 	var toolMessages []llms.MessageContent
 	for _, tc := range respChoice.ToolCalls {
-		var tr llms.MessageContent
-		switch tc.FunctionCall.Name {
-		case "getExchangeRate":
-			slog.Debug(fmt.Sprintf("[executeToolCalls] getExchangeRate: %+v", tc.FunctionCall.Arguments))
-			var args struct {
-				CurrencyDate string `json:"currency_date"`
-			}
-			if err := json.Unmarshal([]byte(tc.FunctionCall.Arguments), &args); err != nil {
-				return nil, false, err
-			}
-			rs, err := getExchangeRate(ctx, args.CurrencyDate)
-			if err != nil {
-				return nil, false, err
-			}
-			tr = llms.MessageContent{
-				Role: llms.ChatMessageTypeTool,
-				Parts: []llms.ContentPart{
-					llms.ToolCallResponse{
-						ToolCallID: tc.ID,
-						Name:       tc.FunctionCall.Name,
-						Content:    string(rs),
-					},
-				},
-			}
-		case "generateImage":
-			slog.Debug(fmt.Sprintf("[executeToolCalls] generateImage: %+v", tc.FunctionCall.Arguments))
-			var args struct {
-				ImageDesc string `json:"image_desc"`
-			}
-			if err := json.Unmarshal([]byte(tc.FunctionCall.Arguments), &args); err != nil {
-				return nil, false, err
-			}
-			rs, err := generateImage(ctx, args.ImageDesc, ms)
-			if err != nil {
-				return nil, false, err
-			}
-			tr = llms.MessageContent{
-				Role: llms.ChatMessageTypeTool,
-				Parts: []llms.ContentPart{
-					llms.ToolCallResponse{
-						ToolCallID: tc.ID,
-						Name:       tc.FunctionCall.Name,
-						Content:    fmt.Sprintf("the generated image url is: %s", rs),
-					},
-				},
-			}
-		case "getWeather":
-			slog.Debug(fmt.Sprintf("[executeToolCalls] getWeather: %+v", tc.FunctionCall.Arguments))
-			var args struct {
-				Location string `json:"location"`
-			}
-			if err := json.Unmarshal([]byte(tc.FunctionCall.Arguments), &args); err != nil {
-				return nil, false, err
-			}
-			rs, err := getWeather(ctx, args.Location, ms)
-			if err != nil {
-				return nil, false, err
-			}
-			tr = llms.MessageContent{
-				Role: llms.ChatMessageTypeTool,
-				Parts: []llms.ContentPart{
-					llms.ToolCallResponse{
-						ToolCallID: tc.ID,
-						Name:       tc.FunctionCall.Name,
-						Content:    string(rs),
-					},
-				},
-			}
-		default:
+		t, ok := lookupTool(tc.FunctionCall.Name)
+		if !ok {
 			slog.Warn("[LLMAgent.Query] hint unknown tool call", "name", tc.FunctionCall.Name)
 			continue
 		}
+		slog.Debug(fmt.Sprintf("[executeToolCalls] %s: %+v", tc.FunctionCall.Name, tc.FunctionCall.Arguments))
+		start := time.Now()
+		rs, err := t.Execute(ctx, tc.FunctionCall.Arguments)
+		if err != nil {
+			return nil, false, err
+		}
+		tr := llms.MessageContent{
+			Role: llms.ChatMessageTypeTool,
+			Parts: []llms.ContentPart{
+				llms.ToolCallResponse{
+					ToolCallID: tc.ID,
+					Name:       tc.FunctionCall.Name,
+					Content:    rs,
+				},
+			},
+		}
 
+		metrics.ObserveTool(tc.FunctionCall.Name, time.Since(start))
 		ar.Parts = append(ar.Parts, tc)
 		toolMessages = append(toolMessages, tr)
 	}
 
-	content = append(content, ar)
-	content = append(content, toolMessages...)
+	if slices.Contains(config.ToolResultsAsText, ms.Name) {
+		content = append(content, toolResultsAsText(ar, toolMessages)...)
+	} else {
+		content = append(content, ar)
+		content = append(content, toolMessages...)
+	}
+	slog.Debug("[executeToolCalls] tools ran", "model", ms.Name, "tool_results", len(toolMessages), "messages", len(content))
 
 	return content, false, nil
 }
 
+// toolResultsAsText turns the tool calls of the AI message ar and their results
+// into an AI and a human text message. The mistral client sends tool results
+// without the ids of their calls, which the api refuses, and each call of ar as
+// a message of its own.
+func toolResultsAsText(ar llms.MessageContent, results []llms.MessageContent) []llms.MessageContent {
+	var calls, answers strings.Builder
+	for _, p := range ar.Parts {
+		switch p := p.(type) {
+		case llms.TextContent:
+			if p.Text != "" {
+				calls.WriteString(p.Text + "\n")
+			}
+		case llms.ToolCall:
+			fmt.Fprintf(&calls, "Calling the tool %s with %s\n", p.FunctionCall.Name, p.FunctionCall.Arguments)
+		}
+	}
+	for _, m := range results {
+		for _, p := range m.Parts {
+			if r, ok := p.(llms.ToolCallResponse); ok {
+				fmt.Fprintf(&answers, "Result of the tool %s:\n%s\n\n", r.Name, r.Content)
+			}
+		}
+	}
+	answers.WriteString("Answer my question with these results.")
+
+	return []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeAI, strings.TrimSpace(calls.String())),
+		llms.TextParts(llms.ChatMessageTypeHuman, answers.String()),
+	}
+}
+
 type toolCallStreamingChunk struct {
 	ID       string `json:"id"`
 	Type     string `json:"type"`
@@ -303,6 +819,12 @@ type toolCallStreamingChunk struct {
 	} `json:"function"`
 }
 
+// sendToolStatus tells the user what a running tool is doing, in the style of
+// the tool call banner.
+func sendToolStatus(ctx context.Context, output chan<- Chunk, format string, args ...any) {
+	send(ctx, output, Chunk{Text: "||*** " + fmt.Sprintf(format, args...) + "... ***||\n\n"})
+}
+
 func parseToolCallStreamingChunk(chunk []byte, end bool) string {
 	if end {
 		return "`||\n\n"
@@ -0,0 +1,371 @@
+package aicore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/douglarek/llmverse/config"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestGetStockPrice(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "key" && r.URL.Query().Get("apikey") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/quote":
+			if r.URL.Query().Get("symbol") != "AAPL" {
+				w.Write([]byte(`{"c":0,"dp":null}`))
+				return
+			}
+			w.Write([]byte(`{"c":189.5,"dp":1.25}`))
+		case "/stock/profile2":
+			w.Write([]byte(`{"currency":"USD"}`))
+		case "/query":
+			w.Write([]byte(`{"Global Quote":{"01. symbol":"IBM","05. price":"170.2500","10. change percent":"-0.5000%"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	finnhubBaseURL, alphaVantageBaseURL = ts.URL+"/", ts.URL+"/"
+	defer func() {
+		finnhubBaseURL, alphaVantageBaseURL = "https://finnhub.io/api/v1/", "https://www.alphavantage.co/"
+	}()
+
+	key := "key"
+	finnhub := config.LLMSetting{StockAPIKey: &key, StockProvider: config.StockProviderFinnhub}
+
+	rs, err := getStockPrice(context.Background(), " aapl", finnhub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q stockQuote
+	if err := json.Unmarshal(rs, &q); err != nil {
+		t.Fatal(err)
+	}
+	if q != (stockQuote{Symbol: "AAPL", Price: 189.5, Currency: "USD", ChangePercent: 1.25}) {
+		t.Fatalf("got quote %+v", q)
+	}
+
+	rs, err = getStockPrice(context.Background(), "NOPE", finnhub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rs), "no quote found") {
+		t.Fatalf("got %s, want no quote found", rs)
+	}
+
+	alphaVantage := config.LLMSetting{StockAPIKey: &key, StockProvider: config.StockProviderAlphaVantage}
+	rs, err = getStockPrice(context.Background(), "IBM", alphaVantage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = stockQuote{}
+	if err := json.Unmarshal(rs, &q); err != nil {
+		t.Fatal(err)
+	}
+	if q != (stockQuote{Symbol: "IBM", Price: 170.25, ChangePercent: -0.5}) {
+		t.Fatalf("got quote %+v", q)
+	}
+
+	bad := "bad"
+	if _, err := getStockPrice(context.Background(), "AAPL", config.LLMSetting{StockAPIKey: &bad}); err == nil {
+		t.Fatal("expected error for invalid api key")
+	}
+}
+
+func TestAvailableTools(t *testing.T) {
+	names := func(tools []llms.Tool) []string {
+		var v []string
+		for _, t := range tools {
+			v = append(v, t.Function.Name)
+		}
+		return v
+	}
+
+	tests := []struct {
+		enabled []string
+		want    []string
+	}{
+		{nil, []string{"define", "fetchURL", "generateImage", "getCryptoPrice", "getExchangeRate", "getTime", "wikipedia"}},
+		{[]string{"getExchangeRate"}, []string{"getExchangeRate"}},
+		{[]string{"generateImage", "getWeather"}, []string{"generateImage"}}, // getWeather has no key
+	}
+
+	for _, tt := range tests {
+		ms := config.LLMSetting{Name: config.OpenAI, APIKey: "key", EnabledTools: tt.enabled}
+		if got := names(availableTools(context.Background(), ms)); !slices.Equal(got, tt.want) {
+			t.Errorf("availableTools(%v) = %v, want %v", tt.enabled, got, tt.want)
+		}
+	}
+}
+
+func TestGetTime(t *testing.T) {
+	now = func() time.Time { return time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	if v := getTime("Asia/Tokyo"); v != "Wednesday, 2024-05-01 21:30:00 JST (UTC+09:00)" {
+		t.Fatalf("got %q", v)
+	}
+	for _, tz := range []string{"Mars/Olympus", "", "Local"} {
+		if v := getTime(tz); !strings.Contains(v, "unknown timezone") {
+			t.Fatalf("getTime(%q) = %q, want unknown timezone", tz, v)
+		}
+	}
+}
+
+func TestGetNews(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("apiKey") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/everything" && r.URL.Query().Get("q") == "rust":
+			w.Write([]byte(`{"status":"ok","articles":[{"title":"Rust 2.0 released","url":"https://example.com/rust","source":{"name":"Example"}},{"title":"[Removed]","source":{"name":"[Removed]"}}]}`))
+		case r.URL.Path == "/top-headlines" && r.URL.Query().Get("category") == "general":
+			w.Write([]byte(`{"status":"ok","articles":[{"title":"Headline","source":{"name":"Daily"}}]}`))
+		default:
+			w.Write([]byte(`{"status":"ok","articles":[]}`))
+		}
+	}))
+	defer ts.Close()
+
+	key := "key"
+	ms := config.LLMSetting{NewsAPIKey: &key, NewsAPIURL: ts.URL + "/"}
+
+	ctx, srcs := withSources(context.Background())
+	rs, err := getNews(ctx, "rust", "", ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs != "- Rust 2.0 released (Example)" {
+		t.Fatalf("got %q", rs)
+	}
+	if !strings.Contains(srcs.footer(), "https://example.com/rust") {
+		t.Fatal("want the article as a source")
+	}
+
+	if rs, err = getNews(context.Background(), "", "unknown", ms); err != nil || rs != "- Headline (Daily)" {
+		t.Fatalf("got %q, %v, want the general headlines", rs, err)
+	}
+
+	if rs, err = getNews(context.Background(), "nothing", "", ms); err != nil || !strings.Contains(rs, "no news found") {
+		t.Fatalf("got %q, %v, want no news found", rs, err)
+	}
+
+	bad := "bad"
+	if _, err := getNews(context.Background(), "rust", "", config.LLMSetting{NewsAPIKey: &bad, NewsAPIURL: ts.URL + "/"}); err == nil {
+		t.Fatal("expected error for invalid api key")
+	}
+}
+
+func TestGetExchangeRate(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.String()
+		if r.URL.Query().Get("from") == "XXX" {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"base":"USD","rates":{"EUR":0.9}}`))
+	}))
+	defer ts.Close()
+	ms := config.LLMSetting{ExchangeRateURL: ts.URL + "/"}
+
+	for _, tt := range []struct {
+		date, from, to string
+		want           string
+	}{
+		{"latest", "usd", "eur", "/latest?from=USD&to=EUR"},
+		{"2024-01-02", "USD", "", "/2024-01-02?from=USD"},
+		{"", "GBP", "JPY", "/latest?from=GBP&to=JPY"},
+	} {
+		rs, err := getExchangeRate(context.Background(), tt.date, tt.from, tt.to, ms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("requested %s, want %s", got, tt.want)
+		}
+		if !strings.Contains(string(rs), `"EUR":0.9`) {
+			t.Errorf("got %s", rs)
+		}
+	}
+
+	if rs, err := getExchangeRate(context.Background(), "latest", "XXX", "EUR", ms); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("got %s, %v, want the error page refused", rs, err)
+	}
+}
+
+func TestGetCryptoPrice(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/simple/price" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("symbols") == "btc" && r.URL.Query().Get("vs_currencies") == "usd" {
+			w.Write([]byte(`{"btc":{"usd":64123.45}}`))
+			return
+		}
+		if r.URL.Query().Get("symbols") == "btc" {
+			w.Write([]byte(`{"btc":{}}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	coinGeckoBaseURL = ts.URL + "/"
+	defer func() { coinGeckoBaseURL = "https://api.coingecko.com/api/v3/" }()
+
+	for _, tt := range []struct {
+		symbol, fiat, want string
+	}{
+		{"BTC", "", "1 BTC = 64123.45 USD"},
+		{"btc", "xyz", "no price of BTC in XYZ"},
+		{"NOPE", "usd", `unknown cryptocurrency "NOPE", use its symbol like 'BTC'`},
+	} {
+		got, err := getCryptoPrice(context.Background(), tt.symbol, tt.fiat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("getCryptoPrice(%q, %q) = %q, want %q", tt.symbol, tt.fiat, got, tt.want)
+		}
+	}
+}
+
+func TestImagePrompt(t *testing.T) {
+	if got := imagePrompt(nil, "a cat"); got != dalle3SystemPrompt+"a cat" {
+		t.Fatalf("got %q, want the built-in guidelines", got)
+	}
+	empty, custom := "", "Draw in pixel art.\n"
+	if got := imagePrompt(&empty, "a cat"); got != "a cat" {
+		t.Fatalf("got %q, want the description alone", got)
+	}
+	if got := imagePrompt(&custom, "a cat"); got != "Draw in pixel art.\n\na cat" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestDefine(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/entries/en/serendipity" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"title":"No Definitions Found"}`))
+			return
+		}
+		w.Write([]byte(`[{"word":"serendipity","phonetic":"/ˌsɛɹ.ən.ˈdɪp.ɪ.ti/","meanings":[{"partOfSpeech":"noun","definitions":[
+			{"definition":"An unsought, unintended, and/or unexpected discovery made by happy accident.","example":"Meeting her there was pure serendipity."},
+			{"definition":"The faculty of making such discoveries."},
+			{"definition":"A third one."},
+			{"definition":"A fourth one, left out."}]}]}]`))
+	}))
+	defer ts.Close()
+	dictionaryBaseURL = ts.URL + "/"
+	defer func() { dictionaryBaseURL = "https://api.dictionaryapi.dev/api/v2/" }()
+
+	got, err := define(context.Background(), " Serendipity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "serendipity /ˌsɛɹ.ən.ˈdɪp.ɪ.ti/\n" +
+		"- (noun) An unsought, unintended, and/or unexpected discovery made by happy accident.\n" +
+		"  e.g. Meeting her there was pure serendipity.\n" +
+		"- (noun) The faculty of making such discoveries.\n" +
+		"- (noun) A third one."
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if got, err = define(context.Background(), "xyzzyq"); err != nil || !strings.Contains(got, "no definition found") {
+		t.Fatalf("got %q, %v, want no definition found", got, err)
+	}
+}
+
+// mistralToolCallStream is a recorded streaming response of the mistral api calling a tool.
+const mistralToolCallStream = `data: {"id":"cmpl-e5cc70bb28c444948073e77776eb30ef","object":"chat.completion.chunk","created":1718000000,"model":"mistral-large-latest","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}
+
+data: {"id":"cmpl-e5cc70bb28c444948073e77776eb30ef","object":"chat.completion.chunk","created":1718000000,"model":"mistral-large-latest","choices":[{"index":0,"delta":{"content":"","tool_calls":[{"id":"D681PevKs","function":{"name":"getTime","arguments":"{\"timezone\": \"Asia/Tokyo\"}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":92,"total_tokens":115,"completion_tokens":23}}
+
+data: [DONE]
+
+`
+
+func TestExecuteToolCalls_Mistral(t *testing.T) {
+	now = func() time.Time { return time.Date(2024, 6, 10, 1, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	type request struct {
+		Messages []struct {
+			Role      string           `json:"role"`
+			Content   string           `json:"content"`
+			ToolCalls []map[string]any `json:"tool_calls"`
+		} `json:"messages"`
+		Tools []map[string]any `json:"tools"`
+	}
+	var requests []request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, req)
+		w.Header().Set("Content-Type", "text/event-stream")
+		if len(requests) == 1 {
+			w.Write([]byte(mistralToolCallStream))
+			return
+		}
+		w.Write([]byte(`data: {"id":"cmpl-2","object":"chat.completion.chunk","created":1718000001,"model":"mistral-large-latest","choices":[{"index":0,"delta":{"content":"It is 10:00 in Tokyo."},"finish_reason":"stop"}]}
+
+data: [DONE]
+
+`))
+	}))
+	defer ts.Close()
+
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [{"name": "mistral", "api_key": "key", "base_url": "`+ts.URL+`", "enabled": true, "has_tool_support": true}]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	agent := NewLLMAgent(settings)
+	agent.tools = map[string][]llms.Tool{"mistral": {timeTool}}
+
+	got, err := agent.QueryString(context.Background(), "mistral", "alice", "what time is it in Tokyo?", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(got, "It is 10:00 in Tokyo.") {
+		t.Fatalf("got answer %q", got)
+	}
+
+	if len(requests) != 2 || len(requests[0].Tools) != 1 {
+		t.Fatalf("got %d requests, want the tool call then the answer", len(requests))
+	}
+	var roles []string
+	for _, m := range requests[1].Messages {
+		roles = append(roles, m.Role)
+		if m.Role == "tool" || len(m.ToolCalls) > 0 {
+			t.Errorf("got message %+v, want the tool results as text", m)
+		}
+	}
+	if want := []string{"system", "user", "assistant", "user"}; !slices.Equal(roles, want) {
+		t.Fatalf("got roles %v, want %v", roles, want)
+	}
+	calls, results := requests[1].Messages[2].Content, requests[1].Messages[3].Content
+	if calls != `Calling the tool getTime with {"timezone": "Asia/Tokyo"}` {
+		t.Errorf("got calls %q", calls)
+	}
+	if !strings.Contains(results, "Result of the tool getTime:\nMonday, 2024-06-10 10:00:00 JST") {
+		t.Errorf("got results %q", results)
+	}
+}
@@ -0,0 +1,110 @@
+package aicore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNoTranscription is returned for the audio sent when no whisper_api_key is set.
+var ErrNoTranscription = errors.New("voice messages are not supported, no transcription is configured")
+
+// TranscriptionEnabled reports whether audio can be transcribed.
+func (a *LLMAgent) TranscriptionEnabled() bool {
+	settings := a.currentSettings()
+	return settings.WhisperAPIKey != nil && *settings.WhisperAPIKey != ""
+}
+
+// Transcribe downloads the audio file name at audioURL and returns its text, files
+// larger than max_audio_size are refused.
+func (a *LLMAgent) Transcribe(ctx context.Context, audioURL, name string) (string, error) {
+	settings := a.currentSettings()
+	if settings.WhisperAPIKey == nil || *settings.WhisperAPIKey == "" {
+		return "", ErrNoTranscription
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, audioURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := (&http.Client{Timeout: 1 * time.Minute}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download file %s: %s", name, resp.Status)
+	}
+	audio, err := io.ReadAll(io.LimitReader(resp.Body, int64(*settings.MaxAudioSize)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(audio) > *settings.MaxAudioSize {
+		return "", fmt.Errorf("audio %s is larger than %d bytes", name, *settings.MaxAudioSize)
+	}
+
+	return transcribe(ctx, settings.WhisperURL, *settings.WhisperAPIKey, settings.WhisperModel, name, audio)
+}
+
+// transcribe sends the audio file name to an OpenAI compatible transcription
+// endpoint and returns its text.
+func transcribe(ctx context.Context, endpoint, apiKey, model, name string, audio []byte) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := w.WriteField("model", model); err != nil {
+		return "", err
+	}
+	if err := w.WriteField("response_format", "json"); err != nil {
+		return "", err
+	}
+	fw, err := w.CreateFormFile("file", name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(audio); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := (&http.Client{Timeout: 2 * time.Minute}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Text  string `json:"text"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if result.Error != nil && result.Error.Message != "" {
+			return "", errors.New("transcription failed: " + result.Error.Message)
+		}
+		return "", errors.New(req.URL.Host + ": " + resp.Status)
+	}
+	if text := strings.TrimSpace(result.Text); text != "" {
+		return text, nil
+	}
+	return "", errors.New("nothing was heard in the audio")
+}
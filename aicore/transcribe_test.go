@@ -0,0 +1,70 @@
+package aicore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTranscribe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/voice-message.ogg":
+			w.Write([]byte("OggS audio"))
+		case "/large.ogg":
+			w.Write([]byte(strings.Repeat("a", 100)))
+		case "/transcriptions":
+			if r.Header.Get("Authorization") != "Bearer key" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error":{"message":"Incorrect API key provided"}}`))
+				return
+			}
+			f, h, err := r.FormFile("file")
+			if err != nil {
+				t.Error(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			audio, _ := io.ReadAll(f)
+			if r.FormValue("model") != "whisper-1" || h.Filename != "voice-message.ogg" || string(audio) != "OggS audio" {
+				t.Errorf("got model %q, file %q with %q", r.FormValue("model"), h.Filename, audio)
+			}
+			w.Write([]byte(`{"text":" what is the weather in Paris? "}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(t, nil)
+	ctx := context.Background()
+	if agent.TranscriptionEnabled() {
+		t.Fatal("got transcription enabled without a key")
+	}
+	if _, err := agent.Transcribe(ctx, ts.URL+"/voice-message.ogg", "voice-message.ogg"); !errors.Is(err, ErrNoTranscription) {
+		t.Fatalf("got error %v, want ErrNoTranscription", err)
+	}
+
+	key := "key"
+	agent.settings.WhisperAPIKey, agent.settings.WhisperURL = &key, ts.URL+"/transcriptions"
+	text, err := agent.Transcribe(ctx, ts.URL+"/voice-message.ogg", "voice-message.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "what is the weather in Paris?" {
+		t.Fatalf("got transcript %q", text)
+	}
+
+	*agent.settings.MaxAudioSize = 10
+	if _, err := agent.Transcribe(ctx, ts.URL+"/large.ogg", "large.ogg"); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("got error %v, want the audio refused", err)
+	}
+
+	if _, err := transcribe(ctx, ts.URL+"/transcriptions", "bad", "whisper-1", "voice-message.ogg", []byte("OggS audio")); err == nil || !strings.Contains(err.Error(), "Incorrect API key") {
+		t.Fatalf("got error %v, want the error of the endpoint", err)
+	}
+}
@@ -0,0 +1,127 @@
+package aicore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/douglarek/llmverse/config"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// tokenUsage is the number of tokens used by the calls of a query.
+type tokenUsage struct {
+	input    int
+	output   int
+	reported bool
+}
+
+// add adds the usage reported in the generation info of a response, providers
+// name the counts differently so all known names are looked up.
+func (u *tokenUsage) add(info map[string]any) {
+	for _, k := range [][2]string{{"PromptTokens", "CompletionTokens"}, {"input_tokens", "output_tokens"}} {
+		input, ok1 := toInt(info[k[0]])
+		output, ok2 := toInt(info[k[1]])
+		if ok1 || ok2 {
+			u.input, u.output, u.reported = u.input+input, u.output+output, true
+			return
+		}
+	}
+
+	if v, ok := info["usage"]; ok { // mistral
+		var usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		}
+		if b, err := json.Marshal(v); err == nil && json.Unmarshal(b, &usage) == nil && usage.PromptTokens+usage.CompletionTokens > 0 {
+			u.input, u.output, u.reported = u.input+usage.PromptTokens, u.output+usage.CompletionTokens, true
+		}
+	}
+}
+
+// cost returns the estimated cost in dollars, ok is false if either the usage
+// or the prices of the model are unknown.
+func (u *tokenUsage) cost(ms config.LLMSetting) (float64, bool) {
+	if !u.reported || ms.InputPrice == nil || ms.OutputPrice == nil {
+		return 0, false
+	}
+	return float64(u.input)/1000**ms.InputPrice + float64(u.output)/1000**ms.OutputPrice, true
+}
+
+// costFooter returns the cost estimate appended to an answer, or "" if it's unknown.
+func (u *tokenUsage) costFooter(ms config.LLMSetting) string {
+	if c, ok := u.cost(ms); ok {
+		return fmt.Sprintf("\n\n(≈ $%.4f)", c)
+	}
+	return ""
+}
+
+func toInt(v any) (int, bool) {
+	switch v := v.(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// usageModel is a model that adds the token usage of its responses to usage.
+type usageModel struct {
+	llms.Model
+	usage *tokenUsage
+}
+
+func (m *usageModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	resp, err := m.Model.GenerateContent(ctx, messages, options...)
+	if err == nil && len(resp.Choices) > 0 {
+		m.usage.add(resp.Choices[0].GenerationInfo)
+	}
+	return resp, err
+}
+
+type usageKey struct {
+	user  string
+	model string
+}
+
+func (a *LLMAgent) recordUsage(user, modelName string, u *tokenUsage) {
+	if !u.reported {
+		return
+	}
+
+	a.usageMu.Lock()
+	defer a.usageMu.Unlock()
+	if a.usage == nil {
+		a.usage = make(map[usageKey]tokenUsage)
+	}
+	total := a.usage[usageKey{user, modelName}]
+	total.input, total.output, total.reported = total.input+u.input, total.output+u.output, true
+	a.usage[usageKey{user, modelName}] = total
+}
+
+// Usage describes the tokens the user has used per model, or returns "" if none.
+func (a *LLMAgent) Usage(user string) string {
+	a.usageMu.Lock()
+	defer a.usageMu.Unlock()
+
+	var b strings.Builder
+	for _, m := range a.ModelNames() {
+		if u, ok := a.usage[usageKey{user, m}]; ok {
+			fmt.Fprintf(&b, "`%s`: %d prompt + %d completion tokens\n", m, u.input, u.output)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// ResetUsage forgets the token usage of all users.
+func (a *LLMAgent) ResetUsage() {
+	a.usageMu.Lock()
+	defer a.usageMu.Unlock()
+	a.usage = nil
+}
@@ -0,0 +1,77 @@
+package aicore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/douglarek/llmverse/config"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestTokenUsage(t *testing.T) {
+	in, out := 0.01, 0.03
+	ms := config.LLMSetting{InputPrice: &in, OutputPrice: &out}
+
+	var u tokenUsage
+	if v := u.costFooter(ms); v != "" {
+		t.Fatalf("got %q, want no footer without usage", v)
+	}
+
+	u.add(map[string]any{"PromptTokens": 100, "CompletionTokens": 50})
+	u.add(map[string]any{"input_tokens": int32(100), "output_tokens": int32(50)})
+	u.add(map[string]any{"usage": struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	}{100, 50}})
+	u.add(map[string]any{"created": 1})
+	if u.input != 300 || u.output != 150 {
+		t.Fatalf("got usage %d/%d, want 300/150", u.input, u.output)
+	}
+
+	if v := u.costFooter(ms); v != "\n\n(≈ $0.0075)" {
+		t.Fatalf("got %q", v)
+	}
+	if v := u.costFooter(config.LLMSetting{}); v != "" {
+		t.Fatalf("got %q, want no footer without prices", v)
+	}
+}
+
+func TestLLMAgent_Usage(t *testing.T) {
+	agent := newTestAgent(t, map[string]llms.Model{"a": &stubModel{}, "b": &stubModel{}})
+
+	agent.recordUsage("alice", "a", &tokenUsage{input: 10, output: 5, reported: true})
+	agent.recordUsage("alice", "a", &tokenUsage{input: 10, output: 5, reported: true})
+	agent.recordUsage("alice", "b", &tokenUsage{})
+	agent.recordUsage("bob", "b", &tokenUsage{input: 1, output: 1, reported: true})
+
+	if v := agent.Usage("alice"); v != "`a`: 20 prompt + 10 completion tokens" {
+		t.Fatalf("got %q", v)
+	}
+
+	agent.ResetUsage()
+	if v := agent.Usage("bob"); v != "" {
+		t.Fatalf("got %q, want no usage after reset", v)
+	}
+}
+
+func TestLLMAgent_QueryCostFooter(t *testing.T) {
+	in, out := 0.01, 0.03
+	for _, showCost := range []bool{false, true} {
+		model := &scriptedModel{choices: []*llms.ContentChoice{{Content: "hi", GenerationInfo: map[string]any{"PromptTokens": 100, "CompletionTokens": 50}}}}
+		agent := newTestAgent(t, map[string]llms.Model{"stub": model})
+		agent.settings.Models = []config.LLMSetting{{Name: "stub", Enabled: true, InputPrice: &in, OutputPrice: &out}}
+		agent.settings.ShowCost = showCost
+
+		got, err := agent.QueryString(context.Background(), "stub", "alice", "hello", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if footer := strings.Contains(got, "(≈ $"); footer != showCost {
+			t.Errorf("show_cost %v: got %q", showCost, got)
+		}
+		if v := agent.Usage("alice"); v == "" {
+			t.Errorf("show_cost %v: got no usage recorded", showCost)
+		}
+	}
+}
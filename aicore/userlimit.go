@@ -0,0 +1,62 @@
+package aicore
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// userLimiter allows each user a number of requests per window, as a token bucket
+// per user that holds up to the number of requests and refills over the window.
+type userLimiter struct {
+	mu       sync.Mutex
+	capacity float64
+	rate     float64 // tokens per second
+	buckets  map[string]*tokenBucket
+	now      func() time.Time
+}
+
+func newUserLimiter(requests int, window time.Duration) *userLimiter {
+	return &userLimiter{
+		capacity: float64(requests),
+		rate:     float64(requests) / window.Seconds(),
+		buckets:  make(map[string]*tokenBucket),
+		now:      time.Now,
+	}
+}
+
+// allow takes a token from the bucket of the user, or returns how long it takes
+// until the next token is available.
+func (l *userLimiter) allow(user string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[user]
+	if !ok {
+		b = &tokenBucket{tokens: l.capacity, last: now}
+		l.buckets[user] = b
+	}
+
+	b.tokens = min(l.capacity, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration(math.Ceil((1-b.tokens)/l.rate*1000)) * time.Millisecond
+	}
+	b.tokens--
+
+	if len(l.buckets) > 1024 { // forget the users whose bucket is full again
+		for k, v := range l.buckets {
+			if v.tokens+now.Sub(v.last).Seconds()*l.rate >= l.capacity {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	return true, 0
+}
@@ -0,0 +1,54 @@
+package aicore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newUserLimiter(3, 30*time.Second) // a token every 10s
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("alice"); !ok {
+			t.Fatalf("request %d is limited, want the full bucket allowed", i)
+		}
+	}
+	ok, wait := l.allow("alice")
+	if ok {
+		t.Fatal("want the empty bucket limited")
+	}
+	if wait != 10*time.Second {
+		t.Fatalf("got wait %s, want 10s", wait)
+	}
+
+	// other users have their own bucket
+	if ok, _ := l.allow("bob"); !ok {
+		t.Fatal("want bob allowed")
+	}
+
+	// a token is refilled every 10s
+	now = now.Add(4 * time.Second)
+	if ok, wait := l.allow("alice"); ok || wait != 6*time.Second {
+		t.Fatalf("got %v and wait %s, want limited for 6s", ok, wait)
+	}
+	now = now.Add(6 * time.Second)
+	if ok, _ := l.allow("alice"); !ok {
+		t.Fatal("want the refilled token allowed")
+	}
+	if ok, _ := l.allow("alice"); ok {
+		t.Fatal("want only one token refilled")
+	}
+
+	// the bucket never holds more than its capacity
+	now = now.Add(1 * time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("alice"); !ok {
+			t.Fatalf("request %d is limited after a long pause", i)
+		}
+	}
+	if ok, _ := l.allow("alice"); ok {
+		t.Fatal("want the bucket capped at its capacity")
+	}
+}
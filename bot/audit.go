@@ -0,0 +1,52 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/douglarek/llmverse/aicore"
+)
+
+// channelAuditLog posts the queries and answers to a discord channel, the answers
+// too long for a message are attached as a file.
+type channelAuditLog struct {
+	s         *discordgo.Session
+	channelID string
+}
+
+func (l *channelAuditLog) Record(ctx context.Context, e aicore.AuditEntry) error {
+	content := auditMessage(e)
+	if len([]rune(content)) <= discordMessageLimit {
+		_, err := l.s.ChannelMessageSend(l.channelID, content, discordgo.WithContext(ctx))
+		return err
+	}
+
+	header, _, _ := strings.Cut(content, "\n")
+	_, err := l.s.ChannelMessageSendComplex(l.channelID, &discordgo.MessageSend{
+		Content: header,
+		Files:   []*discordgo.File{{Name: "query.md", ContentType: "text/markdown", Reader: bytes.NewReader([]byte(content))}},
+	}, discordgo.WithContext(ctx))
+	return err
+}
+
+// auditMessage renders the entry as a discord message: who asked which model when,
+// the question quoted, and the answer or the error.
+func auditMessage(e aicore.AuditEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s** asked **%s** at %s\n", e.User, e.Model, e.Time.UTC().Format(time.RFC3339))
+	for _, line := range strings.Split(e.Input, "\n") {
+		b.WriteString("> " + line + "\n")
+	}
+	for _, u := range e.Images {
+		b.WriteString("> 🖼️ " + u + "\n")
+	}
+	b.WriteString(e.Answer)
+	if e.Error != "" {
+		b.WriteString("\n⚠️ " + e.Error)
+	}
+	return b.String()
+}
@@ -0,0 +1,453 @@
+package bot
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/douglarek/llmverse/aicore"
+	"github.com/douglarek/llmverse/config"
+)
+
+// commands are the slash commands registered on startup, they mirror the text commands.
+var commands = []*discordgo.ApplicationCommand{
+	{
+		Name:        "ask",
+		Description: "Ask a model a question",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "model",
+				Description:  "The model to ask",
+				Required:     true,
+				Autocomplete: true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "question",
+				Description: "The question to ask",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "once",
+				Description: "Neither read nor keep your chat history",
+			},
+		},
+	},
+	{
+		Name:        "clear",
+		Description: "Clear your chat history",
+	},
+	{
+		Name:        "models",
+		Description: "List the available models",
+	},
+	{
+		Name:        "usage",
+		Description: "Show the tokens you have used",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "reset",
+				Description: "Reset the usage of all users, admins only",
+			},
+		},
+	},
+}
+
+func registerCommands(s *discordgo.Session) error {
+	for _, c := range commands {
+		if _, err := s.ApplicationCommandCreate(s.State.User.ID, "", c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interactionUser returns the user who triggered the interaction, it is set on
+// Member in guilds and on User in direct messages.
+func interactionUser(i *discordgo.Interaction) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+// displayName returns the name the user goes by: the nickname of the member in the
+// guild, the global name or the username.
+func displayName(m *discordgo.Member, u *discordgo.User) string {
+	if m != nil && m.Nick != "" {
+		return m.Nick
+	}
+	return cmp.Or(u.GlobalName, u.Username)
+}
+
+func respondInteraction(s *discordgo.Session, i *discordgo.Interaction, content string) {
+	s.InteractionRespond(i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: content},
+	})
+}
+
+// autocompleteModel suggests the available models matching what the user typed so far.
+func autocompleteModel(s *discordgo.Session, i *discordgo.Interaction, agent *aicore.LLMAgent) {
+	var typed string
+	for _, o := range i.ApplicationCommandData().Options {
+		if o.Focused && o.Name == "model" {
+			typed = strings.ToLower(o.StringValue())
+		}
+	}
+
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	for _, name := range agent.GuildModelNames(i.GuildID) {
+		if strings.HasPrefix(name, typed) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: name, Value: name})
+		}
+	}
+
+	s.InteractionRespond(i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	})
+}
+
+func interactionCreate(agent *aicore.LLMAgent) func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		switch i.Type {
+		case discordgo.InteractionApplicationCommand:
+		case discordgo.InteractionApplicationCommandAutocomplete:
+			autocompleteModel(s, i.Interaction, agent)
+			return
+		default:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+
+		user := interactionUser(i.Interaction)
+		if !agent.IsAllowed(i.GuildID, user.ID) {
+			respondInteraction(s, i.Interaction, notice(agent, "you are not allowed to use this bot here."))
+			return
+		}
+		if !channelAllowed(s, agent, i.GuildID, i.ChannelID) {
+			respondInteraction(s, i.Interaction, notice(agent, "this bot doesn't answer in this channel."))
+			return
+		}
+		data := i.ApplicationCommandData()
+		scope := []aicore.QueryOption{aicore.WithChannelID(i.ChannelID)}
+		if i.GuildID != "" && isThread(s, i.ChannelID) {
+			scope = append(scope, aicore.WithThreadID(i.ChannelID))
+		}
+
+		switch data.Name {
+		case "clear":
+			agent.ClearHistory(ctx, user.Username, scope...)
+			respondInteraction(s, i.Interaction, notice(agent, "history cleared."))
+		case "models":
+			resp := notice(agent, fmt.Sprintf("available models: %s.", agent.AvailableModelNames(i.GuildID)))
+			if status := agent.ModelStatus(); status != "" {
+				resp += "\n" + status
+			}
+			respondInteraction(s, i.Interaction, resp)
+		case "usage":
+			var reset bool
+			for _, o := range data.Options {
+				if o.Name == "reset" {
+					reset = o.BoolValue()
+				}
+			}
+			arg := ""
+			if reset {
+				arg = "reset"
+			}
+			respondInteraction(s, i.Interaction, usageCommand(agent, user.Username, user.ID, arg))
+		case "ask":
+			var modelName, question string
+			opts := append([]aicore.QueryOption{aicore.WithGuildID(i.GuildID), aicore.WithUserName(displayName(i.Member, user))}, scope...)
+			for _, o := range data.Options {
+				switch o.Name {
+				case "model":
+					modelName = o.StringValue()
+				case "question":
+					question = o.StringValue()
+				case "once":
+					if o.BoolValue() {
+						opts = append(opts, aicore.WithStateless())
+					}
+				}
+			}
+
+			// build the same input as the text command, so history looks alike for both
+			input := combineModelWithMessage(modelName, question)
+			if agent.ParseModelName(input, i.GuildID) == "" {
+				respondInteraction(s, i.Interaction, combineModelWithErrMessage(agent, modelName, fmt.Sprintf("unknown model, available models: %s", agent.AvailableModelNames(i.GuildID))))
+				return
+			}
+
+			var roles []string
+			if i.Member != nil {
+				roles = i.Member.Roles
+			}
+			resolved, err := agent.ResolveModel(modelName, user.ID, roles)
+			if err != nil {
+				respondInteraction(s, i.Interaction, combineModelWithErrMessage(agent, modelName, err.Error()))
+				return
+			}
+			if resolved != modelName {
+				modelName, input = resolved, combineModelWithMessage(resolved, question)
+			}
+
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+			})
+			if err != nil {
+				slog.Error("[interactionCreate] failed to defer response", "error", err)
+				return
+			}
+
+			output, err := agent.Query(ctx, modelName, user.Username, input, nil, opts...)
+			if err != nil {
+				content := combineModelWithErrMessage(agent, modelName, err.Error())
+				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content})
+				return
+			}
+
+			streamReply(&interactionReplier{s: s, i: i.Interaction}, modelName, output, newStreamOptions(agent, modelName, config.ReplyModeEdit))
+		}
+	}
+}
+
+// interactionReplier streams into the deferred interaction response first, and
+// into followup messages once the response is full.
+type interactionReplier struct {
+	s          *discordgo.Session
+	i          *discordgo.Interaction
+	originalID string
+}
+
+func (r *interactionReplier) send(content string) (string, error) {
+	var m *discordgo.Message
+	err := withRetryAfter(func(options ...discordgo.RequestOption) (err error) {
+		if r.originalID == "" {
+			m, err = r.s.InteractionResponseEdit(r.i, &discordgo.WebhookEdit{Content: &content}, options...)
+			return err
+		}
+		m, err = r.s.FollowupMessageCreate(r.i, true, &discordgo.WebhookParams{Content: content}, options...)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if r.originalID == "" {
+		r.originalID = m.ID
+	}
+	return m.ID, nil
+}
+
+func (r *interactionReplier) edit(id, content string) error {
+	return withRetryAfter(func(options ...discordgo.RequestOption) (err error) {
+		if id == r.originalID {
+			_, err = r.s.InteractionResponseEdit(r.i, &discordgo.WebhookEdit{Content: &content}, options...)
+		} else {
+			_, err = r.s.FollowupMessageEdit(r.i, id, &discordgo.WebhookEdit{Content: &content}, options...)
+		}
+		return err
+	})
+}
+
+func (r *interactionReplier) attach(name string, data []byte) error {
+	_, err := r.s.FollowupMessageCreate(r.i, true, &discordgo.WebhookParams{
+		Files: []*discordgo.File{{Name: name, Reader: bytes.NewReader(data)}},
+	})
+	return err
+}
+
+// typing is a no-op, a deferred interaction already shows the "thinking" state.
+func (r *interactionReplier) typing() {}
+
+func (r *interactionReplier) limit() int {
+	return discordMessageLimit
+}
+
+// usageCommand shows the token usage of the user, or resets the usage of all
+// users if arg is "reset" and the user is an admin.
+func usageCommand(agent *aicore.LLMAgent, user, userID, arg string) string {
+	switch arg {
+	case "":
+		if usage := agent.Usage(user); usage != "" {
+			return notice(agent, "your token usage:\n"+usage)
+		}
+		return notice(agent, "you haven't used any tokens yet.")
+	case "reset":
+		if !agent.IsAdmin(userID) {
+			return notice(agent, "only admins can reset the usage.")
+		}
+		agent.ResetUsage()
+		return notice(agent, "usage reset.")
+	}
+	prefix := agent.CommandPrefix()
+	return notice(agent, "usage: `"+prefix+"usage` or `"+prefix+"usage reset`")
+}
+
+// systemCommand shows, sets or resets the global system prompt, only admins are
+// allowed to use it.
+func systemCommand(agent *aicore.LLMAgent, userID, arg string) string {
+	if !agent.IsAdmin(userID) {
+		return notice(agent, "only admins can manage the system prompt.")
+	}
+
+	switch arg {
+	case "":
+		return notice(agent, "current system prompt: "+agent.GlobalSystemPrompt())
+	case "reset":
+		agent.SetSystemPrompt("")
+		return notice(agent, "system prompt reset.")
+	}
+	agent.SetSystemPrompt(arg)
+	return notice(agent, "system prompt updated.")
+}
+
+// reloadHook holds the function re-reading the config file, it is set once all the
+// front-ends are created.
+type reloadHook struct {
+	fn atomic.Pointer[func() error]
+}
+
+// SetReloader sets the function the $reload command calls.
+func (h *reloadHook) SetReloader(reload func() error) {
+	h.fn.Store(&reload)
+}
+
+func (h *reloadHook) reload() error {
+	fn := h.fn.Load()
+	if fn == nil {
+		return errors.New("reloading is not available")
+	}
+	return (*fn)()
+}
+
+// reloadCommand re-reads the config, the queries in flight keep the settings they started with.
+func reloadCommand(agent *aicore.LLMAgent, userID string, reload func() error) string {
+	if !agent.IsAdmin(userID) {
+		return notice(agent, "only admins can reload the config.")
+	}
+	if err := reload(); err != nil {
+		return notice(agent, "cannot reload the config: "+err.Error())
+	}
+	return notice(agent, "config reloaded.")
+}
+
+// debugCommand switches the raw responses after the answers to the user on or off.
+func debugCommand(agent *aicore.LLMAgent, user string) string {
+	if !agent.DebugEnabled() {
+		return notice(agent, "debugging is not enabled.")
+	}
+	if agent.ToggleDebug(user) {
+		return notice(agent, "debug output on, the raw responses follow the answers.")
+	}
+	return notice(agent, "debug output off.")
+}
+
+// helpMessage answers a mention of the bot without a question, help_message
+// replaces it if set.
+func helpMessage(agent *aicore.LLMAgent, guildID, user string) string {
+	if v := agent.HelpMessage(); v != "" {
+		return v
+	}
+	prefix, example := agent.CommandPrefix(), "model"
+	if names := agent.GuildModelNames(guildID); len(names) > 0 {
+		example = names[0]
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "hi! begin your question with the model to answer it, like `%s%s why is the sky blue?`.\n", example, agent.ModelSeparator())
+	if name := agent.DefaultModel(guildID, user); name != "" {
+		fmt.Fprintf(&b, "the questions without a model go to `%s`.\n", name)
+	}
+	fmt.Fprintf(&b, "`%smodels` lists the models, `%sclear` forgets our conversation.\n", prefix, prefix)
+	fmt.Fprintf(&b, "available models: %s.", agent.AvailableModelNames(guildID))
+	return notice(agent, b.String())
+}
+
+// setModelCommand sets the model answering the messages of the user without a model
+// selector, none forgets it.
+func setModelCommand(agent *aicore.LLMAgent, guildID, user, arg string) string {
+	prefix := agent.CommandPrefix()
+	switch arg {
+	case "":
+		return notice(agent, "usage: `"+prefix+"setmodel <model>` or `"+prefix+"setmodel none`")
+	case "none":
+		agent.SetPreferredModel(user, "")
+		return notice(agent, "model forgotten, "+modelHint(agent)+".")
+	}
+	if !slices.Contains(agent.GuildModelNames(guildID), arg) {
+		return notice(agent, fmt.Sprintf("unknown model `%s`, available models: %s.", arg, agent.AvailableModelNames(guildID)))
+	}
+	if err := agent.SetPreferredModel(user, arg); err != nil {
+		return notice(agent, err.Error())
+	}
+	return notice(agent, "`"+arg+"` answers your messages without a model now.")
+}
+
+// myModelCommand shows the model answering the messages of the user without a model selector.
+func myModelCommand(agent *aicore.LLMAgent, guildID, user string) string {
+	name := agent.DefaultModel(guildID, user)
+	switch {
+	case name == "":
+		return notice(agent, "no model set, "+modelHint(agent)+" or send `"+agent.CommandPrefix()+"setmodel <model>`.")
+	case name == agent.PreferredModel(user):
+		return notice(agent, "your model is `"+name+"`.")
+	}
+	return notice(agent, "no model set, the default model `"+name+"` answers.")
+}
+
+// noTruncatedAnswer answers $continue when there is nothing to continue.
+const noTruncatedAnswer = "there is no cut answer to continue."
+
+// continueInput returns the question asking the model whose last answer to the
+// user was cut at the length limit to go on, or "" if there is none.
+func continueInput(agent *aicore.LLMAgent, user string, opts ...aicore.QueryOption) string {
+	modelName := agent.TruncatedModel(user, opts...)
+	if modelName == "" {
+		return ""
+	}
+	return modelName + agent.ModelSeparator() + " " + aicore.ContinuePrompt
+}
+
+// parseCommand splits content starting with the command prefix into the name of
+// the command and its argument, ok is false if content is not a command.
+func parseCommand(content, prefix string) (name, arg string, ok bool) {
+	rest, ok := strings.CutPrefix(content, prefix)
+	if !ok || prefix == "" {
+		return "", "", false
+	}
+	name, arg = rest, ""
+	if i := strings.IndexFunc(rest, unicode.IsSpace); i != -1 {
+		name, arg = rest[:i], rest[i:]
+	}
+	return name, strings.TrimSpace(arg), name != ""
+}
+
+// notice marks the message as the bot's own rather than a model's, with the notice_prefix.
+func notice(agent *aicore.LLMAgent, message string) string {
+	if prefix := agent.NoticePrefix(); prefix != "" {
+		return prefix + " " + message
+	}
+	return message
+}
+
+// modelHint tells how to select a model with the configured separator.
+func modelHint(agent *aicore.LLMAgent) string {
+	return "begin your question with `model" + agent.ModelSeparator() + " `"
+}
@@ -1,11 +1,16 @@
 package bot
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"path"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -15,44 +20,291 @@ import (
 )
 
 type Discord struct {
-	session *discordgo.Session
+	reloadHook
+	sessions []*discordgo.Session // one per shard
+	agent    *aicore.LLMAgent
+	requests sync.WaitGroup // the handlers running, waited for on close
 }
 
-func (b *Discord) Close() error {
-	return b.session.Close()
+// Reload adds the audit channel of the settings again once the agent is reloaded,
+// the bot token can't be changed.
+func (b *Discord) Reload(settings config.Settings) {
+	b.addAuditChannel(settings)
 }
 
-func NewDiscord(settings config.Settings) (*Discord, error) {
-	session, err := discordgo.New("Bot " + settings.DiscordBotToken)
-	if err != nil {
-		return nil, err
+// addAuditChannel posts the queries to the audit channel if one is configured,
+// through the first shard.
+func (b *Discord) addAuditChannel(settings config.Settings) {
+	if settings.AuditChannelID != "" {
+		b.agent.AddAuditLog(&channelAuditLog{s: b.sessions[0], channelID: settings.AuditChannelID})
 	}
+}
 
-	session.AddHandler(botReady)
-	session.AddHandler(messageCreate(aicore.NewLLMAgent(settings)))
-	session.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages
+// Healthy fails if the gateway connection of a shard is down or no model is available.
+func (b *Discord) Healthy() error {
+	for _, session := range b.sessions {
+		session.RLock()
+		ready := session.DataReady
+		session.RUnlock()
+		if !ready {
+			return fmt.Errorf("discord session of shard %d is not connected", session.ShardID)
+		}
+	}
+	return checkModels(b.agent)
+}
 
-	err = session.Open()
-	if err != nil {
+// Close closes the sessions of all shards, then interrupts the answers in progress
+// and waits for them to be posted.
+func (b *Discord) Close() error {
+	var errs []error
+	for _, session := range b.sessions {
+		errs = append(errs, session.Close())
+	}
+	shutdown(b.agent, &b.requests)
+	return errors.Join(errs...)
+}
+
+// shardDelay is the wait between the connections of two shards, discord allows one
+// identify every 5 seconds.
+var shardDelay = 5 * time.Second
+
+// NewDiscord connects the bot answering with agent, which may be shared with the
+// other front-ends.
+func NewDiscord(settings config.Settings, agent *aicore.LLMAgent) (*Discord, error) {
+	b := &Discord{agent: agent}
+	requests := newInflight() // shared, a reaction or a deletion may come on any shard
+
+	shards := max(settings.ShardCount, 1)
+	for id := range shards {
+		session, err := discordgo.New("Bot " + settings.DiscordBotToken)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		session.ShardID, session.ShardCount = id, shards
+
+		session.AddHandler(botReady)
+		session.AddHandler(track(&b.requests, messageCreate(b.agent, requests, b.reload)))
+		session.AddHandler(messageDelete(requests))
+		session.AddHandler(messageReactionAdd(requests))
+		session.AddHandler(track(&b.requests, interactionCreate(b.agent)))
+		session.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages |
+			discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions
+
+		if id > 0 {
+			time.Sleep(shardDelay)
+		}
+		if err = session.Open(); err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.sessions = append(b.sessions, session)
+	}
+
+	if err := registerCommands(b.sessions[0]); err != nil { // the commands are global to the application
+		b.Close()
 		return nil, err
 	}
+	b.addAuditChannel(settings)
 
-	return &Discord{session: session}, nil
+	return b, nil
 }
 
 func botReady(s *discordgo.Session, r *discordgo.Ready) {
-	slog.Info("[main]: bot is ready", "user", r.User.Username+"#"+r.User.Discriminator)
+	slog.Info("[main]: bot is ready", "user", r.User.Username+"#"+r.User.Discriminator, "shard", s.ShardID)
 }
 
+// discordMessageLimit is the max number of characters of a discord message.
+const discordMessageLimit = 2000
+
 func combineModelWithMessage(modelName, message string) string {
 	return modelName + ": " + message
 }
 
-func combineModelWithErrMessage(modelName, message string) string {
-	return modelName + ": 🤖 " + message
+func combineModelWithErrMessage(agent *aicore.LLMAgent, modelName, message string) string {
+	return combineModelWithMessage(modelName, notice(agent, message))
+}
+
+// ackEmoji returns the emoji to react with to a message the bot takes, as
+// MessageReactionAdd wants it, false if ack_emoji disables the reactions. A custom
+// emoji may be given as copied from discord, like <:name:id>.
+func ackEmoji(agent *aicore.LLMAgent) (string, bool) {
+	emoji := strings.TrimSpace(agent.AckEmoji())
+	if v, ok := strings.CutPrefix(emoji, "<"); ok {
+		v = strings.TrimSuffix(v, ">")
+		v = strings.TrimPrefix(v, "a:") // animated
+		emoji = strings.TrimPrefix(v, ":")
+	}
+	return emoji, emoji != ""
+}
+
+// acknowledge reacts to the message with the ack_emoji, unless it is disabled.
+func acknowledge(s *discordgo.Session, agent *aicore.LLMAgent, m *discordgo.MessageCreate) {
+	if emoji, ok := ackEmoji(agent); ok {
+		s.MessageReactionAdd(m.ChannelID, m.ID, emoji)
+	}
 }
 
-func messageCreate(agent *aicore.LLMAgent) func(s *discordgo.Session, e *discordgo.MessageCreate) {
+// mentionPattern matches the mentions, channels and emojis in a message.
+var mentionPattern = regexp.MustCompile("<[^>]+>")
+
+// referencedModel returns the model of the message replied to, ref may be nil: the
+// model a bot answer came from, as in combineModelWithMessage, or the model a
+// question was asked to, so a reply continues the conversation with that model.
+func referencedModel(agent *aicore.LLMAgent, ref *discordgo.Message, botID, guildID string) string {
+	if ref == nil {
+		return ""
+	}
+	if ref.Author != nil && ref.Author.ID == botID {
+		return answerModel(agent, ref.Content, guildID)
+	}
+	return agent.ParseModelName(mentionPattern.ReplaceAllString(ref.Content, ""), guildID) // a question, after the mention of the bot
+}
+
+// referenceContext quotes the message ref replied to before input, unless it is an
+// answer of the bot, which the history has already. The attachments of ref the
+// question can use, images, PDFs and text files, are returned along.
+func referenceContext(agent *aicore.LLMAgent, ref *discordgo.Message, botID, input string) (string, []*discordgo.MessageAttachment) {
+	if ref == nil || ref.Author == nil || ref.Author.ID == botID {
+		return input, nil
+	}
+
+	var attachments []*discordgo.MessageAttachment
+	for _, a := range ref.Attachments {
+		if agent.IsImageFile(a.Filename) || isPDFAttachment(a) || isTextAttachment(a) {
+			attachments = append(attachments, a)
+		}
+	}
+
+	content := strings.TrimSpace(mentionPattern.ReplaceAllString(ref.Content, ""))
+	if content == "" {
+		return input, attachments
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s wrote, in the message I reply to:\n", ref.Author.Username)
+	for _, line := range strings.Split(content, "\n") {
+		b.WriteString("> " + line + "\n")
+	}
+	return b.String() + "\n" + input, attachments
+}
+
+// answerModel returns the model an answer of the bot is labelled with by
+// combineModelWithMessage, whatever the model separator of the questions.
+func answerModel(agent *aicore.LLMAgent, content, guildID string) string {
+	name, _, ok := strings.Cut(content, ": ")
+	if !ok || !slices.Contains(agent.GuildModelNames(guildID), name) {
+		return ""
+	}
+	return name
+}
+
+// modelPrefix returns what looks like a model selector at the start of input,
+// i.e. a single word followed by the separator, or empty if there is none.
+func modelPrefix(input, separator string) string {
+	index := strings.Index(input, separator)
+	if index <= 0 || strings.ContainsFunc(input[:index], unicode.IsSpace) {
+		return ""
+	}
+	return input[:index]
+}
+
+// guildSystemCommand shows, sets or resets the system prompt of the guild, only
+// members who can manage the guild are allowed to change it.
+func guildSystemCommand(s *discordgo.Session, e *discordgo.MessageCreate, agent *aicore.LLMAgent, arg string) string {
+	if e.GuildID == "" {
+		return notice(agent, "guild system prompt is only available in servers.")
+	}
+
+	if arg == "" {
+		return notice(agent, "current system prompt: "+agent.SystemPrompt(e.GuildID, ""))
+	}
+
+	perms, err := s.UserChannelPermissions(e.Author.ID, e.ChannelID)
+	if err != nil || perms&discordgo.PermissionManageServer == 0 {
+		return notice(agent, "only server managers can change the guild system prompt.")
+	}
+
+	if arg == "reset" {
+		agent.SetGuildSystemPrompt(e.GuildID, "")
+		return notice(agent, "guild system prompt reset.")
+	}
+
+	agent.SetGuildSystemPrompt(e.GuildID, arg)
+	return notice(agent, "guild system prompt updated.")
+}
+
+// exportCommand sends the conversation of the author with the model, or with all
+// models if modelName is empty, as a Markdown attachment.
+func exportCommand(ctx context.Context, s *discordgo.Session, e *discordgo.MessageCreate, agent *aicore.LLMAgent, modelName string, scope []aicore.QueryOption) {
+	if modelName != "" && !slices.Contains(agent.GuildModelNames(e.GuildID), modelName) {
+		s.ChannelMessageSendReply(e.ChannelID, notice(agent, fmt.Sprintf("unknown model `%s`, available models: %s.", modelName, agent.AvailableModelNames(e.GuildID))), e.Reference())
+		return
+	}
+
+	b, err := agent.ExportHistory(ctx, e.Author.Username, modelName, scope...)
+	if err != nil {
+		s.ChannelMessageSendReply(e.ChannelID, notice(agent, "failed to export the conversation: "+err.Error()), e.Reference())
+		return
+	}
+	if len(b) == 0 {
+		s.ChannelMessageSendReply(e.ChannelID, notice(agent, "there is no conversation to export yet."), e.Reference())
+		return
+	}
+
+	_, err = s.ChannelMessageSendComplex(e.ChannelID, &discordgo.MessageSend{
+		Files:     []*discordgo.File{{Name: "conversation.md", ContentType: "text/markdown", Reader: bytes.NewReader(b)}},
+		Reference: e.Reference(),
+	})
+	if err != nil {
+		slog.Error("[exportCommand] failed to send the conversation", "error", err)
+	}
+}
+
+// previewCommand sends the request the question would make to the model as a file,
+// without calling the model.
+func previewCommand(ctx context.Context, s *discordgo.Session, e *discordgo.MessageCreate, agent *aicore.LLMAgent, modelName, input string, imageURLs []string, opts []aicore.QueryOption) {
+	b, err := agent.Preview(ctx, modelName, e.Author.Username, input, imageURLs, opts...)
+	if err != nil {
+		s.ChannelMessageSendReply(e.ChannelID, combineModelWithErrMessage(agent, modelName, err.Error()), e.Reference())
+		return
+	}
+
+	_, err = s.ChannelMessageSendComplex(e.ChannelID, &discordgo.MessageSend{
+		Files:     []*discordgo.File{{Name: "request.md", ContentType: "text/markdown", Reader: bytes.NewReader(b)}},
+		Reference: e.Reference(),
+	})
+	if err != nil {
+		slog.Error("[previewCommand] failed to send the request", "error", err)
+	}
+}
+
+// messageDelete stops the generation of a deleted message.
+func messageDelete(requests *inflight) func(s *discordgo.Session, e *discordgo.MessageDelete) {
+	return func(s *discordgo.Session, e *discordgo.MessageDelete) {
+		if requests.cancel(e.ID) {
+			slog.Debug("[messageDelete] generation cancelled", "message", e.ID)
+		}
+	}
+}
+
+// cancelEmoji is the reaction the requester clicks on a streaming reply to stop
+// its generation.
+const cancelEmoji = "❌"
+
+// messageReactionAdd stops the generation of a streaming reply when its requester
+// reacts with cancelEmoji.
+func messageReactionAdd(requests *inflight) func(s *discordgo.Session, e *discordgo.MessageReactionAdd) {
+	return func(s *discordgo.Session, e *discordgo.MessageReactionAdd) {
+		if e.UserID == s.State.User.ID || e.Emoji.Name != cancelEmoji {
+			return
+		}
+		if requests.cancelReply(e.MessageID, e.UserID) {
+			slog.Debug("[messageReactionAdd] generation cancelled", "reply", e.MessageID, "user", e.UserID)
+		}
+	}
+}
+
+func messageCreate(agent *aicore.LLMAgent, requests *inflight, reload func() error) func(s *discordgo.Session, e *discordgo.MessageCreate) {
 	return func(s *discordgo.Session, e *discordgo.MessageCreate) {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 		defer cancel()
@@ -73,99 +325,359 @@ func messageCreate(agent *aicore.LLMAgent) func(s *discordgo.Session, e *discord
 			return
 		}
 
-		rawConent := strings.TrimLeftFunc(regexp.MustCompile("<[^>]+>").ReplaceAllString(e.Content, ""), unicode.IsSpace)
+		if !agent.IsAllowed(e.GuildID, e.Author.ID) {
+			slog.Info("[messageCreate] ignored message from a user not allowed", "guild", e.GuildID, "user", e.Author.ID)
+			return
+		}
+		if !channelAllowed(s, agent, e.GuildID, e.ChannelID) {
+			slog.Info("[messageCreate] ignored message in a channel not allowed", "guild", e.GuildID, "channel", e.ChannelID)
+			return
+		}
+
+		scope := []aicore.QueryOption{aicore.WithChannelID(e.ChannelID)}
+		if e.GuildID != "" && isThread(s, e.ChannelID) { // the thread is a conversation of its own, and replies stay in it
+			scope = append(scope, aicore.WithThreadID(e.ChannelID))
+		}
 
-		if rawConent == "$clear" {
-			s.MessageReactionAdd(e.ChannelID, e.ID, "💬")
-			agent.ClearHistory(ctx, e.Author.Username)
-			s.ChannelMessageSendReply(e.ChannelID, "🤖 history cleared.", e.Reference())
+		rawConent := strings.TrimLeftFunc(mentionPattern.ReplaceAllString(e.Content, ""), unicode.IsSpace)
+
+		if emptyMention(e.Message, rawConent) {
+			s.ChannelMessageSendReply(e.ChannelID, helpMessage(agent, e.GuildID, e.Author.ID), e.Reference())
+			return
+		}
+
+		prefix := agent.CommandPrefix()
+		switch name, arg, _ := parseCommand(rawConent, prefix); {
+		case name == "clear" && arg == "":
+			acknowledge(s, agent, e)
+			agent.ClearHistory(ctx, e.Author.Username, scope...)
+			s.ChannelMessageSendReply(e.ChannelID, notice(agent, "history cleared."), e.Reference())
+			return
+		case name == "guild-system":
+			acknowledge(s, agent, e)
+			s.ChannelMessageSendReply(e.ChannelID, guildSystemCommand(s, e, agent, arg), e.Reference())
+			return
+		case name == "system":
+			acknowledge(s, agent, e)
+			s.ChannelMessageSendReply(e.ChannelID, systemCommand(agent, e.Author.ID, arg), e.Reference())
 			return
-		} else if rawConent == "$models" {
-			s.MessageReactionAdd(e.ChannelID, e.ID, "💬")
-			resp := fmt.Sprintf("🤖 available models: %s. begin your question with `model: `", agent.AvailableModelNames())
+		case name == "debug" && arg == "":
+			acknowledge(s, agent, e)
+			s.ChannelMessageSendReply(e.ChannelID, debugCommand(agent, e.Author.Username), e.Reference())
+			return
+		case name == "setmodel":
+			acknowledge(s, agent, e)
+			s.ChannelMessageSendReply(e.ChannelID, setModelCommand(agent, e.GuildID, e.Author.ID, arg), e.Reference())
+			return
+		case name == "mymodel" && arg == "":
+			acknowledge(s, agent, e)
+			s.ChannelMessageSendReply(e.ChannelID, myModelCommand(agent, e.GuildID, e.Author.ID), e.Reference())
+			return
+		case name == "reload" && arg == "":
+			acknowledge(s, agent, e)
+			s.ChannelMessageSendReply(e.ChannelID, reloadCommand(agent, e.Author.ID, reload), e.Reference())
+			return
+		case name == "usage":
+			acknowledge(s, agent, e)
+			s.ChannelMessageSendReply(e.ChannelID, usageCommand(agent, e.Author.Username, e.Author.ID, arg), e.Reference())
+			return
+		case name == "export":
+			acknowledge(s, agent, e)
+			exportCommand(ctx, s, e, agent, arg, scope)
+			return
+		case name == "models" && arg == "":
+			acknowledge(s, agent, e)
+			resp := notice(agent, fmt.Sprintf("available models: %s. %s", agent.AvailableModelNames(e.GuildID), modelHint(agent)))
+			if status := agent.ModelStatus(); status != "" {
+				resp += "\n" + status
+			}
 			s.ChannelMessageSendReply(e.ChannelID, resp, e.Reference())
 			return
 		}
 
-		var modelName string
-		if modelName = agent.ParseModelName(rawConent); modelName == "" {
-			if e.ReferencedMessage == nil {
+		// only the messages starting a generation are tracked, to be cancelled by deleting them
+		requests.add(e.ID, cancel)
+		defer requests.remove(e.ID)
+
+		opts := append([]aicore.QueryOption{aicore.WithGuildID(e.GuildID), aicore.WithUserName(displayName(e.Member, e.Author))}, scope...)
+		var preview bool
+		if name, arg, _ := parseCommand(rawConent, prefix); name == "preview" && arg != "" { // preview model: question, shows the request instead of sending it
+			preview, rawConent = true, arg
+		}
+		if name, arg, _ := parseCommand(rawConent, prefix); name == "once" && arg != "" { // once model: question, neither reads nor keeps the history
+			opts = append(opts, aicore.WithStateless())
+			rawConent = arg
+		}
+		if name, arg, _ := parseCommand(rawConent, prefix); name == "schema" && arg != "" { // schema <name> model: question
+			schema, rest, _ := strings.Cut(arg, " ")
+			opts = append(opts, aicore.WithSchema(schema))
+			rawConent = strings.TrimSpace(rest)
+		}
+
+		if name, arg, _ := parseCommand(rawConent, prefix); name == "continue" && arg == "" { // the model whose answer was cut goes on
+			if rawConent = continueInput(agent, e.Author.Username, scope...); rawConent == "" {
+				s.ChannelMessageSendReply(e.ChannelID, notice(agent, noTruncatedAnswer), e.Reference())
 				return
 			}
-			if modelName = agent.ParseModelName(e.ReferencedMessage.Content); modelName == "" {
+		}
+
+		var attachments, audio []*discordgo.MessageAttachment
+		for _, a := range e.Attachments {
+			if isAudioAttachment(e.Message, a) {
+				audio = append(audio, a)
+			} else {
+				attachments = append(attachments, a)
+			}
+		}
+		if len(audio) > 0 { // the transcript is the question, after the text if any
+			if !agent.TranscriptionEnabled() {
+				s.ChannelMessageSendReply(e.ChannelID, notice(agent, aicore.ErrNoTranscription.Error()+"."), e.Reference())
 				return
 			}
+			s.ChannelTyping(e.ChannelID)
+			for _, a := range audio {
+				text, err := agent.Transcribe(ctx, a.URL, a.Filename)
+				if err != nil {
+					s.ChannelMessageSendReply(e.ChannelID, notice(agent, fmt.Sprintf("cannot transcribe %s: %s", a.Filename, err)), e.Reference())
+					return
+				}
+				rawConent = strings.TrimSpace(rawConent + "\n\n" + text)
+			}
 		}
 
-		s.MessageReactionAdd(e.ChannelID, e.ID, "💬")
+		var modelName string
+		if modelName = agent.ParseModelName(rawConent, e.GuildID); modelName == "" {
+			modelName = referencedModel(agent, e.ReferencedMessage, s.State.User.ID, e.GuildID)
+		}
+		if modelName == "" {
+			modelName = agent.DefaultModel(e.GuildID, e.Author.ID)
+		}
+		if modelName == "" && len(audio) > 0 {
+			s.ChannelMessageSendReply(e.ChannelID, notice(agent, "no model to answer the voice message, send it as a reply to an answer of the model."), e.Reference())
+			return
+		}
+		if modelName == "" {
+			if selector := modelPrefix(rawConent, agent.ModelSeparator()); selector != "" {
+				resp := notice(agent, fmt.Sprintf("unknown model `%s`, available models: %s. %s", selector, agent.AvailableModelNames(e.GuildID), modelHint(agent)))
+				s.ChannelMessageSendReply(e.ChannelID, resp, e.Reference())
+			}
+			return
+		}
+
+		var roles []string
+		if e.Member != nil {
+			roles = e.Member.Roles
+		}
+		resolved, err := agent.ResolveModel(modelName, e.Author.ID, roles)
+		if err != nil {
+			s.ChannelMessageSendReply(e.ChannelID, combineModelWithErrMessage(agent, modelName, err.Error()), e.Reference())
+			return
+		}
+		modelName = resolved
+
+		if agent.IncludeReferenceContext() { // "summarize this" in reply to a message of someone else
+			var refAttachments []*discordgo.MessageAttachment
+			rawConent, refAttachments = referenceContext(agent, e.ReferencedMessage, s.State.User.ID, rawConent)
+			attachments = append(refAttachments, attachments...)
+		}
+
+		acknowledge(s, agent, e)
 		s.ChannelTyping(e.ChannelID)
 
-		var imageURLs []string
-		var resp any
-		var err error
-		if len(e.Attachments) > 0 {
-			for _, a := range e.Attachments {
-				if strings.HasSuffix(a.Filename, ".png") ||
-					strings.HasSuffix(a.Filename, ".jpg") ||
-					strings.HasSuffix(a.Filename, ".jpeg") ||
-					strings.HasSuffix(a.Filename, ".gif") ||
-					strings.HasSuffix(a.Filename, ".webp") {
-					imageURLs = append(imageURLs, a.URL)
+		var imageURLs, textURLs, pdfURLs, unsupported []string
+		var rejected []error
+		for _, a := range attachments {
+			switch {
+			case agent.IsImageFile(a.Filename):
+				if err := agent.CheckImage(a.Filename, a.Size); err != nil { // refuse oversized images before downloading them
+					rejected = append(rejected, err)
+					continue
 				}
+				imageURLs = append(imageURLs, a.URL)
+			case isPDFAttachment(a):
+				pdfURLs = append(pdfURLs, a.URL)
+			case isTextAttachment(a):
+				textURLs = append(textURLs, a.URL)
+			default:
+				unsupported = append(unsupported, a.Filename)
 			}
-			if len(imageURLs) == 0 {
-				resp = "no image found. only png, jpg, jpeg, gif or webp supported"
-			} else {
-				resp, err = agent.Query(ctx, modelName, e.Author.Username, rawConent, imageURLs)
-			}
+		}
+
+		var resp any
+		if len(unsupported) > 0 {
+			resp = fmt.Sprintf("unsupported attachment %s. only images (%s), PDFs, audio and text files (%s) supported", strings.Join(unsupported, ", "), strings.Join(agent.ImageTypes(), ", "), strings.Join(textExtensions, ", "))
+		} else if len(rejected) > 0 {
+			resp = errors.Join(rejected...).Error()
 		} else {
-			resp, err = agent.Query(ctx, modelName, e.Author.Username, rawConent, nil)
+			opts = append(opts, aicore.WithTextFiles(textURLs...), aicore.WithPDFFiles(pdfURLs...))
+			if preview {
+				previewCommand(ctx, s, e, agent, modelName, rawConent, imageURLs, opts)
+				return
+			}
+			resp, err = agent.Query(ctx, modelName, e.Author.Username, rawConent, imageURLs, opts...)
 		}
 
 		if err != nil {
-			s.ChannelMessageSendReply(e.ChannelID, combineModelWithErrMessage(modelName, err.Error()), e.Reference())
+			s.ChannelMessageSendReply(e.ChannelID, combineModelWithErrMessage(agent, modelName, err.Error()), e.Reference())
 			return
 		}
 
 		switch output := resp.(type) {
 		case string:
-			s.ChannelMessageSendReply(e.ChannelID, combineModelWithErrMessage(modelName, output), e.Reference())
-		case <-chan string:
-			message := combineModelWithMessage(modelName, "")
-			messageObj, _ := s.ChannelMessageSendReply(e.ChannelID, "✏️ ...", e.Reference())
-			s.ChannelTyping(e.ChannelID)
-
-			tk := time.NewTicker(1 * time.Second)
-		L:
-			for {
-				select {
-				case <-tk.C:
-					s.ChannelTyping(e.ChannelID)
-					umessage := []rune(message)
-					if len(umessage) <= 2000 {
-						s.ChannelMessageEdit(e.ChannelID, messageObj.ID, message)
-						continue
-					}
-
-					s.ChannelMessageEdit(e.ChannelID, messageObj.ID, string(umessage[:2000]))
-					message = combineModelWithMessage(modelName, "⏩ ") + string(umessage[2000:])
-					messageObj, _ = s.ChannelMessageSendReply(e.ChannelID, message, e.Reference())
-				case chunk, ok := <-output:
-					if !ok {
-						time.Sleep(1 * time.Second) // discord 429 case
-						umessage := []rune(message)
-						if len(umessage) <= 2000 {
-							s.ChannelMessageEdit(e.ChannelID, messageObj.ID, message)
-							return
-						}
-						message = string(umessage[2000:])
-						s.ChannelMessageSendReply(e.ChannelID, message, e.Reference())
-						tk.Stop()
-						break L
-					}
-					message += chunk
-				}
-			}
+			s.ChannelMessageSendReply(e.ChannelID, combineModelWithErrMessage(agent, modelName, output), e.Reference())
+		case <-chan aicore.Chunk:
+			r := &messageReplier{s: s, e: e, requests: requests}
+			streamReply(r, modelName, output, newStreamOptions(agent, modelName, agent.ReplyMode()))
+			r.removeCancelReactions()
 		}
 	}
 }
+
+// isThread reports whether the channel is a thread, the state cache is consulted
+// before asking discord.
+func isThread(s *discordgo.Session, channelID string) bool {
+	ch, err := lookupChannel(s, channelID)
+	if err != nil {
+		slog.Warn("[isThread] cannot get channel", "channel", channelID, "error", err)
+		return false
+	}
+	return ch.IsThread()
+}
+
+// emptyMention reports whether the message only mentions the bot, content is its
+// text without the mentions: there is neither a question, nor an attachment, nor
+// a message it replies to.
+func emptyMention(m *discordgo.Message, content string) bool {
+	return strings.TrimSpace(content) == "" && len(m.Attachments) == 0 && m.ReferencedMessage == nil
+}
+
+// lookupChannel returns the channel from the state, or from the API if it isn't cached.
+func lookupChannel(s *discordgo.Session, channelID string) (*discordgo.Channel, error) {
+	if ch, err := s.State.Channel(channelID); err == nil {
+		return ch, nil
+	}
+	return s.Channel(channelID)
+}
+
+// channelAllowed reports whether the bot answers in the channel of the guild, see
+// aicore.LLMAgent.ChannelAllowed. The channel is only looked up for the parent of
+// a thread when it isn't listed itself.
+func channelAllowed(s *discordgo.Session, agent *aicore.LLMAgent, guildID, channelID string) bool {
+	if agent.ChannelAllowed(guildID, channelID, "") {
+		return true
+	}
+	ch, err := lookupChannel(s, channelID)
+	if err != nil {
+		slog.Warn("[channelAllowed] cannot get channel", "channel", channelID, "error", err)
+		return false
+	}
+	return ch.IsThread() && agent.ChannelAllowed(guildID, channelID, ch.ParentID)
+}
+
+// textExtensions are the extensions of attachments read as text.
+var textExtensions = []string{"txt", "md", "log", "csv", "json", "yaml", "yml"}
+
+func isTextAttachment(a *discordgo.MessageAttachment) bool {
+	if strings.HasPrefix(a.ContentType, "text/") {
+		return true
+	}
+	return slices.Contains(textExtensions, strings.ToLower(strings.TrimPrefix(path.Ext(a.Filename), ".")))
+}
+
+func isPDFAttachment(a *discordgo.MessageAttachment) bool {
+	return a.ContentType == "application/pdf" || strings.EqualFold(path.Ext(a.Filename), ".pdf")
+}
+
+// audioExtensions are the extensions of attachments transcribed as questions.
+var audioExtensions = []string{"ogg", "oga", "mp3", "mpga", "m4a", "wav", "flac"}
+
+// isAudioAttachment reports whether a is audio, like the .ogg file of a voice message.
+func isAudioAttachment(m *discordgo.Message, a *discordgo.MessageAttachment) bool {
+	if m.Flags&discordgo.MessageFlagsIsVoiceMessage != 0 || strings.HasPrefix(a.ContentType, "audio/") {
+		return true
+	}
+	return slices.Contains(audioExtensions, strings.ToLower(strings.TrimPrefix(path.Ext(a.Filename), ".")))
+}
+
+// messageReplier streams the answer to a message, its replies can be cancelled
+// by the requester with cancelEmoji while streaming if requests is set.
+type messageReplier struct {
+	s        *discordgo.Session
+	e        *discordgo.MessageCreate
+	requests *inflight
+	replies  []string
+}
+
+// maxRetryAfter caps the wait for a rate limited call, the call is given up beyond,
+// as the next edit of a streamed answer supersedes it anyway.
+const maxRetryAfter = 10 * time.Second
+
+// retryAfter returns how long discord asks to wait before retrying the call that
+// failed with err, and false if err is not a rate limit.
+func retryAfter(err error) (time.Duration, bool) {
+	var rl *discordgo.RateLimitError
+	if !errors.As(err, &rl) || rl.RateLimit == nil || rl.TooManyRequests == nil {
+		return 0, false
+	}
+	return rl.RetryAfter, true
+}
+
+// withRetryAfter makes the call with discordgo's own retry off, and once more after
+// the retry-after if discord rate limits it.
+func withRetryAfter(call func(options ...discordgo.RequestOption) error) error {
+	noRetry := discordgo.WithRetryOnRatelimit(false)
+	err := call(noRetry)
+	if d, ok := retryAfter(err); ok && d <= maxRetryAfter {
+		slog.Debug("[withRetryAfter] rate limited", "retry_after", d)
+		time.Sleep(d)
+		err = call(noRetry)
+	}
+	return err
+}
+
+func (r *messageReplier) send(content string) (string, error) {
+	var m *discordgo.Message
+	err := withRetryAfter(func(options ...discordgo.RequestOption) (err error) {
+		m, err = r.s.ChannelMessageSendReply(r.e.ChannelID, content, r.e.Reference(), options...)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if r.requests != nil {
+		r.requests.addReply(m.ID, r.e.ID, r.e.Author.ID)
+		r.replies = append(r.replies, m.ID)
+		r.s.MessageReactionAdd(r.e.ChannelID, m.ID, cancelEmoji)
+	}
+	return m.ID, nil
+}
+
+// removeCancelReactions removes cancelEmoji from the replies once the answer is done.
+func (r *messageReplier) removeCancelReactions() {
+	for _, id := range r.replies {
+		r.s.MessageReactionRemove(r.e.ChannelID, id, cancelEmoji, "@me")
+	}
+}
+
+func (r *messageReplier) edit(id, content string) error {
+	return withRetryAfter(func(options ...discordgo.RequestOption) error {
+		_, err := r.s.ChannelMessageEdit(r.e.ChannelID, id, content, options...)
+		return err
+	})
+}
+
+func (r *messageReplier) attach(name string, data []byte) error {
+	_, err := r.s.ChannelMessageSendComplex(r.e.ChannelID, &discordgo.MessageSend{
+		Files:     []*discordgo.File{{Name: name, Reader: bytes.NewReader(data)}},
+		Reference: r.e.Reference(),
+	})
+	return err
+}
+
+func (r *messageReplier) typing() {
+	r.s.ChannelTyping(r.e.ChannelID)
+}
+
+func (r *messageReplier) limit() int {
+	return discordMessageLimit
+}
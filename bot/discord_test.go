@@ -0,0 +1,400 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/douglarek/llmverse/aicore"
+	"github.com/douglarek/llmverse/config"
+)
+
+// the handlers must keep the signatures discordgo dispatches on, or AddHandler
+// silently ignores them.
+var (
+	_ func(*discordgo.Session, *discordgo.Ready)              = botReady
+	_ func(*discordgo.Session, *discordgo.MessageCreate)      = messageCreate(nil, nil, nil)
+	_ func(*discordgo.Session, *discordgo.MessageDelete)      = messageDelete(nil)
+	_ func(*discordgo.Session, *discordgo.MessageReactionAdd) = messageReactionAdd(nil)
+	_ func(*discordgo.Session, *discordgo.InteractionCreate)  = interactionCreate(nil)
+	_ replier                                                 = (*messageReplier)(nil)
+	_ replier                                                 = (*interactionReplier)(nil)
+	_ replier                                                 = (*telegramReplier)(nil)
+	_ replier                                                 = (*slackReplier)(nil)
+)
+
+func TestMessageCreate_IgnoresOwnMessages(t *testing.T) {
+	s := &discordgo.Session{State: discordgo.NewState()}
+	s.State.User = &discordgo.User{ID: "bot"}
+
+	requests := newInflight()
+	handler := messageCreate(&aicore.LLMAgent{}, requests, nil)
+	handler(s, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID:      "1",
+		Author:  &discordgo.User{ID: "bot"},
+		Content: "openai: hello",
+	}})
+
+	if requests.cancel("1") {
+		t.Fatal("the request of the handled message must be removed")
+	}
+}
+
+func TestReferencedModel(t *testing.T) {
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [
+		{"name": "openai", "api_key": "xxx", "enabled": true},
+		{"name": "groq", "api_key": "xxx", "enabled": true}
+	]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	agent := aicore.NewLLMAgent(settings)
+
+	bot, user := &discordgo.User{ID: "bot"}, &discordgo.User{ID: "user"}
+	tests := []struct {
+		ref  *discordgo.Message
+		want string
+	}{
+		{&discordgo.Message{Author: bot, Content: combineModelWithMessage("groq", "the sky is blue")}, "groq"},
+		{&discordgo.Message{Author: bot, Content: combineModelWithMessage("openai", "⏩ the rest")}, "openai"},
+		{&discordgo.Message{Author: bot, Content: combineModelWithErrMessage(agent, "openai", "rate limited")}, "openai"},
+		{&discordgo.Message{Author: user, Content: "<@bot> groq: why is the sky blue?"}, "groq"},
+		{&discordgo.Message{Author: user, Content: "<@bot> why is the sky blue?"}, ""},
+		{&discordgo.Message{Author: bot, Content: "🤖 history cleared."}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := referencedModel(agent, tt.ref, "bot", ""); got != tt.want {
+			t.Errorf("referencedModel(%+v) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestReloadCommand(t *testing.T) {
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "admins": ["admin"], "models": [
+		{"name": "openai", "api_key": "xxx", "enabled": true}
+	]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	agent := aicore.NewLLMAgent(settings)
+
+	var h reloadHook
+	if got := reloadCommand(agent, "admin", h.reload); got != "🤖 cannot reload the config: reloading is not available" {
+		t.Errorf("got %q without a reloader", got)
+	}
+
+	var calls int
+	h.SetReloader(func() error { calls++; return nil })
+	if got := reloadCommand(agent, "user", h.reload); got != "🤖 only admins can reload the config." || calls != 0 {
+		t.Errorf("got %q and %d calls for a non-admin", got, calls)
+	}
+	if got := reloadCommand(agent, "admin", h.reload); got != "🤖 config reloaded." || calls != 1 {
+		t.Errorf("got %q and %d calls for an admin", got, calls)
+	}
+
+	h.SetReloader(func() error { return errors.New("no models enabled") })
+	if got := reloadCommand(agent, "admin", h.reload); got != "🤖 cannot reload the config: no models enabled" {
+		t.Errorf("got %q for an invalid config", got)
+	}
+}
+
+func TestSetModelCommand(t *testing.T) {
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "default_model": "openai", "models": [
+		{"name": "openai", "api_key": "xxx", "enabled": true},
+		{"name": "groq", "api_key": "xxx", "enabled": true}
+	]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	agent := aicore.NewLLMAgent(settings)
+
+	if got := myModelCommand(agent, "", "alice"); !strings.Contains(got, "default model `openai`") {
+		t.Errorf("got %q, want the default model", got)
+	}
+	if got := setModelCommand(agent, "", "alice", "mistral"); !strings.Contains(got, "unknown model") {
+		t.Errorf("got %q, want mistral unknown", got)
+	}
+	if got := setModelCommand(agent, "", "alice", "groq"); !strings.Contains(got, "`groq` answers") {
+		t.Errorf("got %q, want groq set", got)
+	}
+	if got := myModelCommand(agent, "", "alice"); got != "🤖 your model is `groq`." {
+		t.Errorf("got %q, want groq", got)
+	}
+	if got := myModelCommand(agent, "", "bob"); !strings.Contains(got, "default model `openai`") {
+		t.Errorf("got %q for bob, want the default model", got)
+	}
+	setModelCommand(agent, "", "alice", "none")
+	if got := agent.PreferredModel("alice"); got != "" {
+		t.Errorf("got model %q, want it forgotten", got)
+	}
+}
+
+func TestChannelAllowed(t *testing.T) {
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "allowed_channels": ["c1"]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	agent := aicore.NewLLMAgent(settings)
+
+	s := &discordgo.Session{State: discordgo.NewState()}
+	s.State.GuildAdd(&discordgo.Guild{ID: "g1"})
+	for _, ch := range []*discordgo.Channel{
+		{ID: "c1", GuildID: "g1", Type: discordgo.ChannelTypeGuildText},
+		{ID: "c2", GuildID: "g1", Type: discordgo.ChannelTypeGuildText},
+		{ID: "t1", GuildID: "g1", Type: discordgo.ChannelTypeGuildPublicThread, ParentID: "c1"},
+		{ID: "t2", GuildID: "g1", Type: discordgo.ChannelTypeGuildPublicThread, ParentID: "c2"},
+	} {
+		if err := s.State.ChannelAdd(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		guild, channel string
+		want           bool
+	}{
+		{"g1", "c1", true},
+		{"g1", "c2", false},
+		{"g1", "t1", true},
+		{"g1", "t2", false},
+		{"", "dm", true},
+	}
+	for _, tt := range tests {
+		if got := channelAllowed(s, agent, tt.guild, tt.channel); got != tt.want {
+			t.Errorf("channelAllowed(%q, %q) = %v, want %v", tt.guild, tt.channel, got, tt.want)
+		}
+	}
+}
+
+func TestEmptyMention(t *testing.T) {
+	attachment := []*discordgo.MessageAttachment{{Filename: "photo.png"}}
+	tests := []struct {
+		m    *discordgo.Message
+		want bool
+	}{
+		{&discordgo.Message{Content: "<@bot>"}, true},
+		{&discordgo.Message{Content: "<@bot>  \n"}, true},
+		{&discordgo.Message{Content: "<@bot> <@other>"}, true},
+		{&discordgo.Message{Content: "<@bot> openai: hi"}, false},
+		{&discordgo.Message{Content: "<@bot>", Attachments: attachment}, false},
+		{&discordgo.Message{Content: "<@bot>", ReferencedMessage: &discordgo.Message{Content: "why?"}}, false},
+	}
+	for _, tt := range tests {
+		if got := emptyMention(tt.m, mentionPattern.ReplaceAllString(tt.m.Content, "")); got != tt.want {
+			t.Errorf("emptyMention(%q) = %v, want %v", tt.m.Content, got, tt.want)
+		}
+	}
+}
+
+func TestAckEmoji(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+		ok     bool
+	}{
+		{``, "💬", true},
+		{`"ack_emoji": "👀",`, "👀", true},
+		{`"ack_emoji": "",`, "", false},
+		{`"ack_emoji": "<:thinking:123456>",`, "thinking:123456", true},
+		{`"ack_emoji": "<a:spinner:654321>",`, "spinner:654321", true},
+		{`"ack_emoji": "thinking:123456",`, "thinking:123456", true},
+	}
+	for _, tt := range tests {
+		var settings config.Settings
+		if err := json.Unmarshal([]byte(`{`+tt.config+` "discord_bot_token": "xxxx", "models": [
+			{"name": "openai", "api_key": "xxx", "enabled": true}
+		]}`), &settings); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := ackEmoji(aicore.NewLLMAgent(settings)); got != tt.want || ok != tt.ok {
+			t.Errorf("ackEmoji(%s) = %q, %v, want %q, %v", tt.config, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNotice(t *testing.T) {
+	for _, tt := range []struct{ config, want string }{
+		{``, "🤖 history cleared."},
+		{`"notice_prefix": "[bot]",`, "[bot] history cleared."},
+		{`"notice_prefix": "",`, "history cleared."},
+	} {
+		var settings config.Settings
+		if err := json.Unmarshal([]byte(`{`+tt.config+` "discord_bot_token": "xxxx", "models": [
+			{"name": "openai", "api_key": "xxx", "enabled": true}
+		]}`), &settings); err != nil {
+			t.Fatal(err)
+		}
+		agent := aicore.NewLLMAgent(settings)
+		if got := notice(agent, "history cleared."); got != tt.want {
+			t.Errorf("notice(%s) = %q, want %q", tt.config, got, tt.want)
+		}
+		if got, want := combineModelWithErrMessage(agent, "openai", "history cleared."), "openai: "+tt.want; got != want {
+			t.Errorf("combineModelWithErrMessage(%s) = %q, want %q", tt.config, got, want)
+		}
+	}
+}
+
+func TestHelpMessage(t *testing.T) {
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [
+		{"name": "openai", "api_key": "xxx", "enabled": true}
+	]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	agent := aicore.NewLLMAgent(settings)
+
+	got := helpMessage(agent, "", "alice")
+	for _, want := range []string{"`openai: why is the sky blue?`", "`$models`", "`$clear`", "available models: `openai`"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got help %q, want %s in it", got, want)
+		}
+	}
+
+	settings.HelpMessage = "ask the admins"
+	if err := agent.Reload(settings); err != nil {
+		t.Fatal(err)
+	}
+	if got := helpMessage(agent, "", "alice"); got != "ask the admins" {
+		t.Errorf("got help %q, want help_message", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	rateLimited := &discordgo.RateLimitError{RateLimit: &discordgo.RateLimit{TooManyRequests: &discordgo.TooManyRequests{RetryAfter: 300 * time.Millisecond}}}
+	tests := []struct {
+		err  error
+		want time.Duration
+		ok   bool
+	}{
+		{rateLimited, 300 * time.Millisecond, true},
+		{fmt.Errorf("edit failed: %w", rateLimited), 300 * time.Millisecond, true},
+		{&discordgo.RateLimitError{}, 0, false},
+		{errors.New("unknown message"), 0, false},
+		{nil, 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := retryAfter(tt.err); got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%v) = %v, %v, want %v, %v", tt.err, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestWithRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		retryAfter time.Duration
+		wantCalls  int
+	}{
+		{10 * time.Millisecond, 2},
+		{maxRetryAfter + time.Second, 1}, // given up
+	} {
+		var calls int
+		err := withRetryAfter(func(options ...discordgo.RequestOption) error {
+			if len(options) != 1 {
+				t.Fatalf("got %d options, want discordgo's retry turned off", len(options))
+			}
+			if calls++; calls == 1 {
+				return &discordgo.RateLimitError{RateLimit: &discordgo.RateLimit{TooManyRequests: &discordgo.TooManyRequests{RetryAfter: tt.retryAfter}}}
+			}
+			return nil
+		})
+		if calls != tt.wantCalls || (err == nil) != (tt.wantCalls == 2) {
+			t.Errorf("retry after %v: got %d calls and error %v, want %d calls", tt.retryAfter, calls, err, tt.wantCalls)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		content, prefix string
+		name, arg       string
+		ok              bool
+	}{
+		{"$clear", "$", "clear", "", true},
+		{"$usage  reset ", "$", "usage", "reset", true},
+		{"$system\nbe brief", "$", "system", "be brief", true},
+		{"!clear", "!", "clear", "", true},
+		{"!!models", "!!", "models", "", true},
+		{"$clear", "!", "", "", false},
+		{"clear", "$", "", "", false},
+		{"$", "$", "", "", false},
+	}
+	for _, tt := range tests {
+		name, arg, ok := parseCommand(tt.content, tt.prefix)
+		if name != tt.name || arg != tt.arg || ok != tt.ok {
+			t.Errorf("parseCommand(%q, %q) = %q, %q, %v, want %q, %q, %v", tt.content, tt.prefix, name, arg, ok, tt.name, tt.arg, tt.ok)
+		}
+	}
+}
+
+func TestIsTextAttachment(t *testing.T) {
+	tests := []struct {
+		a    *discordgo.MessageAttachment
+		want bool
+	}{
+		{&discordgo.MessageAttachment{Filename: "notes", ContentType: "text/plain"}, true},
+		{&discordgo.MessageAttachment{Filename: "NOTES.TXT"}, true},
+		{&discordgo.MessageAttachment{Filename: "README.MD"}, true},
+		{&discordgo.MessageAttachment{Filename: "photo.png", ContentType: "image/png"}, false},
+	}
+	for _, tt := range tests {
+		if got := isTextAttachment(tt.a); got != tt.want {
+			t.Errorf("isTextAttachment(%s) = %v, want %v", tt.a.Filename, got, tt.want)
+		}
+	}
+}
+
+func TestIsAudioAttachment(t *testing.T) {
+	voice := &discordgo.Message{Flags: discordgo.MessageFlagsIsVoiceMessage}
+	tests := []struct {
+		m    *discordgo.Message
+		a    *discordgo.MessageAttachment
+		want bool
+	}{
+		{voice, &discordgo.MessageAttachment{Filename: "voice-message.ogg", ContentType: "audio/ogg"}, true},
+		{&discordgo.Message{}, &discordgo.MessageAttachment{Filename: "song.MP3"}, true},
+		{&discordgo.Message{}, &discordgo.MessageAttachment{Filename: "clip", ContentType: "audio/wav"}, true},
+		{&discordgo.Message{}, &discordgo.MessageAttachment{Filename: "notes.txt", ContentType: "text/plain"}, false},
+	}
+	for _, tt := range tests {
+		if got := isAudioAttachment(tt.m, tt.a); got != tt.want {
+			t.Errorf("isAudioAttachment(%s) = %v, want %v", tt.a.Filename, got, tt.want)
+		}
+	}
+}
+
+func TestReferenceContext(t *testing.T) {
+	var settings config.Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [{"name": "openai", "api_key": "xxx", "enabled": true}]}`), &settings); err != nil {
+		t.Fatal(err)
+	}
+	agent := aicore.NewLLMAgent(settings)
+
+	bot, alice := &discordgo.User{ID: "bot"}, &discordgo.User{ID: "alice", Username: "alice"}
+	ref := &discordgo.Message{Author: alice, Content: "<@bot> the meeting moved\nto friday", Attachments: []*discordgo.MessageAttachment{
+		{Filename: "agenda.pdf", ContentType: "application/pdf"},
+		{Filename: "photo.png"},
+		{Filename: "video.mp4"},
+	}}
+
+	input, attachments := referenceContext(agent, ref, "bot", "openai: summarize this")
+	if want := "alice wrote, in the message I reply to:\n> the meeting moved\n> to friday\n\nopenai: summarize this"; input != want {
+		t.Fatalf("got input %q, want %q", input, want)
+	}
+	if len(attachments) != 2 || attachments[0].Filename != "agenda.pdf" || attachments[1].Filename != "photo.png" {
+		t.Fatalf("got attachments %v, want the PDF and the image", attachments)
+	}
+
+	for _, ref := range []*discordgo.Message{nil, {Author: bot, Content: "openai: an answer"}} {
+		if input, attachments := referenceContext(agent, ref, "bot", "openai: hi"); input != "openai: hi" || attachments != nil {
+			t.Errorf("got %q, %v, want the input alone", input, attachments)
+		}
+	}
+	if input, _ := referenceContext(agent, &discordgo.Message{Author: alice, Content: "<@bot>"}, "bot", "openai: hi"); input != "openai: hi" {
+		t.Errorf("got %q, want nothing quoted for an empty message", input)
+	}
+}
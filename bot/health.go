@@ -0,0 +1,33 @@
+package bot
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/douglarek/llmverse/aicore"
+)
+
+// HealthHandler answers 200 if all checks pass, 503 with the failures otherwise.
+func HealthHandler(checks ...func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var errs []error
+		for _, check := range checks {
+			if err := check(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// checkModels fails if none of the models of agent could be built.
+func checkModels(agent *aicore.LLMAgent) error {
+	if len(agent.ModelNames()) == 0 {
+		return errors.New("no model is available")
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"context"
+	"sync"
+)
+
+// inflight tracks the cancel funcs of the generations in progress by the id of
+// the message that started them, and the replies they stream into.
+type inflight struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+	replies map[string]inflightReply // by the id of the reply
+}
+
+// inflightReply is a reply being streamed for the request message of user.
+type inflightReply struct {
+	request string
+	user    string
+}
+
+func newInflight() *inflight {
+	return &inflight{cancels: make(map[string]context.CancelFunc), replies: make(map[string]inflightReply)}
+}
+
+func (f *inflight) add(id string, cancel context.CancelFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancels[id] = cancel
+}
+
+func (f *inflight) remove(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.cancels, id)
+	for k, v := range f.replies {
+		if v.request == id {
+			delete(f.replies, k)
+		}
+	}
+}
+
+// addReply records that the generation started by the message request of user
+// streams into the message reply.
+func (f *inflight) addReply(reply, request, user string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies[reply] = inflightReply{request: request, user: user}
+}
+
+// cancelReply stops the generation streaming into the message reply if user
+// started it, and reports whether it did.
+func (f *inflight) cancelReply(reply, user string) bool {
+	f.mu.Lock()
+	r, ok := f.replies[reply]
+	f.mu.Unlock()
+
+	if !ok || r.user != user {
+		return false
+	}
+	return f.cancel(r.request)
+}
+
+// cancel stops the generation started by the message id, and reports whether
+// there was one.
+func (f *inflight) cancel(id string) bool {
+	f.mu.Lock()
+	cancel, ok := f.cancels[id]
+	delete(f.cancels, id)
+	f.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
@@ -0,0 +1,31 @@
+package bot
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInflight_CancelReply(t *testing.T) {
+	requests := newInflight()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requests.add("request", cancel)
+	requests.addReply("reply", "request", "alice")
+
+	if requests.cancelReply("reply", "bob") || ctx.Err() != nil {
+		t.Fatal("only the requester may cancel the generation")
+	}
+	if requests.cancelReply("other", "alice") {
+		t.Fatal("want no generation cancelled for an unknown reply")
+	}
+	if !requests.cancelReply("reply", "alice") || ctx.Err() == nil {
+		t.Fatal("want the generation cancelled by the requester")
+	}
+
+	requests.add("request2", func() {})
+	requests.addReply("reply2", "request2", "alice")
+	requests.remove("request2")
+	if requests.cancelReply("reply2", "alice") {
+		t.Fatal("want the replies forgotten once the request is done")
+	}
+}
@@ -0,0 +1,40 @@
+package bot
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/douglarek/llmverse/aicore"
+)
+
+// track counts the calls of the discord event handler h in requests while they run.
+func track[T any](requests *sync.WaitGroup, h func(*discordgo.Session, T)) func(*discordgo.Session, T) {
+	return func(s *discordgo.Session, e T) {
+		requests.Add(1)
+		defer requests.Done()
+		h(s, e)
+	}
+}
+
+// shutdown stops the generations of agent in progress and waits up to the shutdown
+// timeout for the handlers in requests to post what was answered so far. No new
+// handler must be started once it is called.
+func shutdown(agent *aicore.LLMAgent, requests *sync.WaitGroup) {
+	deadline := time.Now().Add(agent.ShutdownTimeout())
+	if !agent.Shutdown(time.Until(deadline)) {
+		slog.Warn("[shutdown] generations still running after the shutdown timeout")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		requests.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		slog.Warn("[shutdown] replies still being posted after the shutdown timeout")
+	}
+}
@@ -0,0 +1,412 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/douglarek/llmverse/aicore"
+	"github.com/douglarek/llmverse/config"
+	"github.com/gorilla/websocket"
+)
+
+// slackMessageLimit is the number of characters a slack answer is split at, slack
+// truncates longer messages.
+const slackMessageLimit = 4000
+
+type slackEvent struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype"`
+	User        string `json:"user"`
+	BotID       string `json:"bot_id"`
+	Text        string `json:"text"`
+	Team        string `json:"team"`
+	Channel     string `json:"channel"`
+	ChannelType string `json:"channel_type"`
+	TS          string `json:"ts"`
+	ThreadTS    string `json:"thread_ts"`
+}
+
+// slackEnvelope is a message of the Socket Mode connection.
+type slackEnvelope struct {
+	Type       string `json:"type"`
+	EnvelopeID string `json:"envelope_id"`
+	Payload    struct {
+		Event slackEvent `json:"event"`
+	} `json:"payload"`
+}
+
+// Slack is a slack app receiving events over Socket Mode and answering with the Web API.
+type Slack struct {
+	reloadHook
+	botToken  string
+	appToken  string
+	client    *http.Client
+	userID    string // of the bot
+	agent     *aicore.LLMAgent
+	connected atomic.Bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	requests  sync.WaitGroup // the handlers running, waited for on close
+}
+
+// Healthy fails if the Socket Mode connection is down or no model is available.
+func (b *Slack) Healthy() error {
+	if !b.connected.Load() {
+		return errors.New("slack socket is not connected")
+	}
+	return checkModels(b.agent)
+}
+
+// Close stops receiving messages, then interrupts the answers in progress and
+// waits for them to be posted.
+func (b *Slack) Close() error {
+	b.cancel()
+	<-b.done
+	shutdown(b.agent, &b.requests)
+	return nil
+}
+
+// NewSlack starts the bot answering with agent, which may be shared with the
+// other front-ends.
+func NewSlack(settings config.Settings, agent *aicore.LLMAgent) (*Slack, error) {
+	b := &Slack{
+		botToken: settings.SlackBotToken,
+		appToken: settings.SlackAppToken,
+		client:   &http.Client{Timeout: 1 * time.Minute},
+		agent:    agent,
+		done:     make(chan struct{}),
+	}
+
+	var auth struct {
+		UserID string `json:"user_id"`
+	}
+	if err := b.call(context.Background(), b.botToken, "auth.test", nil, &auth); err != nil {
+		return nil, err
+	}
+	b.userID = auth.UserID
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go b.listen(ctx)
+
+	slog.Info("[main]: slack bot is ready", "user", b.userID)
+	return b, nil
+}
+
+// call invokes a Web API method with the token and decodes the response into result if not nil.
+func (b *Slack) call(ctx context.Context, token, method string, params url.Values, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://slack.com/api/"+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var data json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return err
+	}
+	var r struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	if !r.OK {
+		return errors.New("slack " + method + ": " + r.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// listen keeps a Socket Mode connection open until ctx is done.
+func (b *Slack) listen(ctx context.Context) {
+	defer close(b.done)
+
+	for ctx.Err() == nil {
+		if err := b.serve(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("[slack.listen] connection failed", "error", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// serve handles the events of one Socket Mode connection, it returns nil when
+// slack asks to reconnect.
+func (b *Slack) serve(ctx context.Context) error {
+	var open struct {
+		URL string `json:"url"`
+	}
+	if err := b.call(ctx, b.appToken, "apps.connections.open", nil, &open); err != nil {
+		return err
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, open.URL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() }) // unblock the read on close
+	defer stop()
+
+	b.connected.Store(true)
+	defer b.connected.Store(false)
+
+	for {
+		var env slackEnvelope
+		if err := conn.ReadJSON(&env); err != nil {
+			return err
+		}
+
+		switch env.Type {
+		case "disconnect":
+			return nil
+		case "events_api":
+			if err := conn.WriteJSON(map[string]string{"envelope_id": env.EnvelopeID}); err != nil {
+				return err
+			}
+			if b.shouldAnswer(env.Payload.Event) {
+				b.requests.Add(1)
+				go func() {
+					defer b.requests.Done()
+					b.handleEvent(env.Payload.Event)
+				}()
+			}
+		}
+	}
+}
+
+// shouldAnswer reports whether the event is a mention of the bot in a channel or a
+// direct message to it, from a person.
+func (b *Slack) shouldAnswer(e slackEvent) bool {
+	if e.BotID != "" || e.Subtype != "" || e.User == "" || e.User == b.userID {
+		return false
+	}
+	switch e.Type {
+	case "app_mention":
+		return !strings.HasPrefix(e.Channel, "D") // a mention in a DM comes as a message too
+	case "message":
+		return e.ChannelType == "im"
+	}
+	return false
+}
+
+func (b *Slack) handleEvent(e slackEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	agent := b.agent
+	team := e.Team // the workspaces are checked as guilds, and the im channels as direct messages
+	if e.ChannelType == "im" {
+		team = ""
+	}
+	if !agent.IsAllowed(team, e.User) {
+		slog.Info("[slack.handleEvent] ignored message from a user not allowed", "team", e.Team, "user", e.User)
+		return
+	}
+
+	threadTS := e.ThreadTS
+	if threadTS == "" {
+		threadTS = e.TS // answer in a thread of the message
+	}
+	r := &slackReplier{b: b, channel: e.Channel, threadTS: threadTS}
+	reply := func(text string) { r.send(text) }
+
+	rawContent := strings.TrimSpace(strings.ReplaceAll(e.Text, "<@"+b.userID+">", ""))
+	if rawContent == "" { // only the mention
+		reply(helpMessage(agent, "", e.User))
+		return
+	}
+	scope := []aicore.QueryOption{aicore.WithChannelID(e.Channel)}
+	if e.ThreadTS != "" {
+		scope = append(scope, aicore.WithThreadID(e.ThreadTS))
+	}
+
+	prefix := agent.CommandPrefix()
+	switch name, arg, _ := parseCommand(rawContent, prefix); {
+	case name == "clear" && arg == "":
+		agent.ClearHistory(ctx, e.User, scope...)
+		reply(notice(agent, "history cleared."))
+		return
+	case name == "usage":
+		reply(usageCommand(agent, e.User, e.User, arg))
+		return
+	case name == "debug" && arg == "":
+		reply(debugCommand(agent, e.User))
+		return
+	case name == "setmodel":
+		reply(setModelCommand(agent, "", e.User, arg))
+		return
+	case name == "mymodel" && arg == "":
+		reply(myModelCommand(agent, "", e.User))
+		return
+	case name == "reload" && arg == "":
+		reply(reloadCommand(agent, e.User, b.reload))
+		return
+	case name == "models" && arg == "":
+		resp := notice(agent, fmt.Sprintf("available models: %s. %s", agent.AvailableModelNames(""), modelHint(agent)))
+		if status := agent.ModelStatus(); status != "" {
+			resp += "\n" + status
+		}
+		reply(resp)
+		return
+	case name == "system":
+		reply(systemCommand(agent, e.User, arg))
+		return
+	}
+
+	opts := scope
+	if name, arg, _ := parseCommand(rawContent, prefix); name == "once" && arg != "" { // once model: question, neither reads nor keeps the history
+		opts, rawContent = append(opts, aicore.WithStateless()), arg
+	}
+
+	if name, arg, _ := parseCommand(rawContent, prefix); name == "continue" && arg == "" { // the model whose answer was cut goes on
+		if rawContent = continueInput(agent, e.User, scope...); rawContent == "" {
+			reply(notice(agent, noTruncatedAnswer))
+			return
+		}
+	}
+
+	modelName := agent.ParseModelName(rawContent, "")
+	if modelName == "" {
+		modelName = agent.DefaultModel("", e.User)
+	}
+	if modelName == "" {
+		if selector := modelPrefix(rawContent, agent.ModelSeparator()); selector != "" {
+			reply(notice(agent, fmt.Sprintf("unknown model `%s`, available models: %s. %s", selector, agent.AvailableModelNames(""), modelHint(agent))))
+		}
+		return
+	}
+
+	resolved, err := agent.ResolveModel(modelName, e.User, nil)
+	if err != nil {
+		reply(combineModelWithErrMessage(agent, modelName, err.Error()))
+		return
+	}
+	modelName = resolved
+
+	output, err := agent.Query(ctx, modelName, e.User, rawContent, nil, opts...)
+	if err != nil {
+		reply(combineModelWithErrMessage(agent, modelName, err.Error()))
+		return
+	}
+
+	streamReply(r, modelName, output, newStreamOptions(agent, modelName, config.ReplyModeEdit))
+}
+
+// slackReplier answers in the thread of a message.
+type slackReplier struct {
+	b        *Slack
+	channel  string
+	threadTS string
+}
+
+func (r *slackReplier) send(content string) (string, error) {
+	var m struct {
+		TS string `json:"ts"`
+	}
+	params := url.Values{"channel": {r.channel}, "thread_ts": {r.threadTS}, "text": {toSlackMarkdown(content)}}
+	if err := r.b.call(context.Background(), r.b.botToken, "chat.postMessage", params, &m); err != nil {
+		return "", err
+	}
+	return m.TS, nil
+}
+
+func (r *slackReplier) edit(id, content string) error {
+	params := url.Values{"channel": {r.channel}, "ts": {id}, "text": {toSlackMarkdown(content)}}
+	return r.b.call(context.Background(), r.b.botToken, "chat.update", params, nil)
+}
+
+// attach uploads the file with the external upload flow and shares it in the thread.
+func (r *slackReplier) attach(name string, data []byte) error {
+	ctx := context.Background()
+
+	var upload struct {
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	params := url.Values{"filename": {name}, "length": {strconv.Itoa(len(data))}}
+	if err := r.b.call(ctx, r.b.botToken, "files.getUploadURLExternal", params, &upload); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upload.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := r.b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("failed to upload file: " + resp.Status)
+	}
+
+	files, _ := json.Marshal([]map[string]string{{"id": upload.FileID}})
+	params = url.Values{"files": {string(files)}, "channel_id": {r.channel}, "thread_ts": {r.threadTS}}
+	return r.b.call(ctx, r.b.botToken, "files.completeUploadExternal", params, nil)
+}
+
+// typing is a no-op, slack has no typing indicator for bots.
+func (r *slackReplier) typing() {}
+
+func (r *slackReplier) limit() int {
+	return slackMessageLimit
+}
+
+var (
+	slackBold    = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	slackStrike  = regexp.MustCompile(`~~(.+?)~~`)
+	slackLink    = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^)\s]+)\)`)
+	slackHeading = regexp.MustCompile(`^#{1,6}\s+(.+)$`)
+)
+
+// toSlackMarkdown converts the markdown of the models to slack mrkdwn: bold,
+// strikethrough, links and headings are rewritten, and &, < and > are escaped.
+// Code blocks are kept, without their language.
+func toSlackMarkdown(s string) string {
+	s = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+
+	lines := strings.Split(s, "\n")
+	var inCode bool
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if !inCode {
+				lines[i] = line[:strings.Index(line, "```")+3] // slack shows the language as code
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		line = slackHeading.ReplaceAllString(line, "*$1*")
+		line = slackBold.ReplaceAllString(line, "*$1*")
+		line = slackStrike.ReplaceAllString(line, "~$1~")
+		lines[i] = slackLink.ReplaceAllString(line, "<$2|$1>")
+	}
+	return strings.Join(lines, "\n")
+}
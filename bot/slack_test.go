@@ -0,0 +1,41 @@
+package bot
+
+import "testing"
+
+func TestToSlackMarkdown(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"**bold** and ~~gone~~", "*bold* and ~gone~"},
+		{"see [docs](https://example.com/a?b=1&c=2)", "see <https://example.com/a?b=1&amp;c=2|docs>"},
+		{"## Title\ntext", "*Title*\ntext"},
+		{"1 < 2 > 0", "1 &lt; 2 &gt; 0"},
+		{"```go\nx := **y**\n```\n**z**", "```\nx := **y**\n```\n*z*"},
+	}
+	for _, tt := range tests {
+		if got := toSlackMarkdown(tt.in); got != tt.want {
+			t.Errorf("toSlackMarkdown(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSlack_ShouldAnswer(t *testing.T) {
+	b := &Slack{userID: "UBOT"}
+	tests := []struct {
+		e    slackEvent
+		want bool
+	}{
+		{slackEvent{Type: "app_mention", User: "U1", Channel: "C1"}, true},
+		{slackEvent{Type: "app_mention", User: "U1", Channel: "D1"}, false},
+		{slackEvent{Type: "message", User: "U1", Channel: "D1", ChannelType: "im"}, true},
+		{slackEvent{Type: "message", User: "U1", Channel: "C1", ChannelType: "channel"}, false},
+		{slackEvent{Type: "message", User: "U1", Channel: "D1", ChannelType: "im", Subtype: "message_changed"}, false},
+		{slackEvent{Type: "message", User: "UBOT", Channel: "D1", ChannelType: "im"}, false},
+		{slackEvent{Type: "message", BotID: "B1", Channel: "D1", ChannelType: "im"}, false},
+	}
+	for _, tt := range tests {
+		if got := b.shouldAnswer(tt.e); got != tt.want {
+			t.Errorf("shouldAnswer(%+v) = %v, want %v", tt.e, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package bot
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/douglarek/llmverse/aicore"
+	"github.com/douglarek/llmverse/config"
+)
+
+// replier posts a streamed answer somewhere, so that every front-end can share
+// the same streaming loop.
+type replier interface {
+	send(content string) (string, error) // returns the id of the new message
+	edit(id, content string) error
+	attach(name string, data []byte) error // sends a file along with the answer
+	typing()
+	limit() int // max number of characters of a message
+}
+
+// truncatedHint ends an answer cut at the length limit, with the command to continue it.
+func truncatedHint(prefix string) string {
+	return "➡️ _the answer reached the length limit, send `" + prefix + "continue` to go on._"
+}
+
+// streamOptions are how streamReply shows an answer.
+type streamOptions struct {
+	mode           string        // one of config.ReplyModes
+	prefix         string        // the command prefix the hints name
+	noticePrefix   string        // starts the errors, see notice
+	editInterval   time.Duration // between two edits of the reply
+	typingInterval time.Duration // between two typing indicators
+}
+
+// newStreamOptions returns the stream options of the settings of agent, with mode.
+// The answers of a model that doesn't stream are posted at once, with the typing
+// indicator until then, rather than edited into a placeholder.
+func newStreamOptions(agent *aicore.LLMAgent, modelName, mode string) streamOptions {
+	if mode == config.ReplyModeEdit && !agent.Streams(modelName) {
+		mode = config.ReplyModeTypingOnly
+	}
+	return streamOptions{mode: mode, prefix: agent.CommandPrefix(), noticePrefix: agent.NoticePrefix(), editInterval: agent.EditInterval(), typingInterval: agent.TypingInterval()}
+}
+
+// streamReply consumes the output of the model and keeps editing the reply,
+// starting a new reply whenever the message length limit is reached. Unless the
+// mode is config.ReplyModeEdit, nothing is posted until the answer is complete.
+func streamReply(r replier, modelName string, output <-chan aicore.Chunk, opts streamOptions) {
+	mode := opts.mode
+	message := combineModelWithMessage(modelName, "")
+	var messageID string
+	if mode == config.ReplyModeEdit {
+		id, err := r.send("✏️ ...")
+		if err != nil {
+			slog.Error("[streamReply] failed to send reply", "error", err)
+			for range output { // drain the output so that the query goroutine can exit
+			}
+			return
+		}
+		messageID = id
+	}
+
+	// the tickers of the edits and the typing indicators, nil channels never fire
+	var edits, typings <-chan time.Time
+	if mode == config.ReplyModeEdit {
+		tk := time.NewTicker(opts.editInterval)
+		defer tk.Stop()
+		edits = tk.C
+	}
+	if mode != config.ReplyModeFinalOnly {
+		r.typing()
+		tk := time.NewTicker(opts.typingInterval)
+		defer tk.Stop()
+		typings = tk.C
+	}
+
+	// update shows content in the current reply, or in a new one if there is none
+	update := func(content string) {
+		if messageID == "" {
+			if id, err := r.send(content); err == nil {
+				messageID = id
+			}
+			return
+		}
+		r.edit(messageID, content)
+	}
+
+	limit := r.limit()
+	var debug string
+	for {
+		select {
+		case <-typings:
+			r.typing()
+		case <-edits:
+			umessage := []rune(message)
+			if len(umessage) <= limit {
+				r.edit(messageID, message)
+				continue
+			}
+
+			r.edit(messageID, string(umessage[:limit]))
+			message = combineModelWithMessage(modelName, "⏩ ") + string(umessage[limit:])
+			if id, err := r.send(message); err == nil {
+				messageID = id
+			}
+		case chunk, ok := <-output:
+			if !ok {
+				umessage := []rune(message)
+				for len(umessage) > limit {
+					update(string(umessage[:limit]))
+					umessage = []rune(combineModelWithMessage(modelName, "⏩ ") + string(umessage[limit:]))
+					messageID = "" // the rest goes into a new reply
+				}
+				update(string(umessage))
+				if debug != "" { // after the answer, in a message of its own
+					if _, err := r.send(string([]rune(debug)[:min(len([]rune(debug)), limit)])); err != nil {
+						slog.Error("[streamReply] failed to send the debug output", "error", err)
+					}
+				}
+				return
+			}
+			if errors.Is(chunk.Err, aicore.ErrInterrupted) { // keep the partial answer apart from the error
+				message = strings.TrimRightFunc(message, unicode.IsSpace) + "\n\n⚠️ " + chunk.Err.Error()
+				continue
+			}
+			if chunk.Err != nil {
+				message += "\n" + strings.TrimLeft(opts.noticePrefix+" ", " ") + chunk.Err.Error()
+				continue
+			}
+			if chunk.Debug != "" {
+				debug = chunk.Debug
+				continue
+			}
+			if chunk.Truncated {
+				message = strings.TrimRightFunc(message, unicode.IsSpace) + "\n\n" + truncatedHint(opts.prefix)
+				continue
+			}
+			if a := chunk.Attachment; a != nil {
+				if err := r.attach(a.Name, a.Data); err != nil {
+					slog.Error("[streamReply] failed to send attachment", "name", a.Name, "error", err)
+				}
+				continue
+			}
+			message += chunk.Text
+		}
+	}
+}
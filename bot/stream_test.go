@@ -0,0 +1,130 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/douglarek/llmverse/aicore"
+	"github.com/douglarek/llmverse/config"
+)
+
+// recordingReplier keeps the last content of each message and the files sent.
+type recordingReplier struct {
+	messages map[string]string
+	files    []string
+	edits    int
+	typings  int
+}
+
+func (r *recordingReplier) send(content string) (string, error) {
+	id := string(rune('a' + len(r.messages)))
+	r.messages[id] = content
+	return id, nil
+}
+
+func (r *recordingReplier) edit(id, content string) error {
+	r.edits++
+	r.messages[id] = content
+	return nil
+}
+
+func (r *recordingReplier) attach(name string, _ []byte) error {
+	r.files = append(r.files, name)
+	return nil
+}
+
+func (r *recordingReplier) typing() { r.typings++ }
+
+func (r *recordingReplier) limit() int { return discordMessageLimit }
+
+// testStreamOptions are stream options with intervals too long to fire in the tests.
+func testStreamOptions(mode, prefix string) streamOptions {
+	return streamOptions{mode: mode, prefix: prefix, editInterval: time.Hour, typingInterval: time.Hour}
+}
+
+func TestStreamReply_Attachment(t *testing.T) {
+	output := make(chan aicore.Chunk, 3)
+	output <- aicore.Chunk{Attachment: &aicore.Attachment{Name: "image.png", Data: []byte("png")}}
+	output <- aicore.Chunk{Text: "here is your cat"}
+	close(output)
+
+	r := &recordingReplier{messages: make(map[string]string)}
+	streamReply(r, "openai", output, testStreamOptions(config.ReplyModeEdit, "$"))
+
+	if len(r.files) != 1 || r.files[0] != "image.png" {
+		t.Fatalf("got files %v, want the image attached", r.files)
+	}
+	if !strings.HasSuffix(r.messages["a"], "here is your cat") {
+		t.Fatalf("got message %q", r.messages["a"])
+	}
+}
+
+func TestStreamReply_Modes(t *testing.T) {
+	answer := strings.Repeat("x", 4500)
+	for _, mode := range []string{config.ReplyModeEdit, config.ReplyModeTypingOnly, config.ReplyModeFinalOnly} {
+		output := make(chan aicore.Chunk, 1)
+		output <- aicore.Chunk{Text: answer}
+		close(output)
+
+		r := &recordingReplier{messages: make(map[string]string)}
+		streamReply(r, "openai", output, testStreamOptions(mode, "$"))
+
+		if len(r.messages) != 3 {
+			t.Fatalf("%s: got %d messages, want the answer split into 3", mode, len(r.messages))
+		}
+		var got string
+		for _, id := range []string{"a", "b", "c"} {
+			m := []rune(r.messages[id])
+			if len(m) > discordMessageLimit {
+				t.Fatalf("%s: message %s has %d characters", mode, id, len(m))
+			}
+			got += strings.TrimLeft(string(m), "openai:⏩ ") // drop the model prefix of each message
+		}
+		if got != answer {
+			t.Fatalf("%s: got %d characters of the answer, want %d", mode, len(got), len(answer))
+		}
+		if typed := r.typings > 0; typed != (mode != config.ReplyModeFinalOnly) {
+			t.Fatalf("%s: got typing %v", mode, typed)
+		}
+	}
+}
+
+func TestStreamReply_Truncated(t *testing.T) {
+	output := make(chan aicore.Chunk, 2)
+	output <- aicore.Chunk{Text: "the answer goes \n"}
+	output <- aicore.Chunk{Truncated: true}
+	close(output)
+
+	r := &recordingReplier{messages: make(map[string]string)}
+	streamReply(r, "openai", output, testStreamOptions(config.ReplyModeFinalOnly, "!"))
+
+	if want := "openai: the answer goes\n\n➡️ _the answer reached the length limit, send `!continue` to go on._"; r.messages["a"] != want {
+		t.Fatalf("got message %q, want %q", r.messages["a"], want)
+	}
+}
+
+func TestStreamReply_Intervals(t *testing.T) {
+	output := make(chan aicore.Chunk)
+	r := &recordingReplier{messages: make(map[string]string)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamReply(r, "openai", output, streamOptions{mode: config.ReplyModeEdit, editInterval: 10 * time.Millisecond, typingInterval: time.Hour})
+	}()
+
+	output <- aicore.Chunk{Text: "hello"}
+	time.Sleep(100 * time.Millisecond)
+	close(output)
+	<-done
+
+	if r.edits < 3 { // the ticks, then the final update
+		t.Fatalf("got %d edits, want the reply edited every 10ms", r.edits)
+	}
+	if r.typings != 1 {
+		t.Fatalf("got %d typing indicators, want only the first one", r.typings)
+	}
+	if r.messages["a"] != "openai: hello" {
+		t.Fatalf("got message %q", r.messages["a"])
+	}
+}
@@ -0,0 +1,373 @@
+package bot
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/douglarek/llmverse/aicore"
+	"github.com/douglarek/llmverse/config"
+)
+
+// telegramMessageLimit is the max number of characters of a telegram message.
+const telegramMessageLimit = 4096
+
+type telegramUser struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	Username  string `json:"username"`
+}
+
+type telegramChat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+type telegramMessage struct {
+	MessageID      int              `json:"message_id"`
+	From           *telegramUser    `json:"from"`
+	Chat           telegramChat     `json:"chat"`
+	Text           string           `json:"text"`
+	ReplyToMessage *telegramMessage `json:"reply_to_message"`
+}
+
+type telegramUpdate struct {
+	UpdateID int              `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+// Telegram is a telegram bot talking to the bot API with long polling.
+type Telegram struct {
+	reloadHook
+	token    string
+	client   *http.Client
+	me       telegramUser
+	agent    *aicore.LLMAgent
+	cancel   context.CancelFunc
+	done     chan struct{}
+	requests sync.WaitGroup // the handlers running, waited for on close
+}
+
+// Healthy fails if no model is available.
+func (b *Telegram) Healthy() error {
+	return checkModels(b.agent)
+}
+
+// Close stops receiving messages, then interrupts the answers in progress and
+// waits for them to be posted.
+func (b *Telegram) Close() error {
+	b.cancel()
+	<-b.done
+	shutdown(b.agent, &b.requests)
+	return nil
+}
+
+// NewTelegram starts the bot answering with agent, which may be shared with the
+// other front-ends.
+func NewTelegram(settings config.Settings, agent *aicore.LLMAgent) (*Telegram, error) {
+	b := &Telegram{
+		token:  settings.TelegramBotToken,
+		client: &http.Client{Timeout: 1 * time.Minute},
+		agent:  agent,
+		done:   make(chan struct{}),
+	}
+
+	if err := b.call(context.Background(), "getMe", nil, &b.me); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go b.poll(ctx, b.agent)
+
+	slog.Info("[main]: telegram bot is ready", "user", b.me.Username)
+	return b, nil
+}
+
+// call invokes a bot API method and decodes its result into result if not nil.
+func (b *Telegram) call(ctx context.Context, method string, params any, result any) error {
+	var body io.Reader
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+	return b.post(ctx, method, body, contentType, result)
+}
+
+// upload invokes a bot API method sending the file data as the field, along with
+// the params.
+func (b *Telegram) upload(ctx context.Context, method string, params map[string]string, field, name string, data []byte, result any) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for k, v := range params {
+		if err := w.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+	fw, err := w.CreateFormFile(field, name)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return b.post(ctx, method, &body, w.FormDataContentType(), result)
+}
+
+// post sends the body to a bot API method and decodes its result into result if not nil.
+func (b *Telegram) post(ctx context.Context, method string, body io.Reader, contentType string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.telegram.org/bot"+b.token+"/"+method, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if !r.OK {
+		return errors.New("telegram " + method + ": " + r.Description)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+func (b *Telegram) poll(ctx context.Context, agent *aicore.LLMAgent) {
+	defer close(b.done)
+
+	var offset int
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := b.call(ctx, "getUpdates", map[string]any{"offset": offset, "timeout": 50, "allowed_updates": []string{"message"}}, &updates)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("[telegram.poll] failed to get updates", "error", err)
+				time.Sleep(5 * time.Second)
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil && u.Message.From != nil && u.Message.Text != "" {
+				b.requests.Add(1)
+				go func() {
+					defer b.requests.Done()
+					b.handleMessage(agent, u.Message)
+				}()
+			}
+		}
+	}
+}
+
+func (b *Telegram) send(chatID int64, text string, replyTo int) (*telegramMessage, error) {
+	var m telegramMessage
+	err := b.call(context.Background(), "sendMessage", map[string]any{"chat_id": chatID, "text": text, "reply_to_message_id": replyTo}, &m)
+	return &m, err
+}
+
+func (b *Telegram) handleMessage(agent *aicore.LLMAgent, m *telegramMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if m.From.IsBot {
+		return
+	}
+
+	mention := "@" + b.me.Username
+	if m.Chat.Type != "private" { // in groups only reply to mentions and replies to this bot
+		isReply := m.ReplyToMessage != nil && m.ReplyToMessage.From != nil && m.ReplyToMessage.From.ID == b.me.ID
+		if !strings.Contains(m.Text, mention) && !isReply {
+			return
+		}
+	}
+
+	// the group chats are checked as guilds, and the private chats as direct messages
+	var group string
+	if m.Chat.Type != "private" {
+		group = strconv.FormatInt(m.Chat.ID, 10)
+	}
+	if !agent.IsAllowed(group, strconv.FormatInt(m.From.ID, 10)) {
+		slog.Info("[telegram.handleMessage] ignored message from a user not allowed", "chat", m.Chat.ID, "user", m.From.ID)
+		return
+	}
+
+	rawContent := strings.TrimSpace(strings.ReplaceAll(m.Text, mention, ""))
+	user := m.From.Username
+	if user == "" {
+		user = strconv.FormatInt(m.From.ID, 10)
+	}
+	if rawContent == "" && m.ReplyToMessage == nil { // only the mention
+		b.send(m.Chat.ID, helpMessage(agent, "", user), m.MessageID)
+		return
+	}
+
+	// the commands take the configured prefix, or / like the commands of telegram bots
+	prefix := agent.CommandPrefix()
+	command := func(content string) (name, arg string) {
+		name, arg, ok := parseCommand(content, prefix)
+		if !ok {
+			name, arg, _ = parseCommand(content, "/")
+		}
+		return name, arg
+	}
+
+	switch name, arg := command(rawContent); {
+	case name == "clear" && arg == "":
+		agent.ClearHistory(ctx, user, aicore.WithChannelID(strconv.FormatInt(m.Chat.ID, 10)))
+		b.send(m.Chat.ID, notice(agent, "history cleared."), m.MessageID)
+		return
+	case name == "usage":
+		b.send(m.Chat.ID, usageCommand(agent, user, strconv.FormatInt(m.From.ID, 10), arg), m.MessageID)
+		return
+	case name == "debug" && arg == "":
+		b.send(m.Chat.ID, debugCommand(agent, user), m.MessageID)
+		return
+	case name == "setmodel":
+		b.send(m.Chat.ID, setModelCommand(agent, "", user, arg), m.MessageID)
+		return
+	case name == "mymodel" && arg == "":
+		b.send(m.Chat.ID, myModelCommand(agent, "", user), m.MessageID)
+		return
+	case name == "reload" && arg == "":
+		b.send(m.Chat.ID, reloadCommand(agent, strconv.FormatInt(m.From.ID, 10), b.reload), m.MessageID)
+		return
+	case name == "models" && arg == "":
+		resp := notice(agent, fmt.Sprintf("available models: %s. %s", agent.AvailableModelNames(""), modelHint(agent)))
+		if status := agent.ModelStatus(); status != "" {
+			resp += "\n" + status
+		}
+		b.send(m.Chat.ID, resp, m.MessageID)
+		return
+	case name == "system":
+		b.send(m.Chat.ID, systemCommand(agent, strconv.FormatInt(m.From.ID, 10), arg), m.MessageID)
+		return
+	}
+
+	var stateless bool
+	if name, arg, _ := parseCommand(rawContent, prefix); name == "once" && arg != "" { // once model: question, neither reads nor keeps the history
+		stateless, rawContent = true, arg
+	}
+
+	if name, arg := command(rawContent); name == "continue" && arg == "" { // the model whose answer was cut goes on
+		if rawContent = continueInput(agent, user, aicore.WithChannelID(strconv.FormatInt(m.Chat.ID, 10))); rawContent == "" {
+			b.send(m.Chat.ID, notice(agent, noTruncatedAnswer), m.MessageID)
+			return
+		}
+	}
+
+	var modelName string
+	if modelName = agent.ParseModelName(rawContent, ""); modelName == "" && m.ReplyToMessage != nil {
+		if modelName = agent.ParseModelName(m.ReplyToMessage.Text, ""); modelName == "" {
+			modelName = answerModel(agent, m.ReplyToMessage.Text, "")
+		}
+	}
+	if modelName == "" {
+		modelName = agent.DefaultModel("", user)
+	}
+	if modelName == "" {
+		if selector := modelPrefix(rawContent, agent.ModelSeparator()); selector != "" {
+			b.send(m.Chat.ID, notice(agent, fmt.Sprintf("unknown model `%s`, available models: %s. %s", selector, agent.AvailableModelNames(""), modelHint(agent))), m.MessageID)
+		}
+		return
+	}
+
+	resolved, err := agent.ResolveModel(modelName, strconv.FormatInt(m.From.ID, 10), nil)
+	if err != nil {
+		b.send(m.Chat.ID, combineModelWithErrMessage(agent, modelName, err.Error()), m.MessageID)
+		return
+	}
+	modelName = resolved
+
+	opts := []aicore.QueryOption{aicore.WithChannelID(strconv.FormatInt(m.Chat.ID, 10)), aicore.WithUserName(cmp.Or(m.From.FirstName, m.From.Username))}
+	if stateless {
+		opts = append(opts, aicore.WithStateless())
+	}
+	output, err := agent.Query(ctx, modelName, user, rawContent, nil, opts...)
+	if err != nil {
+		b.send(m.Chat.ID, combineModelWithErrMessage(agent, modelName, err.Error()), m.MessageID)
+		return
+	}
+
+	streamReply(&telegramReplier{b: b, m: m, sent: make(map[string]string)}, modelName, output, newStreamOptions(agent, modelName, config.ReplyModeEdit))
+}
+
+type telegramReplier struct {
+	b    *Telegram
+	m    *telegramMessage
+	sent map[string]string // message id -> current text, telegram refuses edits that change nothing
+}
+
+func (r *telegramReplier) send(content string) (string, error) {
+	m, err := r.b.send(r.m.Chat.ID, content, r.m.MessageID)
+	if err != nil {
+		return "", err
+	}
+	id := strconv.Itoa(m.MessageID)
+	r.sent[id] = content
+	return id, nil
+}
+
+func (r *telegramReplier) edit(id, content string) error {
+	if r.sent[id] == content {
+		return nil
+	}
+	messageID, _ := strconv.Atoi(id)
+	err := r.b.call(context.Background(), "editMessageText", map[string]any{"chat_id": r.m.Chat.ID, "message_id": messageID, "text": content}, nil)
+	if err == nil {
+		r.sent[id] = content
+	}
+	return err
+}
+
+func (r *telegramReplier) attach(name string, data []byte) error {
+	params := map[string]string{"chat_id": strconv.FormatInt(r.m.Chat.ID, 10), "reply_to_message_id": strconv.Itoa(r.m.MessageID)}
+	return r.b.upload(context.Background(), "sendPhoto", params, "photo", name, data, nil)
+}
+
+func (r *telegramReplier) typing() {
+	r.b.call(context.Background(), "sendChatAction", map[string]any{"chat_id": r.m.Chat.ID, "action": "typing"}, nil)
+}
+
+func (r *telegramReplier) limit() int {
+	return telegramMessageLimit
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/douglarek/llmverse/aicore"
 	"github.com/douglarek/llmverse/bot"
 	"github.com/douglarek/llmverse/config"
+	"github.com/douglarek/llmverse/metrics"
+	"github.com/fsnotify/fsnotify"
 )
 
 var configFile = flag.String("config-file", "config.json", "path to config file")
@@ -19,6 +29,110 @@ func init() {
 	slog.SetDefault(slog.New(h))
 }
 
+// httpServers tracks the auxiliary http servers, so they can be drained together on shutdown.
+type httpServers struct {
+	servers []*http.Server
+}
+
+// start serves srv in the background.
+func (h *httpServers) start(srv *http.Server) {
+	h.servers = append(h.servers, srv)
+	go func() {
+		slog.Info("[main]: http server is listening", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("[main]: http server failed", "addr", srv.Addr, "error", err)
+		}
+	}()
+}
+
+// shutdown stops all servers from accepting requests and waits up to timeout for
+// the in-flight ones to complete, the connections left are closed.
+func (h *httpServers) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range h.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("[main]: http server did not drain in time", "addr", srv.Addr, "error", err)
+				srv.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// closeBots closes the bots at once, each waits for its answers in progress.
+func closeBots(bots []io.Closer) {
+	var wg sync.WaitGroup
+	for _, b := range bots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.Close(); err != nil {
+				slog.Error("[main]: cannot close bot", "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// watchConfig calls reload with the new settings whenever the config file at path
+// is written, until ctx is done. The directory is watched rather than the file, so
+// that editors saving by renaming a new file over it are followed too, and the file
+// is read once it has been quiet for settle, since a save may take several writes.
+func watchConfig(ctx context.Context, path string, settle time.Duration, reload func(config.Settings) error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("[main]: cannot watch the config file", "error", err)
+		return
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		slog.Error("[main]: cannot watch the config file", "config", path, "error", err)
+		return
+	}
+
+	name := filepath.Clean(path)
+	var quiet <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("[main]: error watching the config file", "error", err)
+			continue
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) == name && e.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				quiet = time.After(settle)
+			}
+			continue
+		case <-quiet:
+			quiet = nil
+		}
+
+		settings, err := config.LoadSettings(path)
+		if err != nil {
+			slog.Error("[main]: cannot reload settings, keeping the current ones", "error", err)
+			continue
+		}
+		if err := reload(settings); err != nil {
+			slog.Error("[main]: cannot apply the reloaded settings, keeping the current ones", "error", err)
+			continue
+		}
+		slog.Info("[main]: settings reloaded", "config", path)
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -32,12 +146,96 @@ func main() {
 		slogLevel.Set(slog.LevelDebug)
 	}
 
-	bot, err := bot.NewDiscord(settings)
-	if err != nil {
-		slog.Error("[main]: cannot create discord bot", "error", err)
-		return
+	agent := aicore.NewLLMAgent(settings) // shared, so the limits and the runtime settings hold across the front-ends
+	var bots []io.Closer
+	defer func() { closeBots(bots) }() // also the bots made before one failed
+	var checks []func() error
+	var hooks []interface{ SetReloader(func() error) } // of the $reload command
+	var reloaders []func(config.Settings)              // of the front-ends, once the agent is reloaded
+
+	if settings.DiscordBotToken != "" {
+		discord, err := bot.NewDiscord(settings, agent)
+		if err != nil {
+			slog.Error("[main]: cannot create discord bot", "error", err)
+			return
+		}
+		bots = append(bots, discord)
+		reloaders = append(reloaders, discord.Reload)
+		checks = append(checks, discord.Healthy)
+		hooks = append(hooks, discord)
+	}
+
+	if settings.TelegramBotToken != "" {
+		telegram, err := bot.NewTelegram(settings, agent)
+		if err != nil {
+			slog.Error("[main]: cannot create telegram bot", "error", err)
+			return
+		}
+		bots = append(bots, telegram)
+		checks = append(checks, telegram.Healthy)
+		hooks = append(hooks, telegram)
+	}
+
+	if settings.SlackBotToken != "" {
+		slack, err := bot.NewSlack(settings, agent)
+		if err != nil {
+			slog.Error("[main]: cannot create slack bot", "error", err)
+			return
+		}
+		bots = append(bots, slack)
+		checks = append(checks, slack.Healthy)
+		hooks = append(hooks, slack)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	apply := func(settings config.Settings) error {
+		if err := agent.Reload(settings); err != nil {
+			return err
+		}
+		for _, reload := range reloaders {
+			reload(settings)
+		}
+		if settings.EnableDebug {
+			slogLevel.Set(slog.LevelDebug)
+		} else {
+			slogLevel.Set(slog.LevelInfo)
+		}
+		return nil
+	}
+	go watchConfig(ctx, *configFile, 200*time.Millisecond, apply)
+	for _, h := range hooks {
+		h.SetReloader(func() error {
+			settings, err := config.LoadSettings(*configFile)
+			if err != nil {
+				return err
+			}
+			if err := apply(settings); err != nil {
+				return err
+			}
+			slog.Info("[main]: settings reloaded by command", "config", *configFile)
+			return nil
+		})
+	}
+
+	muxes := make(map[string]*http.ServeMux) // the endpoints on the same address share a server
+	handle := func(addr, pattern string, h http.Handler) {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(pattern, h)
+	}
+	if settings.MetricsAddr != "" {
+		handle(settings.MetricsAddr, "/metrics", metrics.Handler())
+	}
+	if settings.HealthAddr != "" {
+		handle(settings.HealthAddr, "/healthz", bot.HealthHandler(checks...))
+	}
+
+	var servers httpServers
+	for addr, mux := range muxes {
+		servers.start(&http.Server{Addr: addr, Handler: mux})
 	}
-	defer bot.Close()
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
@@ -45,4 +243,7 @@ func main() {
 	<-stop
 
 	slog.Info("[main]: bot is gracefully shutting down")
+	closeBots(bots) // the answers in progress are interrupted and posted first
+	bots = nil
+	servers.shutdown(time.Duration(*settings.ShutdownTimeout) * time.Second)
 }
@@ -3,8 +3,13 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"slices"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type LLMModel = string
@@ -20,36 +25,235 @@ var (
 	Qwen        LLMModel = "qwen"
 	ChatGLM     LLMModel = "chatglm"
 	Lingyiwanwu LLMModel = "lingyiwanwu"
+	Grok        LLMModel = "grok"
+	OpenRouter  LLMModel = "openrouter"
 )
 
+// EndUserID modes of how the user is identified to the model providers.
+const (
+	EndUserIDHashed = "hashed"
+	EndUserIDPlain  = "plain"
+)
+
+// StockProviders the getStockPrice tool can get quotes from.
+const (
+	StockProviderFinnhub      = "finnhub"
+	StockProviderAlphaVantage = "alphavantage"
+)
+
+// MapsProviders the geocode and getDirections tools can query.
+const (
+	MapsProviderGoogle = "google"
+	MapsProviderMapbox = "mapbox"
+)
+
+// HarmThresholds of the Gemini safety settings, the harm probability from which
+// the content is blocked.
+const (
+	HarmThresholdNone   = "none"
+	HarmThresholdLow    = "low"
+	HarmThresholdMedium = "medium"
+	HarmThresholdHigh   = "high"
+)
+
+// ImageHosts generated images can be rehosted on.
+const (
+	ImageHostImgur = "imgur"
+	ImageHostS3    = "s3"
+)
+
+// HistoryScopes a conversation history is shared in.
+const (
+	HistoryScopeUser    = "user"    // each user has their own history
+	HistoryScopeChannel = "channel" // everyone in a channel shares the history
+	HistoryScopeThread  = "thread"  // everyone in a thread shares the history, per user elsewhere
+)
+
+// ReplyModes of how the discord bot shows an answer while it is generated.
+const (
+	ReplyModeEdit       = "edit"        // post a placeholder and keep editing it
+	ReplyModeTypingOnly = "typing_only" // show typing, post the answer once complete
+	ReplyModeFinalOnly  = "final_only"  // show nothing, post the answer once complete
+)
+
+// The shortest intervals of the streaming replies, so they don't hammer the API.
+const (
+	MinEditIntervalMs   = 500
+	MinTypingIntervalMs = 1000
+)
+
+// S3Setting is an S3 compatible bucket generated images are uploaded to.
+type S3Setting struct {
+	Endpoint        string `json:"endpoint"`
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	PublicURL       string `json:"public_url"`
+}
+
+// MaxImagesLimits are the most images the providers accept in a single request,
+// providers not listed have no limit known.
+var MaxImagesLimits = map[LLMModel]int{ChatGLM: 1, Groq: 5, Mistral: 8, Bedrock: 20}
+
+// NoToolSupport are the providers whose clients can't call tools.
+var NoToolSupport = []LLMModel{Bedrock}
+
+// ToolResultsAsText are the providers whose clients call tools but can't send the
+// results back with the ids of the calls, the results are given as text instead.
+var ToolResultsAsText = []LLMModel{Mistral}
+
+// NoVisionSupport are the providers that have no models accepting images.
+var NoVisionSupport = []LLMModel{Deepseek}
+
+// ImagePromptLimits are the max prompt lengths, in characters, of the image models.
+var ImagePromptLimits = map[string]int{"dall-e-2": 1000, "dall-e-3": 4000}
+
+// ImageSizes are the sizes of generated images the image models support.
+var ImageSizes = []string{"256x256", "512x512", "1024x1024", "1792x1024", "1024x1792", "1536x1024", "1024x1536", "auto"}
+
+// ThinkingBudgetLimits are the max thinking budgets, in tokens, of the providers
+// that support a thinking budget.
+var ThinkingBudgetLimits = map[LLMModel]int{
+	Qwen: 38912,
+}
+
+// RateLimitSetting limits every user to a number of requests per window.
+type RateLimitSetting struct {
+	Requests      int `json:"requests"`
+	WindowSeconds int `json:"window_seconds"`
+}
+
+// ModelAccess restricts a model to the listed users and roles, others are
+// switched to the fallback model if there is one.
+type ModelAccess struct {
+	Users    []string `json:"users"`
+	Roles    []string `json:"roles"`
+	Fallback LLMModel `json:"fallback"`
+}
+
 type LLMSetting struct {
-	Name             LLMModel `json:"name,omitempty"`
-	APIKey           string   `json:"api_key,omitempty"`
-	APIVersion       string   `json:"api_version,omitempty"`
-	Enabled          bool     `json:"enabled"`
-	Model            string   `json:"model,omitempty"`
-	BaseURL          string   `json:"base_url,omitempty"`
-	AccessKeyID      string   `json:"access_key_id,omitempty"`
-	ModelID          string   `json:"model_id,omitempty"`
-	RegionName       string   `json:"region_name,omitempty"`
-	SecretAccessKey  string   `json:"secret_access_key,omitempty"`
-	HasVisionSupport bool     `json:"has_vision_support,omitempty"`
-	HasToolSupport   bool     `json:"has_tool_support,omitempty"`
+	Name              LLMModel `json:"name,omitempty"`
+	APIKey            string   `json:"api_key,omitempty"`
+	APIVersion        string   `json:"api_version,omitempty"`
+	Enabled           bool     `json:"enabled"`
+	Model             string   `json:"model,omitempty"`
+	BaseURL           string   `json:"base_url,omitempty"`
+	AccessKeyID       string   `json:"access_key_id,omitempty"`
+	ModelID           string   `json:"model_id,omitempty"`
+	RegionName        string   `json:"region_name,omitempty"`
+	SecretAccessKey   string   `json:"secret_access_key,omitempty"`
+	HasVisionSupport  bool     `json:"has_vision_support,omitempty"`
+	HasToolSupport    bool     `json:"has_tool_support,omitempty"`
+	SystemPrompt      string   `json:"system_prompt,omitempty"`
+	ThinkingBudget    *int     `json:"thinking_budget,omitempty"`
+	HTTPReferer       string   `json:"http_referer,omitempty"`
+	XTitle            string   `json:"x_title,omitempty"`
+	InputPrice        *float64 `json:"input_price,omitempty"`
+	OutputPrice       *float64 `json:"output_price,omitempty"`
+	EnabledTools      []string `json:"enabled_tools,omitempty"`
+	MaxImages         *int     `json:"max_images,omitempty"`
+	ImageModel        string   `json:"image_model,omitempty"`
+	ImageSize         string   `json:"image_size,omitempty"`
+	ImagePromptPrefix *string  `json:"image_prompt_prefix,omitempty"` // replaces the built-in image guidelines, "" sends the description alone
+	IsReasoningModel  *bool    `json:"is_reasoning_model,omitempty"`  // detected by the model name if unset
+	HarmThreshold     string   `json:"harm_threshold,omitempty"`      // google only, none blocks nothing if unset
+	TopP              *float64 `json:"top_p,omitempty"`               // overrides the global top_p
+	StopWords         []string `json:"stop_words,omitempty"`          // overrides the global stop_words
 	// expose some common settings to the model
-	OpenWeatherKey *string `json:"-"`
-	ImgurClientID  *string `json:"-"`
+	OpenWeatherKey  *string    `json:"-"`
+	StockAPIKey     *string    `json:"-"`
+	StockProvider   string     `json:"-"`
+	NewsAPIKey      *string    `json:"-"`
+	NewsAPIURL      string     `json:"-"`
+	MapsAPIKey      *string    `json:"-"`
+	MapsProvider    string     `json:"-"`
+	ExchangeRateURL string     `json:"-"`
+	ImgurClientID   *string    `json:"-"`
+	ImgurRetries    *int       `json:"-"`
+	ImageHost       string     `json:"-"`
+	S3              *S3Setting `json:"-"`
 }
 
 type Settings struct {
-	DiscordBotToken string       `json:"discord_bot_token"`
-	EnableDebug     bool         `json:"enable_debug"`
-	HistoryMaxSize  *int         `json:"history_max_size"`
-	OutputMaxSize   *int         `json:"output_max_size"`
-	SystemPrompt    string       `json:"system_prompt"`
-	Temperature     *float64     `json:"temperature"`
-	OpenWeatherKey  *string      `json:"openweather_key,omitempty"`
-	ImgurClientID   *string      `json:"imgur_client_id"`
-	Models          []LLMSetting `json:"models"`
+	DiscordBotToken         string                     `json:"discord_bot_token"`
+	ShardCount              int                        `json:"shard_count"` // discord sessions to open, 0 means one
+	TelegramBotToken        string                     `json:"telegram_bot_token"`
+	SlackBotToken           string                     `json:"slack_bot_token"` // xoxb- token for the Web API
+	SlackAppToken           string                     `json:"slack_app_token"` // xapp- token for Socket Mode
+	EnableDebug             bool                       `json:"enable_debug"`
+	ShutdownTimeout         *int                       `json:"shutdown_timeout"` // seconds to drain the http servers and finish the answers on shutdown
+	MetricsAddr             string                     `json:"metrics_addr"`     // address of the prometheus metrics server, none if empty
+	HealthAddr              string                     `json:"health_addr"`      // address of the /healthz server, the metrics server is shared if the same
+	HistoryMaxSize          *int                       `json:"history_max_size"`
+	HistoryMaxMessages      int                        `json:"history_max_messages"` // 0 means no limit
+	OutputMaxSize           *int                       `json:"output_max_size"`
+	HardOutputCap           int                        `json:"hard_output_cap"` // bytes of a streamed answer before it is cut, 0 means no cap
+	StreamBufferSize        *int                       `json:"stream_buffer_size"`
+	CommandPrefix           string                     `json:"command_prefix"`  // starts the commands, like $ in $clear
+	ModelSeparator          string                     `json:"model_separator"` // ends the model selector, like : in openai: hi
+	DefaultModel            LLMModel                   `json:"default_model"`   // answers the messages without a model selector, none if empty
+	HelpMessage             string                     `json:"help_message"`    // replaces the help answering a mention without a question
+	AckEmoji                *string                    `json:"ack_emoji"`       // reacts to the discord messages the bot takes, 💬 if unset, "" reacts with none
+	NoticePrefix            *string                    `json:"notice_prefix"`   // starts the bot's own notices and errors, 🤖 if unset, "" for none
+	SystemPrompt            string                     `json:"system_prompt"`   // may use {{.User}}, {{.Date}} and {{.Model}}
+	Temperature             *float64                   `json:"temperature"`
+	TopP                    *float64                   `json:"top_p,omitempty"`      // nucleus sampling, the provider default if unset
+	StopWords               []string                   `json:"stop_words,omitempty"` // sequences ending the answer
+	OpenWeatherKey          *string                    `json:"openweather_key,omitempty"`
+	StockAPIKey             *string                    `json:"stock_api_key,omitempty"`
+	StockProvider           string                     `json:"stock_provider"`
+	NewsAPIKey              *string                    `json:"news_api_key,omitempty"`
+	NewsAPIURL              string                     `json:"news_api_url"` // base url of a NewsAPI compatible service
+	MapsAPIKey              *string                    `json:"maps_api_key,omitempty"`
+	MapsProvider            string                     `json:"maps_provider"`
+	ExchangeRateURL         string                     `json:"exchange_rate_url"` // base url of a Frankfurter API, e.g. a self-hosted mirror
+	ImgurClientID           *string                    `json:"imgur_client_id"`
+	ImgurRetries            *int                       `json:"imgur_retries"`
+	ImageHost               string                     `json:"image_host"`
+	S3                      *S3Setting                 `json:"s3,omitempty"`
+	MaxImageDimension       *int                       `json:"max_image_dimension"`
+	MaxImageBytes           *int                       `json:"max_image_bytes"`
+	AllowedImageTypes       []string                   `json:"allowed_image_types"`
+	MaxAttachmentSize       *int                       `json:"max_attachment_size"`
+	MaxPDFSize              *int                       `json:"max_pdf_size"`            // in bytes
+	MaxPDFText              *int                       `json:"max_pdf_text"`            // in characters, the text beyond is cut
+	MaxInputLength          int                        `json:"max_input_length"`        // in characters, 0 means no limit
+	MaxConcurrentRequests   int                        `json:"max_concurrent_requests"` // 0 means no limit
+	HistoryScope            string                     `json:"history_scope"`
+	ReplyMode               string                     `json:"reply_mode"`
+	EditIntervalMs          *int                       `json:"edit_interval_ms"`   // between two edits of a streaming reply
+	TypingIntervalMs        *int                       `json:"typing_interval_ms"` // between two typing indicators
+	IncrementalHistory      bool                       `json:"incremental_history"`
+	NormalizeOutput         bool                       `json:"normalize_output"`
+	ShowCost                bool                       `json:"show_cost"`
+	ShowSources             bool                       `json:"show_sources"`
+	SwitchSummary           bool                       `json:"switch_summary"`
+	ShowContextTrimmed      bool                       `json:"show_context_trimmed"`      // note in the answer when earlier messages were dropped from the history
+	IncludeReferenceContext bool                       `json:"include_reference_context"` // quote the message replied to before the question
+	ThrottleRateLimits      bool                       `json:"throttle_rate_limits"`
+	Schemas                 map[string]json.RawMessage `json:"schemas,omitempty"`
+	SchemaRetries           *int                       `json:"schema_retries"`
+	RateLimit               *RateLimitSetting          `json:"rate_limit,omitempty"`
+	Admins                  []string                   `json:"admins"`
+	AllowedGuilds           []string                   `json:"allowed_guilds"`   // the discord guilds, telegram groups and slack workspaces the bot answers in, all if empty
+	AllowedUsers            []string                   `json:"allowed_users"`    // the users the bot answers on any platform, in direct messages too
+	AllowedChannels         []string                   `json:"allowed_channels"` // the guild channels the bot answers in, all if empty
+	SummaryModel            LLMModel                   `json:"summary_model"`
+	EndUserID               string                     `json:"end_user_id"`
+	ModerationAPIKey        *string                    `json:"moderation_api_key,omitempty"`
+	ModerationURL           string                     `json:"moderation_url"`
+	ModerateOutput          bool                       `json:"moderate_output"`           // hold the answers back until they are screened
+	WhisperAPIKey           *string                    `json:"whisper_api_key,omitempty"` // transcribes the voice messages, refused if unset
+	WhisperURL              string                     `json:"whisper_url"`               // an OpenAI compatible transcription endpoint
+	WhisperModel            string                     `json:"whisper_model"`
+	MaxAudioSize            *int                       `json:"max_audio_size"`    // in bytes
+	AuditLogPath            string                     `json:"audit_log_path"`    // file the queries and answers are appended to as JSON lines
+	AuditChannelID          string                     `json:"audit_channel_id"`  // discord channel the queries and answers are posted to
+	AuditSkipImages         bool                       `json:"audit_skip_images"` // leave the image urls out of the audit log
+	ModelAccess             map[LLMModel]ModelAccess   `json:"model_access,omitempty"`
+	GuildModels             map[string][]LLMModel      `json:"guild_models,omitempty"` // guild id -> the models offered there, all if absent
+	Models                  []LLMSetting               `json:"models"`
 }
 
 var _ json.Unmarshaler = (*Settings)(nil)
@@ -73,8 +277,16 @@ func (s *Settings) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	if s.DiscordBotToken == "" {
-		return errors.New("discord_bot_token is required")
+	if s.DiscordBotToken == "" && s.TelegramBotToken == "" && s.SlackBotToken == "" {
+		return errors.New("discord_bot_token, telegram_bot_token or slack_bot_token is required")
+	}
+
+	if (s.SlackBotToken == "") != (s.SlackAppToken == "") {
+		return errors.New("slack_bot_token and slack_app_token must be set together")
+	}
+
+	if s.ShardCount < 0 {
+		return errors.New("shard_count must not be negative")
 	}
 
 	if s.HistoryMaxSize == nil {
@@ -84,16 +296,284 @@ func (s *Settings) UnmarshalJSON(data []byte) error {
 	if s.OutputMaxSize == nil {
 		s.OutputMaxSize = ptr(4096)
 	}
+	if s.HardOutputCap < 0 {
+		return errors.New("hard_output_cap must not be negative")
+	}
+
+	if s.StreamBufferSize == nil {
+		s.StreamBufferSize = ptr(1024)
+	}
+	if *s.StreamBufferSize < 0 {
+		return errors.New("stream_buffer_size must not be negative")
+	}
+
+	if s.ShutdownTimeout == nil {
+		s.ShutdownTimeout = ptr(10)
+	}
+	if *s.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
 
 	if s.SystemPrompt == "" {
 		s.SystemPrompt = "You are a helpful AI assistant."
 	}
 
+	if s.CommandPrefix == "" {
+		s.CommandPrefix = "$"
+	}
+	if s.ModelSeparator == "" {
+		s.ModelSeparator = ":"
+	}
+	if s.AckEmoji == nil {
+		s.AckEmoji = ptr("💬")
+	}
+	if s.NoticePrefix == nil {
+		s.NoticePrefix = ptr("🤖")
+	}
+	if strings.ContainsFunc(s.CommandPrefix+s.ModelSeparator, unicode.IsSpace) {
+		return errors.New("command_prefix and model_separator must not contain spaces")
+	}
+	if r, _ := utf8.DecodeRuneInString(s.CommandPrefix); unicode.IsLetter(r) || unicode.IsDigit(r) {
+		return errors.New("command_prefix must not start with a letter or digit, questions and model names do")
+	}
+	if strings.HasPrefix(s.CommandPrefix, s.ModelSeparator) || strings.HasPrefix(s.ModelSeparator, s.CommandPrefix) {
+		return errors.New("command_prefix and model_separator must not start alike")
+	}
+
 	if s.Temperature == nil {
 		s.Temperature = ptr(0.7)
 	}
 
+	if err := checkSampling("", s.TopP, s.StopWords); err != nil {
+		return err
+	}
+
+	switch s.HistoryScope {
+	case "":
+		s.HistoryScope = HistoryScopeUser
+	case HistoryScopeUser, HistoryScopeChannel, HistoryScopeThread:
+	default:
+		return errors.New("history_scope must be one of user, channel or thread")
+	}
+
+	switch s.ReplyMode {
+	case "":
+		s.ReplyMode = ReplyModeEdit
+	case ReplyModeEdit, ReplyModeTypingOnly, ReplyModeFinalOnly:
+	default:
+		return errors.New("reply_mode must be one of edit, typing_only or final_only")
+	}
+
+	if s.EditIntervalMs == nil {
+		s.EditIntervalMs = ptr(1000)
+	} else if *s.EditIntervalMs < MinEditIntervalMs {
+		return fmt.Errorf("edit_interval_ms must be at least %d", MinEditIntervalMs)
+	}
+	if s.TypingIntervalMs == nil {
+		s.TypingIntervalMs = ptr(5000)
+	} else if *s.TypingIntervalMs < MinTypingIntervalMs {
+		return fmt.Errorf("typing_interval_ms must be at least %d", MinTypingIntervalMs)
+	}
+
+	switch s.EndUserID {
+	case "", EndUserIDHashed, EndUserIDPlain:
+	default:
+		return errors.New("end_user_id must be one of hashed, plain or empty")
+	}
+
+	if s.ModerationURL == "" {
+		s.ModerationURL = "https://api.openai.com/v1/moderations"
+	}
+	if s.ModerateOutput && (s.ModerationAPIKey == nil || *s.ModerationAPIKey == "") {
+		return errors.New("moderate_output requires moderation_api_key")
+	}
+
+	if s.WhisperURL == "" {
+		s.WhisperURL = "https://api.openai.com/v1/audio/transcriptions"
+	}
+	if s.WhisperModel == "" {
+		s.WhisperModel = "whisper-1"
+	}
+	if s.MaxAudioSize == nil {
+		s.MaxAudioSize = ptr(25 * 1024 * 1024) // the limit of whisper
+	} else if *s.MaxAudioSize <= 0 {
+		return errors.New("max_audio_size must be positive")
+	}
+
+	for name, schema := range s.Schemas {
+		var v map[string]any
+		if err := json.Unmarshal(schema, &v); err != nil {
+			return errors.New("schema " + name + " must be a JSON object")
+		}
+	}
+
+	if s.RateLimit != nil && (s.RateLimit.Requests <= 0 || s.RateLimit.WindowSeconds <= 0) {
+		return errors.New("rate_limit requests and window_seconds must be positive")
+	}
+
+	if s.SchemaRetries == nil {
+		s.SchemaRetries = ptr(2)
+	}
+
+	if s.ImgurRetries == nil {
+		s.ImgurRetries = ptr(3)
+	}
+
+	switch s.StockProvider {
+	case "":
+		s.StockProvider = StockProviderFinnhub
+	case StockProviderFinnhub, StockProviderAlphaVantage:
+	default:
+		return errors.New("stock_provider must be one of finnhub or alphavantage")
+	}
+
+	if s.NewsAPIURL == "" {
+		s.NewsAPIURL = "https://newsapi.org/v2/"
+	}
+
+	switch s.MapsProvider {
+	case "":
+		s.MapsProvider = MapsProviderGoogle
+	case MapsProviderGoogle, MapsProviderMapbox:
+	default:
+		return errors.New("maps_provider must be one of google or mapbox")
+	}
+
+	if s.ExchangeRateURL == "" {
+		s.ExchangeRateURL = "https://api.frankfurter.app/"
+	}
+
+	if s.ImageHost == "" && s.ImgurClientID != nil && *s.ImgurClientID != "" {
+		s.ImageHost = ImageHostImgur
+	}
+
+	switch s.ImageHost {
+	case "":
+	case ImageHostImgur:
+		if s.ImgurClientID == nil || *s.ImgurClientID == "" {
+			return errors.New("imgur_client_id is required for image_host imgur")
+		}
+	case ImageHostS3:
+		if s.S3 == nil || s.S3.Endpoint == "" || s.S3.Bucket == "" {
+			return errors.New("s3 endpoint and bucket are required for image_host s3")
+		}
+		if s.S3.AccessKeyID == "" || s.S3.SecretAccessKey == "" {
+			return errors.New("s3 access_key_id and secret_access_key are required for image_host s3")
+		}
+		if s.S3.Region == "" {
+			s.S3.Region = "us-east-1"
+		}
+	default:
+		return errors.New("image_host must be one of imgur, s3 or empty")
+	}
+
+	if s.MaxImageDimension == nil {
+		s.MaxImageDimension = ptr(2048)
+	}
+
+	if s.MaxImageBytes == nil {
+		s.MaxImageBytes = ptr(10 * 1024 * 1024)
+	}
+
+	if len(s.AllowedImageTypes) == 0 {
+		s.AllowedImageTypes = []string{"png", "jpg", "jpeg", "gif", "webp"}
+	}
+
+	if s.MaxAttachmentSize == nil {
+		s.MaxAttachmentSize = ptr(100 * 1024)
+	}
+
+	if s.MaxPDFSize == nil {
+		s.MaxPDFSize = ptr(10 * 1024 * 1024)
+	} else if *s.MaxPDFSize <= 0 {
+		return errors.New("max_pdf_size must be positive")
+	}
+
+	if s.MaxPDFText == nil {
+		s.MaxPDFText = ptr(20000)
+	} else if *s.MaxPDFText <= 0 {
+		return errors.New("max_pdf_text must be positive")
+	}
+
+	if s.MaxInputLength < 0 {
+		return errors.New("max_input_length must not be negative")
+	}
+
+	if s.MaxConcurrentRequests < 0 {
+		return errors.New("max_concurrent_requests must not be negative")
+	}
+
+	if s.HistoryMaxMessages < 0 {
+		return errors.New("history_max_messages must not be negative")
+	}
+
+	if s.SummaryModel != "" && !slices.ContainsFunc(s.Models, func(m LLMSetting) bool { return m.Enabled && m.Name == s.SummaryModel }) {
+		return errors.New("summary_model " + s.SummaryModel + " is not an enabled model")
+	}
+
+	if s.DefaultModel != "" && !slices.ContainsFunc(s.Models, func(m LLMSetting) bool { return m.Enabled && m.Name == s.DefaultModel }) {
+		return errors.New("default_model " + s.DefaultModel + " is not an enabled model")
+	}
+
+	for guild, names := range s.GuildModels {
+		for _, name := range names {
+			if !slices.ContainsFunc(s.Models, func(m LLMSetting) bool { return m.Enabled && m.Name == name }) {
+				return errors.New("guild_models of " + guild + " names " + name + ", which is not an enabled model")
+			}
+		}
+	}
+
+	for name, access := range s.ModelAccess {
+		if access.Fallback == name {
+			return errors.New("model_access fallback of " + name + " must be another model")
+		}
+	}
+
+	enabled := make(map[LLMModel]bool)
 	for i, v := range s.Models {
+		if v.Enabled {
+			if enabled[v.Name] {
+				return errors.New("model " + v.Name + " is enabled more than once")
+			}
+			enabled[v.Name] = true
+
+			if v.HasToolSupport && slices.Contains(NoToolSupport, v.Name) {
+				slog.Warn("[config] has_tool_support is set but the provider can't call tools", "model", v.Name)
+			}
+			if v.HasVisionSupport && slices.Contains(NoVisionSupport, v.Name) {
+				slog.Warn("[config] has_vision_support is set but the provider can't see images", "model", v.Name)
+			}
+		}
+
+		if err := checkSampling(v.Name+" ", v.TopP, v.StopWords); err != nil {
+			return err
+		}
+
+		switch v.HarmThreshold {
+		case "":
+			s.Models[i].HarmThreshold = HarmThresholdNone
+		case HarmThresholdNone, HarmThresholdLow, HarmThresholdMedium, HarmThresholdHigh:
+		default:
+			return errors.New(v.Name + " harm_threshold must be one of none, low, medium or high")
+		}
+
+		if v.ImagePromptPrefix != nil && v.Name != OpenAI {
+			return errors.New(v.Name + " image_prompt_prefix is only used by openai")
+		}
+
+		if v.MaxImages != nil && *v.MaxImages <= 0 {
+			return errors.New(v.Name + " max_images must be positive")
+		}
+
+		if v.Enabled && v.ThinkingBudget != nil {
+			if *v.ThinkingBudget <= 0 {
+				return errors.New(v.Name + " thinking_budget must be positive")
+			}
+			if limit, ok := ThinkingBudgetLimits[v.Name]; ok && *v.ThinkingBudget > limit {
+				return fmt.Errorf("%s thinking_budget must not exceed %d", v.Name, limit)
+			}
+		}
+
 		if v.Enabled {
 			switch v.Name {
 			case OpenAI:
@@ -106,6 +586,18 @@ func (s *Settings) UnmarshalJSON(data []byte) error {
 				if v.Model == "" {
 					s.Models[i].Model = "gpt-4"
 				}
+				if v.ImageModel == "" {
+					s.Models[i].ImageModel = "dall-e-3"
+				}
+				if v.ImageSize == "" {
+					s.Models[i].ImageSize = "1024x1024"
+				}
+				if !slices.Contains(ImageSizes, s.Models[i].ImageSize) {
+					return fmt.Errorf("openai image_size must be one of %s", strings.Join(ImageSizes, ", "))
+				}
+				if limit, ok := ImagePromptLimits[s.Models[i].ImageModel]; ok && v.ImagePromptPrefix != nil && utf8.RuneCountInString(*v.ImagePromptPrefix) >= limit {
+					return fmt.Errorf("openai image_prompt_prefix must be shorter than the %d characters %s accepts", limit, s.Models[i].ImageModel)
+				}
 			case Google:
 				if v.APIKey == "" {
 					return errors.New("google api_key is required")
@@ -196,6 +688,26 @@ func (s *Settings) UnmarshalJSON(data []byte) error {
 				if v.Model == "" {
 					s.Models[i].Model = "yi-large"
 				}
+			case Grok:
+				if v.APIKey == "" {
+					return errors.New("grok api_key is required")
+				}
+				if v.BaseURL == "" {
+					s.Models[i].BaseURL = "https://api.x.ai/v1"
+				}
+				if v.Model == "" {
+					s.Models[i].Model = "grok-beta"
+				}
+			case OpenRouter:
+				if v.APIKey == "" {
+					return errors.New("openrouter api_key is required")
+				}
+				if v.BaseURL == "" {
+					s.Models[i].BaseURL = "https://openrouter.ai/api/v1"
+				}
+				if v.Model == "" {
+					s.Models[i].Model = "openrouter/auto"
+				}
 			default:
 				return errors.New("unknown model name " + v.Name)
 			}
@@ -205,8 +717,9 @@ func (s *Settings) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// GetLLMModel returns the model selected at the start of input, before the model separator.
 func (s Settings) GetLLMModel(input string) LLMModel {
-	index := strings.Index(input, ":")
+	index := strings.Index(input, s.ModelSeparator)
 	if index == -1 {
 		return ""
 	}
@@ -225,13 +738,184 @@ func (s Settings) GetLLMModelSetting(name LLMModel) LLMSetting {
 	for _, v := range s.Models {
 		if v.Name == name {
 			v.OpenWeatherKey = s.OpenWeatherKey
+			v.StockAPIKey = s.StockAPIKey
+			v.StockProvider = s.StockProvider
+			v.NewsAPIKey = s.NewsAPIKey
+			v.NewsAPIURL = s.NewsAPIURL
+			v.MapsAPIKey = s.MapsAPIKey
+			v.MapsProvider = s.MapsProvider
+			v.ExchangeRateURL = s.ExchangeRateURL
 			v.ImgurClientID = s.ImgurClientID
+			v.ImgurRetries = s.ImgurRetries
+			v.ImageHost = s.ImageHost
+			v.S3 = s.S3
 			return v
 		}
 	}
 	return LLMSetting{}
 }
 
+// Secrets returns the tokens and keys of the settings, the values that must never
+// be shown to the users.
+func (s Settings) Secrets() []string {
+	secrets := []string{s.DiscordBotToken, s.TelegramBotToken, s.SlackBotToken, s.SlackAppToken}
+	for _, v := range []*string{s.OpenWeatherKey, s.StockAPIKey, s.NewsAPIKey, s.MapsAPIKey, s.ImgurClientID, s.ModerationAPIKey, s.WhisperAPIKey} {
+		if v != nil {
+			secrets = append(secrets, *v)
+		}
+	}
+	if s.S3 != nil {
+		secrets = append(secrets, s.S3.AccessKeyID, s.S3.SecretAccessKey)
+	}
+	for _, v := range s.Models {
+		secrets = append(secrets, v.APIKey, v.AccessKeyID, v.SecretAccessKey)
+	}
+	return slices.DeleteFunc(secrets, func(v string) bool { return v == "" })
+}
+
+// IsAdmin reports whether the user is one of the bot admins.
+func (s Settings) IsAdmin(userID string) bool {
+	return slices.Contains(s.Admins, userID)
+}
+
+// IsAllowed reports whether the user may use the bot in the guild, guildID is
+// empty for direct messages. Everyone is allowed if both allowlists are empty,
+// otherwise the user and the guild must each be on their list unless it is empty.
+// Direct messages are only allowed to the users on allowed_users.
+func (s Settings) IsAllowed(guildID, userID string) bool {
+	if len(s.AllowedGuilds) == 0 && len(s.AllowedUsers) == 0 {
+		return true
+	}
+	if guildID == "" {
+		return slices.Contains(s.AllowedUsers, userID)
+	}
+	return (len(s.AllowedUsers) == 0 || slices.Contains(s.AllowedUsers, userID)) &&
+		(len(s.AllowedGuilds) == 0 || slices.Contains(s.AllowedGuilds, guildID))
+}
+
+// ChannelAllowed reports whether the bot answers in the channel of the guild, a
+// thread is allowed with its parent channel. Direct messages and all channels are
+// allowed if the allowlist is empty.
+func (s Settings) ChannelAllowed(guildID, channelID, parentID string) bool {
+	if guildID == "" || len(s.AllowedChannels) == 0 {
+		return true
+	}
+	return slices.Contains(s.AllowedChannels, channelID) || parentID != "" && slices.Contains(s.AllowedChannels, parentID)
+}
+
+// GuildAllowsModel reports whether the model is offered in the guild, DMs (an
+// empty guildID) and guilds without an allowlist are offered all models.
+func (s Settings) GuildAllowsModel(guildID string, name LLMModel) bool {
+	allowed, ok := s.GuildModels[guildID]
+	return guildID == "" || !ok || slices.Contains(allowed, name)
+}
+
+// CanUseModel reports whether the user, or one of its roles, is allowed to use the model.
+// Models without access rules can be used by everyone.
+func (s Settings) CanUseModel(name LLMModel, userID string, roleIDs []string) bool {
+	access, ok := s.ModelAccess[name]
+	if !ok {
+		return true
+	}
+	if slices.Contains(access.Users, userID) {
+		return true
+	}
+	for _, r := range roleIDs {
+		if slices.Contains(access.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSystemPrompt returns the system prompt of the model, or the global one if the
+// model has none.
+func (s Settings) GetSystemPrompt(name LLMModel) string {
+	for _, v := range s.Models {
+		if v.Name == name && v.SystemPrompt != "" {
+			return v.SystemPrompt
+		}
+	}
+	return s.SystemPrompt
+}
+
+// GetMaxImages returns the most images a single request to the model may carry,
+// 0 means no limit.
+func (s Settings) GetMaxImages(name LLMModel) int {
+	for _, v := range s.Models {
+		if v.Name == name && v.MaxImages != nil {
+			return *v.MaxImages
+		}
+	}
+	return MaxImagesLimits[name]
+}
+
+// checkSampling validates top_p and stop_words, prefix names the model of the settings if any.
+func checkSampling(prefix string, topP *float64, stopWords []string) error {
+	if topP != nil && (*topP <= 0 || *topP > 1) {
+		return errors.New(prefix + "top_p must be greater than 0 and at most 1")
+	}
+	if slices.Contains(stopWords, "") {
+		return errors.New(prefix + "stop_words must not be empty strings")
+	}
+	return nil
+}
+
+// GetTopP returns the top_p of the model, or the global one if it has none.
+func (s Settings) GetTopP(name LLMModel) *float64 {
+	for _, v := range s.Models {
+		if v.Name == name && v.TopP != nil {
+			return v.TopP
+		}
+	}
+	return s.TopP
+}
+
+// GetStopWords returns the stop_words of the model, or the global ones if it has none.
+func (s Settings) GetStopWords(name LLMModel) []string {
+	for _, v := range s.Models {
+		if v.Name == name && len(v.StopWords) > 0 {
+			return v.StopWords
+		}
+	}
+	return s.StopWords
+}
+
+// ReasoningModelPrefixes are the prefixes of the OpenAI reasoning models, which
+// take no temperature and limit their output with max_completion_tokens.
+var ReasoningModelPrefixes = []string{"o1", "o3", "o4"}
+
+// Streams reports whether the model streams its answers, the bedrock client only
+// streams those of the claude models.
+func (s Settings) Streams(name LLMModel) bool {
+	if name != Bedrock {
+		return true
+	}
+	return strings.HasPrefix(s.GetLLMModelSetting(name).ModelID, "anthropic.")
+}
+
+// IsReasoningModel reports whether the model is a reasoning model, either as
+// configured by is_reasoning_model or detected by the model name.
+func (s Settings) IsReasoningModel(name LLMModel) bool {
+	for _, v := range s.Models {
+		if v.Name != name {
+			continue
+		}
+		if v.IsReasoningModel != nil {
+			return *v.IsReasoningModel
+		}
+		if v.Name != OpenAI && v.Name != Azure {
+			return false
+		}
+		for _, p := range ReasoningModelPrefixes {
+			if strings.HasPrefix(v.Model, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s Settings) GetVisionSupport(name string) bool {
 	for _, v := range s.Models {
 		if v.Name == name {
@@ -250,11 +934,89 @@ func (s Settings) GetToolSupport(name LLMModel) bool {
 	return false
 }
 
+// envPrefix prefixes the environment variables overriding the settings of the config file.
+const envPrefix = "LLMVERSE_"
+
+// envSettings are the settings overridden by LLMVERSE_<KEY>, e.g. LLMVERSE_DISCORD_BOT_TOKEN.
+var envSettings = []string{
+	"discord_bot_token", "telegram_bot_token", "slack_bot_token", "slack_app_token",
+	"openweather_key", "stock_api_key", "news_api_key", "maps_api_key", "imgur_client_id", "moderation_api_key", "whisper_api_key",
+}
+
+// envModelSettings are the model settings overridden by LLMVERSE_<MODEL>_<KEY>, e.g.
+// LLMVERSE_OPENAI_API_KEY.
+var envModelSettings = []string{"api_key", "base_url", "access_key_id", "secret_access_key"}
+
+// envName returns the environment variable of the key: upper case, with the characters
+// other than letters and digits replaced by _.
+func envName(parts ...string) string {
+	name := envPrefix + strings.ToUpper(strings.Join(parts, "_"))
+	return strings.Map(func(r rune) rune {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// applyEnv sets the settings of the environment variables in the JSON config, they win
+// over the values of the file. The models are only overridden, not added.
+func applyEnv(data []byte) ([]byte, error) {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = make(map[string]json.RawMessage)
+	}
+
+	set := func(m map[string]json.RawMessage, key, name string) bool {
+		v, ok := os.LookupEnv(name)
+		if ok {
+			m[key], _ = json.Marshal(v)
+		}
+		return ok
+	}
+
+	for _, key := range envSettings {
+		set(config, key, envName(key))
+	}
+
+	if raw, ok := config["models"]; ok {
+		var models []map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &models); err != nil {
+			return nil, fmt.Errorf("models: %w", err)
+		}
+		var changed bool
+		for _, m := range models {
+			var name string
+			if err := json.Unmarshal(m["name"], &name); err != nil || name == "" {
+				continue
+			}
+			for _, key := range envModelSettings {
+				if set(m, key, envName(name, key)) {
+					changed = true
+				}
+			}
+		}
+		if changed {
+			config["models"], _ = json.Marshal(models)
+		}
+	}
+
+	return json.Marshal(config)
+}
+
+// LoadSettings reads the config file, the LLMVERSE_ environment variables of
+// envSettings and envModelSettings override its values.
 func LoadSettings(filePath string) (Settings, error) {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return Settings{}, err
 	}
+	if data, err = applyEnv(data); err != nil {
+		return Settings{}, err
+	}
 
 	var config Settings
 	if err := json.Unmarshal(data, &config); err != nil {
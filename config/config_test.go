@@ -2,6 +2,9 @@ package config
 
 import (
 	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -88,3 +91,454 @@ func TestConfig_UnmarshalJSON(t *testing.T) {
 
 	t.Logf("discord_bot_token: %s, history_max_size: %d, system_prompt: %s, temperature: %.1f", c.DiscordBotToken, *c.HistoryMaxSize, c.SystemPrompt, *c.Temperature)
 }
+
+func TestSettings_CanUseModel(t *testing.T) {
+	var c Settings
+
+	s := `
+	{
+		"discord_bot_token": "xxxx",
+		"model_access": {
+			"openai": {"users": ["u1"], "roles": ["r1"], "fallback": "groq"}
+		}
+	}
+`
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		model string
+		user  string
+		roles []string
+		want  bool
+	}{
+		{"openai", "u1", nil, true},
+		{"openai", "u2", []string{"r2", "r1"}, true},
+		{"openai", "u2", []string{"r2"}, false},
+		{"openai", "u2", nil, false},
+		{"groq", "u2", nil, true},
+	}
+	for _, tt := range tests {
+		if got := c.CanUseModel(tt.model, tt.user, tt.roles); got != tt.want {
+			t.Fatalf("CanUseModel(%q, %q, %v) = %v, want %v", tt.model, tt.user, tt.roles, got, tt.want)
+		}
+	}
+}
+
+func TestSettings_GetSystemPrompt(t *testing.T) {
+	var c Settings
+
+	s := `
+	{
+		"discord_bot_token": "xxxx",
+		"models": [
+			{
+				"name": "openai",
+				"api_key": "xxx",
+				"enabled": true,
+				"system_prompt": "You are a senior software engineer."
+			},
+			{
+				"name": "groq",
+				"api_key": "xxx",
+				"enabled": true
+			}
+		]
+	}
+`
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := c.GetSystemPrompt(OpenAI); v != "You are a senior software engineer." {
+		t.Fatalf("got %q, want the model system prompt", v)
+	}
+	if v := c.GetSystemPrompt(Groq); v != "You are a helpful AI assistant." {
+		t.Fatalf("got %q, want the global system prompt", v)
+	}
+	if v := c.GetSystemPrompt(Google); v != "You are a helpful AI assistant." {
+		t.Fatalf("got %q, want the global system prompt for unknown models", v)
+	}
+	if v := c.GetLLMModelSetting(OpenAI).SystemPrompt; v != "You are a senior software engineer." {
+		t.Fatalf("got %q, want the model system prompt in the model setting", v)
+	}
+}
+
+func TestConfig_Grok(t *testing.T) {
+	var c Settings
+
+	s := `
+	{
+		"discord_bot_token": "xxxx",
+		"models": [
+			{
+				"name": "grok",
+				"api_key": "xxx",
+				"enabled": true,
+				"has_tool_support": true,
+				"has_vision_support": true
+			}
+		]
+	}
+`
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := c.GetLLMModelSetting(Grok)
+	if ms.BaseURL != "https://api.x.ai/v1" || ms.Model != "grok-beta" {
+		t.Fatalf("got base_url %q and model %q, want the grok defaults", ms.BaseURL, ms.Model)
+	}
+	if !c.GetToolSupport(Grok) || !c.GetVisionSupport(Grok) {
+		t.Fatal("want tool and vision support")
+	}
+
+	var missingKey Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [{"name": "grok", "enabled": true}]}`), &missingKey); err == nil {
+		t.Fatal("expected error for missing grok api_key")
+	}
+}
+
+func TestConfig_ImageSettings(t *testing.T) {
+	var c Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [{"name": "openai", "api_key": "xxx", "enabled": true}]}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if ms := c.GetLLMModelSetting(OpenAI); ms.ImageModel != "dall-e-3" || ms.ImageSize != "1024x1024" {
+		t.Fatalf("got image_model %q and image_size %q, want the defaults", ms.ImageModel, ms.ImageSize)
+	}
+
+	var portrait Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [{"name": "openai", "api_key": "xxx", "enabled": true, "image_model": "gpt-image-1", "image_size": "1024x1536"}]}`), &portrait); err != nil {
+		t.Fatal(err)
+	}
+
+	var invalid Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [{"name": "openai", "api_key": "xxx", "enabled": true, "image_size": "100x100"}]}`), &invalid); err == nil {
+		t.Fatal("expected error for an unsupported image_size")
+	}
+}
+
+func TestSettings_IsAllowed(t *testing.T) {
+	var open Settings
+	if !open.IsAllowed("g1", "u1") || !open.IsAllowed("", "u1") {
+		t.Fatal("want everyone allowed without allowlists")
+	}
+
+	c := Settings{AllowedGuilds: []string{"g1"}, AllowedUsers: []string{"u1"}}
+	tests := []struct {
+		guild string
+		user  string
+		want  bool
+	}{
+		{"g1", "u1", true},
+		{"g1", "u2", false}, // users not listed, even in an allowed guild
+		{"g2", "u1", false}, // listed users in guilds not listed
+		{"", "u1", true},
+		{"g2", "u2", false},
+		{"", "u2", false}, // direct messages of users not listed
+	}
+	for _, tt := range tests {
+		if got := c.IsAllowed(tt.guild, tt.user); got != tt.want {
+			t.Fatalf("IsAllowed(%q, %q) = %v, want %v", tt.guild, tt.user, got, tt.want)
+		}
+	}
+
+	guildsOnly := Settings{AllowedGuilds: []string{"g1"}}
+	if guildsOnly.IsAllowed("", "u1") {
+		t.Fatal("want direct messages blocked when only guilds are allowed")
+	}
+	if !guildsOnly.IsAllowed("g1", "u2") || guildsOnly.IsAllowed("g2", "u2") {
+		t.Fatal("want everyone allowed in the listed guilds only")
+	}
+
+	usersOnly := Settings{AllowedUsers: []string{"u1"}}
+	if !usersOnly.IsAllowed("g2", "u1") || !usersOnly.IsAllowed("", "u1") || usersOnly.IsAllowed("g2", "u2") {
+		t.Fatal("want the listed users allowed everywhere and no one else")
+	}
+}
+
+func TestSettings_ChannelAllowed(t *testing.T) {
+	var open Settings
+	if !open.ChannelAllowed("g1", "c1", "") {
+		t.Fatal("want every channel allowed without an allowlist")
+	}
+
+	c := Settings{AllowedChannels: []string{"c1"}, AllowedGuilds: []string{"g1"}}
+	tests := []struct {
+		guild, channel, parent string
+		want                   bool
+	}{
+		{"g1", "c1", "", true},
+		{"g1", "c2", "", false},
+		{"g1", "t1", "c1", true}, // a thread of an allowed channel
+		{"g1", "t2", "c2", false},
+		{"", "dm", "", true}, // direct messages bypass the allowlist
+	}
+	for _, tt := range tests {
+		if got := c.ChannelAllowed(tt.guild, tt.channel, tt.parent); got != tt.want {
+			t.Errorf("ChannelAllowed(%q, %q, %q) = %v, want %v", tt.guild, tt.channel, tt.parent, got, tt.want)
+		}
+	}
+}
+
+func TestSettings_GetMaxImages(t *testing.T) {
+	var c Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": [{"name": "bedrock", "access_key_id": "x", "secret_access_key": "x", "enabled": true, "max_images": 4}]}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.GetMaxImages(Bedrock); v != 4 {
+		t.Fatalf("got %d, want the configured max_images", v)
+	}
+	if v := c.GetMaxImages(ChatGLM); v != 1 {
+		t.Fatalf("got %d, want the provider limit", v)
+	}
+	if v := c.GetMaxImages(OpenAI); v != 0 {
+		t.Fatalf("got %d, want no limit", v)
+	}
+}
+
+func TestConfig_DuplicateModels(t *testing.T) {
+	tests := []struct {
+		models  string
+		wantErr bool
+	}{
+		{`[{"name": "openai", "api_key": "a", "enabled": true}, {"name": "openai", "api_key": "b", "enabled": true}]`, true},
+		{`[{"name": "openai", "api_key": "a", "enabled": true}, {"name": "openai", "api_key": "b", "enabled": false}]`, false},
+		{`[{"name": "openai", "api_key": "a", "enabled": true}, {"name": "groq", "api_key": "b", "enabled": true}]`, false},
+		{`[{"name": "unknown", "enabled": true}]`, true},
+	}
+	for _, tt := range tests {
+		var c Settings
+		err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "models": `+tt.models+`}`), &c)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("models %s: got error %v, want error %v", tt.models, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSettings_IsReasoningModel(t *testing.T) {
+	var c Settings
+	s := `{"discord_bot_token": "xxxx", "models": [
+		{"name": "openai", "api_key": "xxx", "enabled": true, "model": "o1-mini"},
+		{"name": "azure", "api_key": "xxx", "base_url": "https://example.openai.azure.com", "enabled": true, "model": "o3", "is_reasoning_model": false},
+		{"name": "openrouter", "api_key": "xxx", "enabled": true, "model": "deepseek/deepseek-r1", "is_reasoning_model": true},
+		{"name": "groq", "api_key": "xxx", "enabled": true, "model": "o1-lookalike"}
+	]}`
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[LLMModel]bool{OpenAI: true, Azure: false, OpenRouter: true, Groq: false, Google: false} {
+		if got := c.IsReasoningModel(name); got != want {
+			t.Fatalf("IsReasoningModel(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSettings_Streams(t *testing.T) {
+	c := Settings{Models: []LLMSetting{{Name: Bedrock, ModelID: "meta.llama3-70b-instruct-v1:0"}}}
+	if c.Streams(Bedrock) {
+		t.Error("got llama on bedrock streaming")
+	}
+	c.Models[0].ModelID = "anthropic.claude-3-haiku-20240307-v1:0"
+	if !c.Streams(Bedrock) || !c.Streams(OpenAI) {
+		t.Error("got claude on bedrock or openai not streaming")
+	}
+}
+
+func TestSettings_HarmThreshold(t *testing.T) {
+	var c Settings
+	s := `{"discord_bot_token": "xxxx", "models": [{"name": "google", "api_key": "xxx", "enabled": true, "harm_threshold": "medium"}, {"name": "mistral", "api_key": "xxx", "enabled": true}]}`
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetLLMModelSetting(Google).HarmThreshold; got != HarmThresholdMedium {
+		t.Fatalf("got harm_threshold %q, want %q", got, HarmThresholdMedium)
+	}
+	if got := c.GetLLMModelSetting(Mistral).HarmThreshold; got != HarmThresholdNone {
+		t.Fatalf("got harm_threshold %q, want the default %q", got, HarmThresholdNone)
+	}
+
+	s = `{"discord_bot_token": "xxxx", "models": [{"name": "google", "api_key": "xxx", "enabled": true, "harm_threshold": "strict"}]}`
+	if err := json.Unmarshal([]byte(s), &c); err == nil {
+		t.Fatal("expected error for an unknown harm_threshold")
+	}
+}
+
+func TestSettings_GuildAllowsModel(t *testing.T) {
+	c := Settings{GuildModels: map[string][]LLMModel{"cheap": {Groq}}}
+
+	tests := []struct {
+		guildID string
+		model   LLMModel
+		want    bool
+	}{
+		{"cheap", Groq, true},
+		{"cheap", OpenAI, false},
+		{"other", OpenAI, true},
+		{"", OpenAI, true},
+	}
+	for _, tt := range tests {
+		if got := c.GuildAllowsModel(tt.guildID, tt.model); got != tt.want {
+			t.Errorf("GuildAllowsModel(%q, %q) = %v, want %v", tt.guildID, tt.model, got, tt.want)
+		}
+	}
+
+	s := `{"discord_bot_token": "xxxx", "guild_models": {"g": ["openai"]}, "models": [{"name": "groq", "api_key": "xxx", "enabled": true}]}`
+	if err := json.Unmarshal([]byte(s), &c); err == nil {
+		t.Fatal("expected error for a guild_models entry naming a disabled model")
+	}
+}
+
+func TestSettings_ImagePromptPrefix(t *testing.T) {
+	var c Settings
+	for s, ok := range map[string]bool{
+		`{"discord_bot_token": "xxxx", "models": [{"name": "openai", "api_key": "xxx", "enabled": true, "image_prompt_prefix": ""}]}`:                                  true,
+		`{"discord_bot_token": "xxxx", "models": [{"name": "openai", "api_key": "xxx", "enabled": true, "image_prompt_prefix": "` + strings.Repeat("x", 4000) + `"}]}`: false,
+		`{"discord_bot_token": "xxxx", "models": [{"name": "groq", "api_key": "xxx", "enabled": true, "image_prompt_prefix": "draw"}]}`:                                false,
+	} {
+		if err := json.Unmarshal([]byte(s), &c); (err == nil) != ok {
+			t.Errorf("got error %v, want ok %v", err, ok)
+		}
+	}
+}
+
+func TestLoadSettings_Env(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"telegram_bot_token": "file", "models": [
+		{"name": "openai", "api_key": "file", "enabled": true},
+		{"name": "groq", "api_key": "file", "enabled": true}
+	]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("LLMVERSE_TELEGRAM_BOT_TOKEN", "env")
+	t.Setenv("LLMVERSE_DISCORD_BOT_TOKEN", "env") // fills in a setting missing from the file
+	t.Setenv("LLMVERSE_OPENAI_API_KEY", "env")
+	t.Setenv("LLMVERSE_MISTRAL_API_KEY", "env") // no mistral model to override
+
+	s, err := LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.TelegramBotToken != "env" || s.DiscordBotToken != "env" {
+		t.Errorf("got telegram token %q, discord token %q, want both from env", s.TelegramBotToken, s.DiscordBotToken)
+	}
+	if len(s.Models) != 2 {
+		t.Fatalf("got %d models, want 2", len(s.Models))
+	}
+	if s.Models[0].APIKey != "env" || s.Models[1].APIKey != "file" {
+		t.Errorf("got api keys %q and %q, want env and file", s.Models[0].APIKey, s.Models[1].APIKey)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := envName("my-model", "api_key"); got != "LLMVERSE_MY_MODEL_API_KEY" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSettings_Sampling(t *testing.T) {
+	tests := []struct {
+		settings string
+		wantErr  bool
+	}{
+		{`"top_p": 1, "stop_words": ["END"]`, false},
+		{`"top_p": 0`, true},
+		{`"top_p": 1.5`, true},
+		{`"stop_words": [""]`, true},
+	}
+	for _, tt := range tests {
+		for _, s := range []string{
+			`{"discord_bot_token": "xxxx", ` + tt.settings + `}`,
+			`{"discord_bot_token": "xxxx", "models": [{"name": "groq", "api_key": "xxx", "enabled": true, ` + tt.settings + `}]}`,
+		} {
+			var c Settings
+			if err := json.Unmarshal([]byte(s), &c); (err != nil) != tt.wantErr {
+				t.Errorf("%s: got error %v, want error %v", s, err, tt.wantErr)
+			}
+		}
+	}
+}
+
+func TestSettings_CommandPrefix(t *testing.T) {
+	tests := []struct {
+		settings string
+		wantErr  bool
+	}{
+		{`"command_prefix": "!", "model_separator": ">"`, false},
+		{`"command_prefix": "!!"`, false},
+		{`"command_prefix": "a"`, true},
+		{`"command_prefix": "! "`, true},
+		{`"command_prefix": ":"`, true},
+		{`"model_separator": "$$"`, true},
+	}
+	for _, tt := range tests {
+		s := `{"discord_bot_token": "xxxx", ` + tt.settings + `}`
+		var c Settings
+		if err := json.Unmarshal([]byte(s), &c); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", s, err, tt.wantErr)
+		}
+	}
+
+	var c Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx", "model_separator": ">", "models": [{"name": "groq", "api_key": "xxx", "enabled": true}]}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.CommandPrefix != "$" {
+		t.Errorf("got command prefix %q, want the default $", c.CommandPrefix)
+	}
+	if got := c.GetLLMModel("groq> hello"); got != "groq" {
+		t.Errorf("got model %q, want groq", got)
+	}
+	if got := c.GetLLMModel("groq: hello"); got != "" {
+		t.Errorf("got model %q, want none with the default separator", got)
+	}
+}
+
+func TestSettings_StreamIntervals(t *testing.T) {
+	tests := []struct {
+		settings string
+		wantErr  bool
+	}{
+		{`"edit_interval_ms": 500, "typing_interval_ms": 1000`, false},
+		{`"edit_interval_ms": 100`, true},
+		{`"typing_interval_ms": 0`, true},
+	}
+	for _, tt := range tests {
+		s := `{"discord_bot_token": "xxxx", ` + tt.settings + `}`
+		var c Settings
+		if err := json.Unmarshal([]byte(s), &c); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", s, err, tt.wantErr)
+		}
+	}
+
+	var c Settings
+	if err := json.Unmarshal([]byte(`{"discord_bot_token": "xxxx"}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if *c.EditIntervalMs != 1000 || *c.TypingIntervalMs != 5000 {
+		t.Errorf("got intervals %d and %d, want the defaults", *c.EditIntervalMs, *c.TypingIntervalMs)
+	}
+}
+
+func TestSettings_DefaultModel(t *testing.T) {
+	tests := []struct {
+		settings string
+		wantErr  bool
+	}{
+		{`"default_model": "openai"`, false},
+		{`"default_model": "groq"`, true},
+		{`"default_model": "mistral"`, true},
+		{`"default_model": ""`, false},
+	}
+	for _, tt := range tests {
+		s := `{"discord_bot_token": "xxxx", "models": [{"name": "openai", "api_key": "a", "enabled": true}, {"name": "mistral", "api_key": "b", "enabled": false}], ` + tt.settings + `}`
+		var c Settings
+		if err := json.Unmarshal([]byte(s), &c); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.settings, err, tt.wantErr)
+		}
+	}
+}
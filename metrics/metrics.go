@@ -0,0 +1,75 @@
+// Package metrics records the prometheus metrics of the bot.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "llmverse_requests_total",
+		Help: "Number of generations per model.",
+	}, []string{"model"})
+	failures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "llmverse_errors_total",
+		Help: "Number of failed generations per model.",
+	}, []string{"model"})
+	latency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "llmverse_request_duration_seconds",
+		Help:    "Duration of the generations per model.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"model"})
+	tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "llmverse_tokens_total",
+		Help: "Number of tokens used per model, by type prompt or completion.",
+	}, []string{"model", "type"})
+	toolCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "llmverse_tool_calls_total",
+		Help: "Number of tool invocations per tool.",
+	}, []string{"tool"})
+	historyTrimmed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "llmverse_history_trimmed_messages_total",
+		Help: "Number of history messages dropped to fit the history limits.",
+	})
+	toolLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "llmverse_tool_duration_seconds",
+		Help:    "Duration of the tool invocations per tool.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tool"})
+)
+
+// ObserveRequest records a generation of the model that took d, and whether it failed.
+func ObserveRequest(model string, d time.Duration, failed bool) {
+	requests.WithLabelValues(model).Inc()
+	latency.WithLabelValues(model).Observe(d.Seconds())
+	if failed {
+		failures.WithLabelValues(model).Inc()
+	}
+}
+
+// AddTokens records the tokens a generation of the model used.
+func AddTokens(model string, prompt, completion int) {
+	tokens.WithLabelValues(model, "prompt").Add(float64(prompt))
+	tokens.WithLabelValues(model, "completion").Add(float64(completion))
+}
+
+// ObserveTool records an invocation of the tool that took d.
+func ObserveTool(tool string, d time.Duration) {
+	toolCalls.WithLabelValues(tool).Inc()
+	toolLatency.WithLabelValues(tool).Observe(d.Seconds())
+}
+
+// AddHistoryTrimmed records n messages dropped from a history.
+func AddHistoryTrimmed(n int) {
+	historyTrimmed.Add(float64(n))
+}
+
+// Handler serves the metrics in the prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
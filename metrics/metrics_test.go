@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	ObserveRequest("m", time.Second, true)
+	AddTokens("m", 10, 5)
+	ObserveTool("getTime", time.Millisecond)
+	AddHistoryTrimmed(3)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		`llmverse_requests_total{model="m"} 1`,
+		`llmverse_errors_total{model="m"} 1`,
+		`llmverse_request_duration_seconds_count{model="m"} 1`,
+		`llmverse_tokens_total{model="m",type="prompt"} 10`,
+		`llmverse_tokens_total{model="m",type="completion"} 5`,
+		`llmverse_tool_calls_total{tool="getTime"} 1`,
+		`llmverse_history_trimmed_messages_total 3`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+}